@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ATTACHMENT_MAX_SIZE bounds the files attached to the pages, kept in a
+// single document.
+const ATTACHMENT_MAX_SIZE = 8 * 1024 * 1024
+
+// attachment is a file referenced by a page, readable by the users who can
+// read the page.
+type attachment struct {
+	Id          primitive.ObjectID `bson:"_id"`
+	PageId      primitive.ObjectID `bson:"pageid"`
+	Name        string             `bson:"name"`
+	ContentType string             `bson:"contenttype"`
+	Data        []byte             `bson:"data"`
+	Date        time.Time          `bson:"date"`
+}
+
+func newAttachment(pageId primitive.ObjectID, name string, data []byte) *attachment {
+	ct := mime.TypeByExtension(path.Ext(name))
+	if ct == "" {
+		ct = http.DetectContentType(data)
+	}
+	return &attachment{
+		Id:          primitive.NewObjectID(),
+		PageId:      pageId,
+		Name:        path.Base(name),
+		ContentType: ct,
+		Data:        data,
+		Date:        time.Now(),
+	}
+}
+
+// url returns the path serving a.
+func (a *attachment) url() string {
+	return "/api/pages/" + a.PageId.Hex() + "/attachments/" + a.Id.Hex()
+}
+
+func apiPageAttachmentGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	p, err := getVisiblePage(c, getSessionUser(c), c.URLParams["pageId"])
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("apiPageAttachmentGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !isObjectIdHex(c.URLParams["attachmentId"]) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	a, err := getDocDb(c).Attachments.Get(p.Id, objectIdHex(c.URLParams["attachmentId"]))
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("apiPageAttachmentGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(a.Data)))
+	// uploaded files must not run as pages of the site
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Write(a.Data)
+}
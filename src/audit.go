@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	AUDIT_PER_PAGE     = 50
+	AUDIT_MAX_PER_PAGE = 500
+	AUDIT_EXPORT_LIMIT = 100000
+)
+
+// auditEntry is an append-only record of a change made by a user.
+type auditEntry struct {
+	Id     primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Actor  primitive.ObjectID `bson:"actor,omitempty" json:"actor,omitempty"`
+	Action string             `bson:"action" json:"action"`
+	Target string             `bson:"target" json:"target"`
+	Before interface{}        `bson:"before,omitempty" json:"before,omitempty"`
+	After  interface{}        `bson:"after,omitempty" json:"after,omitempty"`
+	IP     string             `bson:"ip,omitempty" json:"ip,omitempty"`
+	Date   time.Time          `bson:"date" json:"date"`
+
+	ActorName string `bson:"-" json:"actorName,omitempty"`
+}
+
+// userSummary is what the audit log keeps of a user.
+type userSummary struct {
+	Name            string        `bson:"name,omitempty" json:"name,omitempty"`
+	Email           string        `bson:"email,omitempty" json:"email,omitempty"`
+	Roles           []roleBinding `bson:"roles,omitempty" json:"roles,omitempty"`
+	Disabled        bool          `bson:"disabled" json:"disabled"`
+	PasswordChanged bool          `bson:"passwordchanged,omitempty" json:"passwordChanged,omitempty"`
+}
+
+func summarizeUser(u *user) userSummary {
+	return userSummary{Name: u.Name, Email: u.EMail, Roles: u.bindings(), Disabled: u.Disabled}
+}
+
+// pageSummary is what the audit log keeps of a page, without the body.
+type pageSummary struct {
+	Title    string               `bson:"title" json:"title"`
+	Access   AccessLevel          `bson:"access,omitempty" json:"access,omitempty"`
+	Projects []primitive.ObjectID `bson:"projects,omitempty" json:"projects,omitempty"`
+	Groups   []primitive.ObjectID `bson:"groups,omitempty" json:"groups,omitempty"`
+}
+
+func summarizePage(p *page) pageSummary {
+	return pageSummary{Title: p.Article.Title, Access: p.Access, Projects: p.Projects, Groups: p.Groups}
+}
+
+func remoteIP(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// recordAudit appends an entry to the audit log. Failures are logged but
+// never fail the audited operation.
+func recordAudit(db *docdb, r *http.Request, actor *user, action string, target string, before interface{}, after interface{}) {
+	e := auditEntry{
+		Id:     primitive.NewObjectID(),
+		Action: action,
+		Target: target,
+		Before: before,
+		After:  after,
+		IP:     remoteIP(r),
+		Date:   time.Now(),
+	}
+	if actor != nil {
+		e.Actor = actor.Id
+	}
+
+	if err := db.Audit.Insert(&e); err != nil {
+		log.Println("recordAudit failed: ", action, target, err)
+	}
+}
+
+// parseAuditTime accepts RFC 3339 or a plain date in the site timezone.
+func parseAuditTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, siteLocation)
+}
+
+// auditFilter selects audit entries. The zero value selects them all.
+type auditFilter struct {
+	Actor primitive.ObjectID
+	// Action is matched exactly, or as a prefix with ActionPrefix.
+	Action       string
+	ActionPrefix bool
+	Target       string
+	// From and To bound the date, To excluded, when not zero.
+	From time.Time
+	To   time.Time
+}
+
+func (f *auditFilter) matches(e *auditEntry) bool {
+	if !f.Actor.IsZero() && e.Actor != f.Actor {
+		return false
+	}
+	if f.ActionPrefix && !strings.HasPrefix(e.Action, f.Action) {
+		return false
+	}
+	if !f.ActionPrefix && f.Action != "" && e.Action != f.Action {
+		return false
+	}
+	if f.Target != "" && e.Target != f.Target {
+		return false
+	}
+	if !f.From.IsZero() && e.Date.Before(f.From) {
+		return false
+	}
+	return f.To.IsZero() || e.Date.Before(f.To)
+}
+
+// auditQuery builds the filter of the audit parameters: actor (user id),
+// action (exact, or a prefix when ending with "."), target, from and to.
+func auditQuery(r *http.Request) (auditFilter, []validationError) {
+	f := auditFilter{}
+	var errs []validationError
+
+	if actor := r.FormValue("actor"); actor != "" {
+		if isObjectIdHex(actor) {
+			f.Actor = objectIdHex(actor)
+		} else {
+			errs = append(errs, validationError{Field: "actor", Code: "invalid", Message: "actor must be a user id"})
+		}
+	}
+
+	if action := r.FormValue("action"); action != "" {
+		f.Action = action
+		f.ActionPrefix = action[len(action)-1] == '.'
+	}
+
+	f.Target = r.FormValue("target")
+
+	for _, field := range []string{"from", "to"} {
+		v := r.FormValue(field)
+		if v == "" {
+			continue
+		}
+		t, err := parseAuditTime(v)
+		if err != nil {
+			errs = append(errs, validationError{Field: field, Code: "invalid", Message: field + " must be a date or RFC 3339 time"})
+			continue
+		}
+		if field == "from" {
+			f.From = t
+			continue
+		}
+		// a plain "to" date includes the whole day
+		if len(v) == len("2006-01-02") {
+			t = t.AddDate(0, 0, 1)
+		}
+		f.To = t
+	}
+
+	return f, errs
+}
+
+// nameActors fills ActorName of the entries.
+func nameActors(db *docdb, entries []auditEntry) error {
+	var ids []primitive.ObjectID
+	for _, e := range entries {
+		if !e.Actor.IsZero() {
+			ids = append(ids, e.Actor)
+		}
+	}
+
+	names, err := userNames(db, ids)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		entries[i].ActorName = names[entries[i].Actor]
+	}
+	return nil
+}
+
+type auditPage struct {
+	Entries []auditEntry `json:"entries"`
+	Total   int          `json:"total"`
+	Page    int          `json:"page"`
+	PerPage int          `json:"perPage"`
+}
+
+func formInt(r *http.Request, name string, def int) int {
+	n, err := strconv.Atoi(r.FormValue(name))
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
+func apiAuditGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	filter, errs := auditQuery(r)
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	res := auditPage{Entries: []auditEntry{}, Page: formInt(r, "page", 1), PerPage: formInt(r, "perPage", AUDIT_PER_PAGE)}
+	if res.PerPage > AUDIT_MAX_PER_PAGE {
+		res.PerPage = AUDIT_MAX_PER_PAGE
+	}
+
+	docdb := getDocDb(c)
+
+	var err error
+	if res.Total, err = docdb.Audit.Count(filter); err != nil {
+		log.Println("apiAuditGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res.Entries, err = docdb.Audit.Find(filter, (res.Page-1)*res.PerPage, res.PerPage)
+	if err == nil {
+		err = nameActors(docdb, res.Entries)
+	}
+	if err != nil {
+		log.Println("apiAuditGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	me := getSessionUser(c)
+	for i := range res.Entries {
+		res.Entries[i].Date = me.localTime(res.Entries[i].Date)
+	}
+
+	js, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+var auditCSVHeader = []string{"date", "actor", "actor_name", "action", "target", "ip", "before", "after"}
+
+func auditSummaryJSON(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	js, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(js)
+}
+
+func apiAuditExportGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	filter, errs := auditQuery(r)
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	docdb := getDocDb(c)
+	entries, err := docdb.Audit.Find(filter, 0, AUDIT_EXPORT_LIMIT)
+	if err == nil {
+		err = nameActors(docdb, entries)
+	}
+	if err != nil {
+		log.Println("apiAuditExportGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+
+	me := getSessionUser(c)
+	cw := csv.NewWriter(w)
+	cw.Write(auditCSVHeader)
+	for _, e := range entries {
+		actor := ""
+		if !e.Actor.IsZero() {
+			actor = e.Actor.Hex()
+		}
+		cw.Write([]string{
+			me.localTime(e.Date).Format(time.RFC3339),
+			actor,
+			e.ActorName,
+			e.Action,
+			e.Target,
+			e.IP,
+			auditSummaryJSON(e.Before),
+			auditSummaryJSON(e.After),
+		})
+	}
+	cw.Flush()
+}
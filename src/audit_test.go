@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestAuditQuery(t *testing.T) {
+	actor := primitive.NewObjectID()
+	r, _ := http.NewRequest("GET", "/api/admin/audit?actor="+actor.Hex()+"&action=user.&target=user:1&from=2015-11-01&to=2015-11-30", nil)
+
+	f, errs := auditQuery(r)
+	if len(errs) != 0 {
+		t.Fatal("unexpected errors:", errs)
+	}
+
+	if f.Actor != actor || f.Target != "user:1" {
+		t.Error("actor or target filter unexpected:", f)
+	}
+	if f.Action != "user." || !f.ActionPrefix {
+		t.Error("action should be a prefix:", f)
+	}
+	if !f.To.Equal(time.Date(2015, 12, 1, 0, 0, 0, 0, siteLocation)) {
+		t.Error("to should include the whole day:", f.To)
+	}
+
+	e := auditEntry{Actor: actor, Action: "user.update", Target: "user:1", Date: time.Date(2015, 11, 30, 23, 0, 0, 0, siteLocation)}
+	if !f.matches(&e) {
+		t.Error("entry should match:", e)
+	}
+	e.Action = "group.update"
+	if f.matches(&e) {
+		t.Error("entry of another action should not match:", e)
+	}
+
+	r, _ = http.NewRequest("GET", "/api/admin/audit?actor=someone&from=yesterday", nil)
+	if _, errs := auditQuery(r); len(errs) != 2 {
+		t.Error("invalid actor and date should be reported:", errs)
+	}
+}
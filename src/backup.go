@@ -0,0 +1,547 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A backup is a gzipped tar holding one file per collection, its documents
+// in canonical extended JSON one per line, then a manifest listing the files
+// with their count and checksum.
+const (
+	// BACKUP_FORMAT is the version of the archives written. Archives of a
+	// newer format are refused.
+	BACKUP_FORMAT   = 1
+	BACKUP_MANIFEST = "manifest.json"
+
+	backupBatchSize = 500
+)
+
+var ErrBackupInvalid = errors.New("invalid backup")
+
+type backupCollection struct {
+	Name   string `json:"name"`
+	File   string `json:"file"`
+	Count  int    `json:"count"`
+	Sha256 string `json:"sha256"`
+}
+
+type backupManifest struct {
+	Format  int       `json:"format"`
+	Created time.Time `json:"created"`
+	// Schema is the latest migration applied to the database.
+	Schema      int                `json:"schema"`
+	Collections []backupCollection `json:"collections"`
+}
+
+type backupWriter struct {
+	gz       *gzip.Writer
+	tw       *tar.Writer
+	manifest backupManifest
+}
+
+func newBackupWriter(w io.Writer, schema int) *backupWriter {
+	gz := gzip.NewWriter(w)
+	return &backupWriter{
+		gz:       gz,
+		tw:       tar.NewWriter(gz),
+		manifest: backupManifest{Format: BACKUP_FORMAT, Created: time.Now(), Schema: schema},
+	}
+}
+
+func (b *backupWriter) addFile(name string, size int64, r io.Reader) error {
+	err := b.tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: size, ModTime: b.manifest.Created})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(b.tw, r)
+	return err
+}
+
+// addCollection adds the documents returned by next until it returns
+// io.EOF. They are spooled to a temporary file, tar needing the size first.
+func (b *backupWriter) addCollection(name string, next func() (interface{}, error)) error {
+	tmp, err := os.CreateTemp("", "irori-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	c := backupCollection{Name: name, File: name + ".jsonl"}
+	sum := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(tmp, sum))
+	for {
+		doc, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		line, err := bson.MarshalExtJSON(doc, true, false)
+		if err != nil {
+			return err
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+		c.Count++
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	c.Sha256 = hexSum(sum)
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := b.addFile(c.File, size, tmp); err != nil {
+		return err
+	}
+
+	b.manifest.Collections = append(b.manifest.Collections, c)
+	return nil
+}
+
+// close writes the manifest and ends the archive.
+func (b *backupWriter) close() error {
+	js, _ := json.MarshalIndent(b.manifest, "", "  ")
+	if err := b.addFile(BACKUP_MANIFEST, int64(len(js)), strings.NewReader(string(js))); err != nil {
+		return err
+	}
+	if err := b.tw.Close(); err != nil {
+		return err
+	}
+	return b.gz.Close()
+}
+
+// readBackup reads the archive r, calling f with the documents of each
+// collection when it is not nil, and verifies them against the manifest.
+// As the manifest comes last, the documents are only known to be valid once
+// readBackup returns: read it once without f before using them.
+func readBackup(r io.Reader, f func(collection string, doc bson.D) error) (*backupManifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+
+	var manifest *backupManifest
+	read := map[string]backupCollection{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if h.Name == BACKUP_MANIFEST {
+			manifest = &backupManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("%v: manifest: %v", ErrBackupInvalid, err)
+			}
+			continue
+		}
+
+		if !strings.HasSuffix(h.Name, ".jsonl") {
+			return nil, fmt.Errorf("%v: unexpected file %s", ErrBackupInvalid, h.Name)
+		}
+		c := backupCollection{Name: strings.TrimSuffix(h.Name, ".jsonl"), File: h.Name}
+		if c.Count, c.Sha256, err = readBackupCollection(tr, c.Name, f); err != nil {
+			return nil, err
+		}
+		read[c.File] = c
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("%v: no manifest", ErrBackupInvalid)
+	}
+	if manifest.Format > BACKUP_FORMAT {
+		return nil, fmt.Errorf("%v: format %d is newer than this irori", ErrBackupInvalid, manifest.Format)
+	}
+	if len(read) != len(manifest.Collections) {
+		return nil, fmt.Errorf("%v: %d files for %d collections", ErrBackupInvalid, len(read), len(manifest.Collections))
+	}
+	for _, c := range manifest.Collections {
+		if read[c.File] != c {
+			return nil, fmt.Errorf("%v: %s doesn't match the manifest", ErrBackupInvalid, c.File)
+		}
+	}
+	return manifest, nil
+}
+
+func readBackupCollection(r io.Reader, name string, f func(collection string, doc bson.D) error) (int, string, error) {
+	sum := sha256.New()
+	sc := bufio.NewScanner(io.TeeReader(r, sum))
+	sc.Buffer(nil, 64*1024*1024)
+
+	n := 0
+	for sc.Scan() {
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(sc.Bytes(), true, &doc); err != nil {
+			return 0, "", fmt.Errorf("%v: %s line %d: %v", ErrBackupInvalid, name, n+1, err)
+		}
+		if f != nil {
+			if err := f(name, doc); err != nil {
+				return 0, "", err
+			}
+		}
+		n++
+	}
+	if err := sc.Err(); err != nil {
+		return 0, "", err
+	}
+	return n, hexSum(sum), nil
+}
+
+func hexSum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// schemaVersion returns the latest migration applied to db.
+func schemaVersion(db *docdb) (int, error) {
+	var records []appliedMigration
+	if err := db.C("migrations").findAll(bson.M{}, &records); err != nil {
+		return 0, err
+	}
+	v := 0
+	for _, a := range records {
+		if a.Version > v {
+			v = a.Version
+		}
+	}
+	return v, nil
+}
+
+// collectionNames returns the collections of db, without the system ones.
+func collectionNames(db *docdb) ([]string, error) {
+	all, err := db.Db.ListCollectionNames(db.Ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range all {
+		if !strings.HasPrefix(name, "system.") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// writeBackup writes every collection of db to w.
+func writeBackup(db *docdb, w io.Writer, out io.Writer) error {
+	schema, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	names, err := collectionNames(db)
+	if err != nil {
+		return err
+	}
+
+	b := newBackupWriter(w, schema)
+	for _, name := range names {
+		cur, err := db.Db.Collection(name).Find(db.Ctx, bson.M{})
+		if err != nil {
+			return err
+		}
+
+		err = b.addCollection(name, func() (interface{}, error) {
+			if cur.Next(db.Ctx) {
+				return cur.Current, nil
+			}
+			if err := cur.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		})
+		cur.Close(db.Ctx)
+		if err != nil {
+			return fmt.Errorf("backup of %s failed: %v", name, err)
+		}
+		fmt.Fprintf(out, "%s: %d documents\n", name, b.manifest.Collections[len(b.manifest.Collections)-1].Count)
+	}
+	return b.close()
+}
+
+// verifyBackup reads the archive path and checks it against its manifest.
+func verifyBackup(path string) (*backupManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readBackup(f, nil)
+}
+
+// backupCommand runs "irori backup [-o file]" and "irori backup -verify file".
+func backupCommand(db *docdb, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	path := fs.String("o", "irori-backup-"+time.Now().Format("20060102-150405")+".tar.gz", "archive written")
+	verify := fs.String("verify", "", "only verify the archive `file`")
+	fs.Parse(args)
+
+	if *verify != "" {
+		m, err := verifyBackup(*verify)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d collections, created %s, valid\n", *verify, len(m.Collections), m.Created.Format(time.RFC3339))
+		return nil
+	}
+
+	if !db.hasMongo() {
+		return fmt.Errorf("backup %w, copy its file while irori is stopped", ErrUnsupported)
+	}
+
+	f, err := os.OpenFile(*path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeBackup(db, f, os.Stdout)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(*path)
+		return err
+	}
+
+	if _, err := verifyBackup(*path); err != nil {
+		return fmt.Errorf("%s written but unreadable: %v", *path, err)
+	}
+	fmt.Printf("backup written to %s\n", *path)
+	return nil
+}
+
+// backupInserter inserts the documents of a restore in batches.
+type backupInserter struct {
+	db         *docdb
+	collection string
+	batch      []interface{}
+	counts     map[string]int
+}
+
+func (ins *backupInserter) add(collection string, doc bson.D) error {
+	if collection != ins.collection || len(ins.batch) >= backupBatchSize {
+		if err := ins.flush(); err != nil {
+			return err
+		}
+		ins.collection = collection
+	}
+	ins.batch = append(ins.batch, doc)
+	return nil
+}
+
+func (ins *backupInserter) flush() error {
+	if len(ins.batch) == 0 {
+		return nil
+	}
+	if _, err := ins.db.Db.Collection(ins.collection).InsertMany(ins.db.Ctx, ins.batch); err != nil {
+		return fmt.Errorf("restore of %s failed: %v", ins.collection, err)
+	}
+	ins.counts[ins.collection] += len(ins.batch)
+	ins.batch = nil
+	return nil
+}
+
+// docValue returns the value of key in doc, or nil.
+func docValue(doc bson.D, key string) interface{} {
+	for _, e := range doc {
+		if e.Key == key {
+			return e.Value
+		}
+	}
+	return nil
+}
+
+// projectBackupFilter selects the documents of the project named name: the
+// project, its pages, their revisions and attachments. It learns them from
+// a first reading of the archive with scan.
+type projectBackupFilter struct {
+	name    string
+	project primitive.ObjectID
+	// projects of each page
+	pageProjects map[primitive.ObjectID]bson.A
+}
+
+func (pf *projectBackupFilter) scan(collection string, doc bson.D) error {
+	switch collection {
+	case "projects":
+		if docValue(doc, "name") == pf.name {
+			pf.project, _ = docValue(doc, "_id").(primitive.ObjectID)
+		}
+
+	case "pages":
+		id, _ := docValue(doc, "_id").(primitive.ObjectID)
+		pf.pageProjects[id], _ = docValue(doc, "projects").(bson.A)
+	}
+	return nil
+}
+
+func (pf *projectBackupFilter) hasPage(id interface{}) bool {
+	pageId, _ := id.(primitive.ObjectID)
+	for _, pid := range pf.pageProjects[pageId] {
+		if pid == pf.project {
+			return true
+		}
+	}
+	return false
+}
+
+func (pf *projectBackupFilter) selects(collection string, doc bson.D) bool {
+	switch collection {
+	case "projects":
+		return docValue(doc, "_id") == pf.project
+	case "pages":
+		return pf.hasPage(docValue(doc, "_id"))
+	case "revisions", "attachments":
+		return pf.hasPage(docValue(doc, "pageid"))
+	}
+	return false
+}
+
+// newProjectBackupFilter returns the filter of the project name of the
+// archive path, verifying it.
+func newProjectBackupFilter(path string, name string) (*projectBackupFilter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pf := &projectBackupFilter{name: name, pageProjects: map[primitive.ObjectID]bson.A{}}
+	if _, err := readBackup(f, pf.scan); err != nil {
+		return nil, err
+	}
+	if pf.project.IsZero() {
+		return nil, fmt.Errorf("no project %s in %s", name, path)
+	}
+	return pf, nil
+}
+
+// restoreBackup restores the archive path into db, which must be empty.
+func restoreBackup(db *docdb, path string, out io.Writer) error {
+	m, err := verifyBackup(path)
+	if err != nil {
+		return err
+	}
+	if latest := migrations[len(migrations)-1].Version; m.Schema > latest {
+		return fmt.Errorf("%s is from a newer irori: migration %d is unknown", path, m.Schema)
+	}
+
+	names, err := collectionNames(db)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if n, err := db.C(name).count(bson.M{}); err != nil {
+			return err
+		} else if n > 0 {
+			return fmt.Errorf("the database is not empty: %s has %d documents", name, n)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ins := &backupInserter{db: db, counts: map[string]int{}}
+	if _, err := readBackup(f, ins.add); err != nil {
+		return err
+	}
+	if err := ins.flush(); err != nil {
+		return err
+	}
+	for _, c := range m.Collections {
+		fmt.Fprintf(out, "%s: %d documents\n", c.Name, ins.counts[c.Name])
+	}
+	return ensureIndexes(db, false, out)
+}
+
+// restoreBackupProject restores the project name of the archive path into
+// db with its pages, their revisions and attachments. The documents already in db are
+// skipped, the users and groups are not restored.
+func restoreBackupProject(db *docdb, path string, name string, out io.Writer) error {
+	pf, err := newProjectBackupFilter(path, name)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	restored, skipped := map[string]int{}, map[string]int{}
+	_, err = readBackup(f, func(collection string, doc bson.D) error {
+		if !pf.selects(collection, doc) {
+			return nil
+		}
+
+		err := db.C(collection).insert(doc)
+		if err == ErrDuplicate && collection == "projects" {
+			return fmt.Errorf("project %s already exists", name)
+		} else if err == ErrDuplicate {
+			skipped[collection]++
+			return nil
+		} else if err != nil {
+			return err
+		}
+		restored[collection]++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, collection := range []string{"projects", "pages", "revisions", "attachments"} {
+		fmt.Fprintf(out, "%s: %d documents restored, %d already there\n", collection, restored[collection], skipped[collection])
+	}
+	return nil
+}
+
+// restoreCommand runs "irori restore [-project name] file".
+func restoreCommand(db *docdb, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	project := fs.String("project", "", "restore only the project `name`, its pages and their history")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: irori restore [-project name] file")
+	}
+	if !db.hasMongo() {
+		return fmt.Errorf("restore %w, copy its file back while irori is stopped", ErrUnsupported)
+	}
+
+	if *project != "" {
+		return restoreBackupProject(db, fs.Arg(0), *project, os.Stdout)
+	}
+	return restoreBackup(db, fs.Arg(0), os.Stdout)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// docsOf returns a next function for backupWriter.addCollection.
+func docsOf(docs ...interface{}) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		if len(docs) == 0 {
+			return nil, io.EOF
+		}
+		doc := docs[0]
+		docs = docs[1:]
+		return doc, nil
+	}
+}
+
+func TestBackupArchive(t *testing.T) {
+	pid, pageId, otherPage := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	date := time.Date(2024, 3, 20, 12, 0, 0, 0, time.UTC)
+
+	write := func(tamper func(b *backupWriter)) []byte {
+		var buf bytes.Buffer
+		b := newBackupWriter(&buf, 5)
+		collections := []struct {
+			name string
+			docs []interface{}
+		}{
+			{"pages", []interface{}{
+				bson.D{{Key: "_id", Value: pageId}, {Key: "projects", Value: bson.A{pid}}},
+				bson.D{{Key: "_id", Value: otherPage}, {Key: "projects", Value: bson.A{}}},
+			}},
+			{"projects", []interface{}{bson.D{{Key: "_id", Value: pid}, {Key: "name", Value: "irori"}}}},
+			{"revisions", []interface{}{
+				bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "pageid", Value: pageId},
+					{Key: "body", Value: []byte{1, 2, 3}}, {Key: "date", Value: date}},
+				bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "pageid", Value: otherPage}},
+			}},
+		}
+		for _, c := range collections {
+			if err := b.addCollection(c.name, docsOf(c.docs...)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tamper != nil {
+			tamper(b)
+		}
+		if err := b.close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	archive := write(nil)
+	pf := &projectBackupFilter{name: "irori", pageProjects: map[primitive.ObjectID]bson.A{}}
+	m, err := readBackup(bytes.NewReader(archive), pf.scan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var revisions []bson.D
+	selected := 0
+	_, err = readBackup(bytes.NewReader(archive), func(collection string, doc bson.D) error {
+		if collection == "revisions" {
+			revisions = append(revisions, doc)
+		}
+		if pf.selects(collection, doc) {
+			selected++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Format != BACKUP_FORMAT || m.Schema != 5 || len(m.Collections) != 3 || m.Collections[0].Count != 2 {
+		t.Error("manifest unexpected:", m)
+	}
+
+	// the types survive the JSON
+	if len(revisions) != 2 || docValue(revisions[0], "pageid") != pageId ||
+		!bytes.Equal(docValue(revisions[0], "body").(primitive.Binary).Data, []byte{1, 2, 3}) ||
+		docValue(revisions[0], "date").(primitive.DateTime).Time().UTC() != date {
+		t.Error("revisions unexpected:", revisions)
+	}
+
+	// the project, its page and the revision of the page
+	if selected != 3 {
+		t.Error("project filter selected:", selected)
+	}
+
+	tampered := write(func(b *backupWriter) { b.manifest.Collections[1].Count++ })
+	if _, err := readBackup(bytes.NewReader(tampered), nil); err == nil || !strings.Contains(err.Error(), "projects.jsonl") {
+		t.Error("archive not matching its manifest should be refused:", err)
+	}
+
+	newer := write(func(b *backupWriter) { b.manifest.Format = BACKUP_FORMAT + 1 })
+	if _, err := readBackup(bytes.NewReader(newer), nil); err == nil {
+		t.Error("archive of a newer format should be refused")
+	}
+
+	if _, err := readBackup(bytes.NewReader(archive[:len(archive)/2]), nil); err == nil {
+		t.Error("truncated archive should be refused")
+	}
+}
+
+func TestCommandsUnsupported(t *testing.T) {
+	db := newMemoryDocDb()
+	for name, args := range map[string][]string{
+		"backup":  nil,
+		"restore": {"irori.tar.gz"},
+		"migrate": nil,
+		"indexes": nil,
+	} {
+		if err := commands[name](db, args); !errors.Is(err, ErrUnsupported) {
+			t.Error(name, "should fail without MongoDB:", err)
+		}
+	}
+}
@@ -14,8 +14,8 @@ import (
 	_ "github.com/flosch/pongo2-addons"
 	"github.com/zenazn/goji/web"
 
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/cupcake/sigil/gen"
 
@@ -30,27 +30,88 @@ type pageHook interface {
 var pageHooks []pageHook
 
 type group struct {
-	Id    bson.ObjectId   `bson:"_id,omitempty" json:"id,omitempty"`
-	Name  string          `json:"name"`
-	Users []bson.ObjectId `json:"users"`
+	Id     primitive.ObjectID   `bson:"_id,omitempty" json:"id,omitempty"`
+	Name   string               `json:"name"`
+	Users  []primitive.ObjectID `json:"users"`
+	Admins []primitive.ObjectID `bson:"admins,omitempty" json:"admins"`
+	Roles  []roleBinding        `bson:"roles,omitempty" json:"roles"`
 }
 
-func groupListFilter(u *user) bson.M {
-	if u.HasPermission(ADMIN) {
-		return bson.M{}
+// editedGroup holds the fields of a group update, nil when unchanged.
+type editedGroup struct {
+	Name   *string               `json:"name"`
+	Users  *[]primitive.ObjectID `json:"users"`
+	Admins *[]primitive.ObjectID `json:"admins"`
+}
+
+func containsId(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// groupListQuery selects the groups visible to the user: every group for
+// group managers, otherwise the groups the user belongs to or administers.
+func groupListQuery(u *user) groupQuery {
+	if u.HasPermission(GROUP_MANAGE) {
+		return groupQuery{}
+	}
+	return groupQuery{Member: u.Id}
+}
+
+// canManageGroup reports whether the user may change the members of g.
+func (u *user) canManageGroup(g *group) bool {
+	return u.HasPermission(GROUP_MANAGE) || containsId(g.Admins, u.Id)
+}
+
+// apiNeedGroupManager loads the group of :groupId into c.Env["group"] and
+// lets only its managers through.
+func apiNeedGroupManager(c web.C, w http.ResponseWriter, r *http.Request) bool {
+	gid := c.URLParams["groupId"]
+	if !isObjectIdHex(gid) {
+		w.WriteHeader(http.StatusNotFound)
+		return false
 	}
 
-	return bson.M{"users": u.Id}
+	g, err := getDocDb(c).Groups.Get(objectIdHex(gid))
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	} else if err != nil {
+		log.Println("apiNeedGroupManager: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+
+	me := getSessionUser(c)
+	if !me.canManageGroup(g) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	// a token must carry the admin scope to use managing permissions
+	if t := getSessionToken(c); t != nil && !containsId(g.Admins, me.Id) && !t.HasScope(SCOPE_ADMIN) {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+
+	c.Env["group"] = g
+	return true
+}
+
+// precond: must call after apiNeedGroupManager
+func getEnvGroup(c web.C) *group {
+	return c.Env["group"].(*group)
 }
 
 func apiGroupListGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	docdb := getDocDb(c)
 
-	groups := []group{}
-
-	err := docdb.Db.C("groups").Find(bson.M{}).All(&groups)
+	groups, err := docdb.Groups.List(groupListQuery(getSessionUser(c)))
 	if err != nil {
-		log.Fatal("!!!!! get groups")
+		log.Println("apiGroupListGetHandler: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -58,7 +119,7 @@ func apiGroupListGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	js, err := json.Marshal(groups)
 
 	if err != nil {
-		log.Fatal("!!!!! json.Marshal")
+		log.Println("apiGroupListGetHandler: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -68,26 +129,30 @@ func apiGroupListGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 }
 
 func apiGroupGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
-	gid := bson.ObjectIdHex(c.URLParams["groupId"])
-
-	if !gid.Valid() {
+	if !isObjectIdHex(c.URLParams["groupId"]) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	gid := objectIdHex(c.URLParams["groupId"])
 
 	docdb := getDocDb(c)
 
-	var group group
-	err := docdb.Db.C("groups").FindId(gid).One(&group)
-	if err == mgo.ErrNotFound {
+	group, err := docdb.Groups.Get(gid)
+	if err == ErrNotFound {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	} else if err != nil {
-		log.Fatal(err)
+		log.Println("apiGroupGetHandler: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	// invisible groups are reported as missing
+	if !groupListQuery(getSessionUser(c)).matches(group) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
 	js, _ := json.Marshal(group)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(js)
@@ -103,70 +168,354 @@ func apiGroupCreateHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: verify incomming
+	if group.Name == "" {
+		writeValidationErrors(w, []validationError{
+			{Field: "name", Code: "required", Message: "name is required"}})
+		return
+	}
+
+	// roles are granted through /api/groups/:groupId/roles only
+	group.Id = primitive.NewObjectID()
+	group.Roles = nil
 
-	changeinfo, err := docdb.Db.C("groups").Upsert(bson.M{"name": group.Name},
-		bson.M{"$setOnInsert": group})
-	if err != nil {
+	err := docdb.Groups.Insert(&group)
+	if err == ErrDuplicate {
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	if changeinfo.UpsertedId == nil {
+	recordAudit(docdb, r, getSessionUser(c), "group.create", "group:"+group.Id.Hex(), nil, group)
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// verifyUserIds checks that every id refers to an existing user.
+func verifyUserIds(db *docdb, field string, ids []primitive.ObjectID) ([]validationError, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	n, err := db.Users.Count(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	if n != len(uniqueIds(ids)) {
+		return []validationError{{Field: field, Code: "unknown", Message: "unknown user in " + field}}, nil
+	}
+	return nil, nil
+}
+
+// sameIds compares two sets of ids, ignoring their order and duplicates.
+func sameIds(a []primitive.ObjectID, b []primitive.ObjectID) bool {
+	a, b = uniqueIds(a), uniqueIds(b)
+	if len(a) != len(b) {
+		return false
+	}
+	for _, id := range a {
+		if !containsId(b, id) {
+			return false
+		}
+	}
+	return true
+}
+
+func uniqueIds(ids []primitive.ObjectID) []primitive.ObjectID {
+	var uniq []primitive.ObjectID
+	for _, id := range ids {
+		if !containsId(uniq, id) {
+			uniq = append(uniq, id)
+		}
+	}
+	return uniq
+}
+
+// apiGroupPutHandler updates the given fields of a group. Group admins may
+// change the members only; the name and the admins need GROUP_MANAGE.
+func apiGroupPutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	docdb := getDocDb(c)
+	me := getSessionUser(c)
+	old := getEnvGroup(c)
+
+	defer r.Body.Close()
+	var eg editedGroup
+	if err := json.NewDecoder(r.Body).Decode(&eg); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	renamed := eg.Name != nil && *eg.Name != old.Name
+	if (renamed || eg.Admins != nil) && !me.HasPermission(GROUP_MANAGE) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if eg.Users != nil && !sameIds(*eg.Users, old.Users) {
+		if ok, err := canChangeGroupMembers(docdb, me, old); err != nil {
+			log.Println("apiGroupPutHandler: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	g := *old
+	var errs []validationError
+
+	if renamed {
+		if *eg.Name == "" {
+			errs = append(errs, validationError{Field: "name", Code: "required", Message: "name is required"})
+		} else if _, err := docdb.Groups.FindByName(*eg.Name); err == nil {
+			errs = append(errs, validationError{Field: "name", Code: "taken", Message: "name is already used"})
+		} else if err != ErrNotFound {
+			log.Println("apiGroupPutHandler: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		g.Name = *eg.Name
+	}
+
+	for _, f := range []struct {
+		field string
+		ids   *[]primitive.ObjectID
+		dst   *[]primitive.ObjectID
+	}{{"users", eg.Users, &g.Users}, {"admins", eg.Admins, &g.Admins}} {
+		if f.ids == nil {
+			continue
+		}
+		ves, err := verifyUserIds(docdb, f.field, *f.ids)
+		if err != nil {
+			log.Println("apiGroupPutHandler: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		errs = append(errs, ves...)
+		*f.dst = uniqueIds(*f.ids)
+	}
+
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	if err := docdb.Groups.Update(&g); err == ErrDuplicate {
 		w.WriteHeader(http.StatusConflict)
 		return
+	} else if err != nil {
+		log.Println("apiGroupPutHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	recordAudit(docdb, r, me, "group.update", "group:"+g.Id.Hex(), old, g)
+
+	js, _ := json.Marshal(g)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
 }
 
-func apiGroupPutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+// apiGroupDeleteHandler removes a group and its references from the pages.
+func apiGroupDeleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	if !isObjectIdHex(c.URLParams["groupId"]) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	gid := objectIdHex(c.URLParams["groupId"])
+
 	docdb := getDocDb(c)
 
-	groupId := bson.ObjectIdHex(c.URLParams["groupId"])
+	g, err := docdb.Groups.Get(gid)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("apiGroupDeleteHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	defer r.Body.Close()
-	var group group
-	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+	if err := docdb.Groups.Remove(gid); err != nil {
+		log.Println("apiGroupDeleteHandler: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	// TODO: verify incomming
+	// pages shared with the group stay visible to their authors
+	if _, err := docdb.Pages.PullGroup(gid); err != nil {
+		log.Println("apiGroupDeleteHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	err := docdb.Db.C("groups").UpdateId(groupId, group)
-	if err != nil {
-		log.Println(err)
+	recordAudit(docdb, r, getSessionUser(c), "group.delete", "group:"+gid.Hex(), g, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateGroupMember adds or removes :userId of the group with update, either
+// AddMember or RemoveMember of the group store.
+func updateGroupMember(c web.C, w http.ResponseWriter, r *http.Request, update func(gid, uid primitive.ObjectID) error, action string) {
+	if !isObjectIdHex(c.URLParams["userId"]) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	uid := objectIdHex(c.URLParams["userId"])
+
+	docdb := getDocDb(c)
+	g := getEnvGroup(c)
+
+	if ok, err := canChangeGroupMembers(docdb, getSessionUser(c), g); err != nil {
+		log.Println("updateGroupMember: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
+	} else if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
 	}
 
-	js, _ := json.Marshal(group)
-	w.Write(js)
+	if _, err := docdb.Users.Get(uid); err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("updateGroupMember: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := update(g.Id, uid); err != nil {
+		log.Println("updateGroupMember: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(docdb, r, getSessionUser(c), action, "group:"+g.Id.Hex(), nil, bson.M{"user": uid})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiGroupMemberPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	updateGroupMember(c, w, r, getDocDb(c).Groups.AddMember, "group.member.add")
+}
+
+func apiGroupMemberDeleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	updateGroupMember(c, w, r, getDocDb(c).Groups.RemoveMember, "group.member.remove")
 }
 
 func groupEditHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	groupId := c.URLParams["groupId"]
 
-	objid := bson.ObjectIdHex(groupId)
-	if !objid.Valid() {
+	if !isObjectIdHex(groupId) {
 		log.Println("invalid groupId:", groupId)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	objid := objectIdHex(groupId)
+
+	g, err := getDocDb(c).Groups.Get(objid)
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	executeWriterFromFile(w, "view/edit-group.html", &pongo2.Context{"groupid": objid.Hex()})
+	me := getSessionUser(c)
+	if !me.canManageGroup(g) {
+		http.Error(w, "You are not an admin of this group", http.StatusForbidden)
+		return
+	}
+
+	executeWriterFromFile(w, "view/edit-group.html", &pongo2.Context{
+		"loginuser": me,
+		"groupid":   objid.Hex(),
+		"canrename": me.HasPermission(GROUP_MANAGE),
+	})
+}
+
+// projectMemberQuery selects the projects whose project pages the user may
+// read: every project for project managers, otherwise the projects the user
+// is a member or an owner of.
+func projectMemberQuery(u *user) projectQuery {
+	if u.HasPermission(PROJECT_MANAGE) {
+		return projectQuery{IncludeArchived: true}
+	}
+	return projectQuery{Member: u.Id, IncludeArchived: true}
+}
+
+// projectListQuery selects the projects visible to the user. Projects
+// without members are open to everyone.
+func projectListQuery(u *user) projectQuery {
+	q := projectMemberQuery(u)
+	q.IncludeOpen = true
+	return q
+}
+
+func (u *user) isProjectMember(p *project) bool {
+	return containsId(p.Members, u.Id) || containsId(p.Owners, u.Id)
+}
+
+// canManageProject reports whether the user may change the members of p.
+func (u *user) canManageProject(p *project) bool {
+	return u.HasPermission(PROJECT_MANAGE) || containsId(p.Owners, u.Id)
+}
+
+// apiNeedProjectOwner loads the project of :projectId into c.Env["project"]
+// and lets only its owners and the project managers through.
+func apiNeedProjectOwner(c web.C, w http.ResponseWriter, r *http.Request) bool {
+	pid := c.URLParams["projectId"]
+	if !isObjectIdHex(pid) {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	}
+
+	p, err := getDocDb(c).Projects.Get(objectIdHex(pid))
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	} else if err != nil {
+		log.Println("apiNeedProjectOwner: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+
+	me := getSessionUser(c)
+	if !me.canManageProject(p) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	// a token must carry the admin scope to use managing permissions
+	if t := getSessionToken(c); t != nil && !containsId(p.Owners, me.Id) && !t.HasScope(SCOPE_ADMIN) {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+
+	c.Env["project"] = p
+	return true
+}
+
+// precond: must call after apiNeedProjectOwner
+func getEnvProject(c web.C) *project {
+	return c.Env["project"].(*project)
 }
 
 func apiProjectListGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	docdb := getDocDb(c)
 
-	projects := []project{}
+	q := projectListQuery(getSessionUser(c))
+	q.IncludeArchived = r.FormValue("archived") != ""
 
-	err := docdb.Db.C("projects").Find(bson.M{}).All(&projects)
+	projects, err := docdb.Projects.List(q)
 	if err != nil {
-		log.Fatal("@@@ projects")
+		log.Println("apiProjectListGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
 	js, err := json.Marshal(projects)
@@ -179,25 +528,31 @@ func apiProjectListGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	w.Write(js)
 }
 
-func apiProjectGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
-	//FIXME: check credential
-
-	pid := bson.ObjectIdHex(c.URLParams["projectId"])
+// getVisibleProject returns the project of pid if the user may see it.
+func getVisibleProject(db *docdb, u *user, pid string) (*project, error) {
+	if !isObjectIdHex(pid) {
+		return nil, ErrNotFound
+	}
 
-	if !pid.Valid() {
-		w.WriteHeader(http.StatusNotFound)
-		return
+	p, err := db.Projects.Get(objectIdHex(pid))
+	if err != nil {
+		return nil, err
+	}
+	if !projectListQuery(u).matches(p) {
+		return nil, ErrNotFound
 	}
+	return p, nil
+}
 
+func apiProjectGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	docdb := getDocDb(c)
 
-	var project project
-	err := docdb.Db.C("projects").FindId(pid).One(&project)
-	if err == mgo.ErrNotFound {
+	project, err := getVisibleProject(docdb, getSessionUser(c), c.URLParams["projectId"])
+	if err == ErrNotFound {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	} else if err != nil {
-		log.Fatal(err)
+		log.Println("apiProjectGetHandler: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -210,42 +565,178 @@ func apiProjectGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 func projectEditHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	pId := c.URLParams["projectId"]
 
-	objid := bson.ObjectIdHex(pId)
-	if !objid.Valid() {
+	if !isObjectIdHex(pId) {
 		log.Println("invalid projectId:", pId)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	objid := objectIdHex(pId)
 
-	executeWriterFromFile(w, "view/edit-project.html", &pongo2.Context{"projectId": objid.Hex()})
+	executeWriterFromFile(w, "view/edit-project.html", &pongo2.Context{
+		"loginuser": getSessionUser(c),
+		"projectId": objid.Hex(),
+	})
 }
 
+// projectPageHandler serves a page of the project dashboard to the users
+// who may see the project.
+func projectPageHandler(path string) func(c web.C, w http.ResponseWriter, r *http.Request) {
+	return func(c web.C, w http.ResponseWriter, r *http.Request) {
+		me := getSessionUser(c)
+
+		p, err := getVisibleProject(getDocDb(c), me, c.URLParams["projectId"])
+		if err == ErrNotFound {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = executeWriterFromFile(w, path, &pongo2.Context{
+			"loginuser": me,
+			"project":   p,
+			"projectId": p.Id.Hex(),
+			"canmanage": me.canManageProject(p),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// editedProject holds the fields of a project update, nil when unchanged.
+type editedProject struct {
+	Name     *string               `json:"name"`
+	SlackURL *string               `json:"slackurl"`
+	Members  *[]primitive.ObjectID `json:"members"`
+	Owners   *[]primitive.ObjectID `json:"owners"`
+}
+
+// apiProjectPutHandler updates the given fields of a project. Owners may
+// change the members and the slack url; the name and the owners need
+// PROJECT_MANAGE.
 func apiProjectPutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	docdb := getDocDb(c)
-
-	projectId := bson.ObjectIdHex(c.URLParams["projectId"])
+	me := getSessionUser(c)
+	old := getEnvProject(c)
 
 	defer r.Body.Close()
-	var p project
-	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
-		log.Println("apiPrjectPutHandler failed to parse json: ", r.Body)
-		w.WriteHeader(http.StatusInternalServerError)
+	var ep editedProject
+	if err := json.NewDecoder(r.Body).Decode(&ep); err != nil {
+		log.Println("apiProjectPutHandler failed to parse json: ", err)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	// TODO: verify incomming
+	// the slack webhook is posted to by the server, so like the name and
+	// the owners it is left to the project managers
+	renamed := ep.Name != nil && *ep.Name != old.Name
+	rehooked := ep.SlackURL != nil && *ep.SlackURL != old.SlackURL
+	if (renamed || rehooked || ep.Owners != nil) && !me.HasPermission(PROJECT_MANAGE) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 
-	err := docdb.Db.C("projects").UpdateId(projectId, p)
-	if err != nil {
+	p := *old
+	var errs []validationError
+
+	if renamed {
+		if *ep.Name == "" {
+			errs = append(errs, validationError{Field: "name", Code: "required", Message: "name is required"})
+		} else if _, err := docdb.Projects.FindByName(*ep.Name); err == nil {
+			errs = append(errs, validationError{Field: "name", Code: "taken", Message: "name is already used"})
+		} else if err != ErrNotFound {
+			log.Println("apiProjectPutHandler: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		p.Name = *ep.Name
+	}
+
+	if rehooked {
+		p.SlackURL = *ep.SlackURL
+	}
+
+	for _, f := range []struct {
+		field string
+		ids   *[]primitive.ObjectID
+		dst   *[]primitive.ObjectID
+	}{{"members", ep.Members, &p.Members}, {"owners", ep.Owners, &p.Owners}} {
+		if f.ids == nil {
+			continue
+		}
+		ves, err := verifyUserIds(docdb, f.field, *f.ids)
+		if err != nil {
+			log.Println("apiProjectPutHandler: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		errs = append(errs, ves...)
+		*f.dst = uniqueIds(*f.ids)
+	}
+
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	if err := docdb.Projects.Update(&p); err == ErrDuplicate {
+		http.Error(w, "project name already exists", http.StatusConflict)
+		return
+	} else if err != nil {
 		log.Println("apiProjectPutHandler update db error: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	recordAudit(docdb, r, me, "project.update", "project:"+p.Id.Hex(), old, p)
+
 	js, _ := json.Marshal(p)
+	w.Header().Set("Content-Type", "application/json")
 	w.Write(js)
 }
 
+// updateProjectMember adds or removes :userId of the project members with
+// update, either AddMember or RemoveMember of the project store.
+func updateProjectMember(c web.C, w http.ResponseWriter, r *http.Request, update func(pid, uid primitive.ObjectID) error, action string) {
+	if !isObjectIdHex(c.URLParams["userId"]) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	uid := objectIdHex(c.URLParams["userId"])
+
+	docdb := getDocDb(c)
+	p := getEnvProject(c)
+
+	if _, err := docdb.Users.Get(uid); err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("updateProjectMember: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := update(p.Id, uid); err != nil {
+		log.Println("updateProjectMember: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(docdb, r, getSessionUser(c), action, "project:"+p.Id.Hex(), nil, bson.M{"user": uid})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiProjectMemberPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	updateProjectMember(c, w, r, getDocDb(c).Projects.AddMember, "project.member.add")
+}
+
+func apiProjectMemberDeleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	updateProjectMember(c, w, r, getDocDb(c).Projects.RemoveMember, "project.member.remove")
+}
+
 func apiProjectsPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	var p project
@@ -256,22 +747,39 @@ func apiProjectsPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 
 	docdb := getDocDb(c)
 
-	changeinfo, err := docdb.Db.C("projects").Upsert(bson.M{"name": p.Name},
-		bson.M{"$setOnInsert": p})
-	if err != nil {
+	// the creator owns the new project
+	p.Id = primitive.NewObjectID()
+	p.Owners = uniqueIds(append(p.Owners, getSessionUser(c).Id))
+
+	err := docdb.Projects.Insert(&p)
+	if err == ErrDuplicate {
+		writeValidationErrorsStatus(w, http.StatusConflict, []validationError{
+			{Field: "name", Code: "taken", Message: "name is already used"}})
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if changeinfo.UpsertedId == nil {
-		// FIXME: project name already exists.
-		http.Error(w, "project name already exists", http.StatusInternalServerError)
-		return
-	}
+	recordAudit(docdb, r, getSessionUser(c), "project.create", "project:"+p.Id.Hex(), nil, p)
 
 	w.WriteHeader(http.StatusCreated)
 }
 
+// validatePageAccess checks the access level settings of a page.
+func validatePageAccess(p *page) []validationError {
+	switch p.Access {
+	case "", PUBLIC, GROUP, PRIVATE:
+	case PROJECT:
+		if len(p.Projects) == 0 {
+			return []validationError{{Field: "access", Code: "no_project", Message: "project access needs at least one project"}}
+		}
+	default:
+		return []validationError{{Field: "access", Code: "invalid", Message: "unknown access level"}}
+	}
+	return nil
+}
+
 func apiPageCreateHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	user := getSessionUser(c)
 	docdb := getDocDb(c)
@@ -284,32 +792,58 @@ func apiPageCreateHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	p.Id = bson.NewObjectId()
+	if !user.canCreatePage(p.Projects) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if errs := validatePageAccess(&p); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	if errs, err := validatePageProjects(docdb, &p, nil); err != nil {
+		log.Println("apiPageCreateHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	p.Id = primitive.NewObjectID()
 	p.Author = user.Id
-	p.Article.Id = bson.NewObjectId()
+	p.Article.Id = primitive.NewObjectID()
 	p.Article.UserId = user.Id
 	p.Article.Date = time.Now()
+	p.Created = p.Article.Date
+	p.Views = 0
 
 	log.Println(p)
 
-	err := docdb.Db.C("pages").Insert(p)
+	err := docdb.Pages.Insert(&p)
 	if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	js, _ := json.Marshal(p)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	recordAudit(docdb, r, user, "page.create", "page:"+p.Id.Hex(), nil, summarizePage(&p))
 
 	for _, h := range pageHooks {
 		go h.onCreate(p)
 	}
+
+	user.localizePage(&p)
+	js, _ := json.Marshal(p)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
 }
 
 func apiPageUpdateHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	user := getSessionUser(c)
+
 	defer r.Body.Close()
 	var p page
 
@@ -318,26 +852,60 @@ func apiPageUpdateHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := p.save(c, r)
+	old, err := getPageFromDb(c, c.URLParams["pageId"])
 	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	p.Id = old.Id
+	p.Author = old.Author
+
+	// the page must stay editable for the user in its new projects too
+	if !user.canEditPage(old) || !user.canEditPage(&p) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if errs := validatePageAccess(&p); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	if errs, err := validatePageProjects(getDocDb(c), &p, old); err != nil {
+		log.Println("apiPageUpdateHandler: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
+	} else if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
 	}
 
-	js, _ := json.Marshal(p)
+	err = p.save(c, old)
+	if err == ErrConflict {
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	recordAudit(getDocDb(c), r, user, "page.update", "page:"+p.Id.Hex(), summarizePage(old), summarizePage(&p))
 
 	for _, h := range pageHooks {
 		go h.onUpdate(p)
 	}
+
+	user.localizePage(&p)
+	js, _ := json.Marshal(p)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
 }
 
 func apiPageGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	pageId := c.URLParams["pageId"]
-
-	// FIXME: access level check
+	user := getSessionUser(c)
 
 	page, err := getPageFromDb(c, pageId)
 	if err != nil {
@@ -345,25 +913,68 @@ func apiPageGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// invisible pages are reported as missing
+	if ok, err := canViewPage(user, getDocDb(c), page); err != nil {
+		log.Println("apiPageGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	user.localizePage(page)
 	js, _ := json.Marshal(page)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(js)
 }
 
-func apiOwnPageGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+func apiPageDeleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	user := getSessionUser(c)
+
+	p, err := getPageFromDb(c, c.URLParams["pageId"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !user.canDeletePage(p) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
 	docdb := getDocDb(c)
+	if err := docdb.Pages.Remove(p.Id); err != nil {
+		log.Println("apiPageDeleteHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := docdb.Revisions.RemovePage(p.Id); err != nil {
+		log.Println("apiPageDeleteHandler: ", err)
+	}
+	if err := docdb.Attachments.RemovePage(p.Id); err != nil {
+		log.Println("apiPageDeleteHandler: ", err)
+	}
+
+	recordAudit(docdb, r, user, "page.delete", "page:"+p.Id.Hex(), summarizePage(p), nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	var pages []page
+func apiOwnPageGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	user := getSessionUser(c)
+	docdb := getDocDb(c)
 
-	err := docdb.Db.C("pages").Find(bson.M{"author": user.Id}).Select(bson.M{"history": 0}).All(&pages)
+	pages, err := docdb.Pages.FindByAuthor(user.Id)
 	if err != nil {
 		log.Println("apiPageListGetHandler Find Failed: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	user.localizePages(pages)
+
 	js, err := json.Marshal(pages)
 	if err != nil {
 		log.Println("apiPageListGetHandler json Marshal Failed: ", err)
@@ -375,64 +986,68 @@ func apiOwnPageGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	w.Write(js)
 }
 
-func pageQuery(r *http.Request, u *user, db *docdb) (bson.M, error) {
-	r.ParseForm()
+// pageVisibilityOf returns the pages the user may read.
+func pageVisibilityOf(u *user, db *docdb) (*pageVisibility, error) {
+	v := &pageVisibility{User: u.Id}
 
-	var groups []group
-	err := db.Db.C("groups").Find(groupListFilter(u)).All(&groups)
+	groups, err := db.Groups.List(groupListQuery(u))
 	if err != nil {
 		return nil, err
 	}
-
-	var gids []bson.ObjectId
 	for _, g := range groups {
-		gids = append(gids, g.Id)
+		v.Groups = append(v.Groups, g.Id)
+	}
+
+	projects, err := db.Projects.List(projectMemberQuery(u))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range projects {
+		v.Projects = append(v.Projects, p.Id)
 	}
 
-	cond := bson.M{"$or": []interface{}{
-		bson.M{"author": u.Id},           // user is author
-		bson.M{"access": string(PUBLIC)}, // Access level public
-		bson.M{"groups": bson.M{"$in": gids}},
-	}}
+	return v, nil
+}
 
-	if q := r.FormValue("q"); q != "" {
-		// FIXME: is sanitize necessary?
-		if qs := strings.Split(q, " "); len(qs) > 0 {
-			query := []interface{}{cond}
-			for _, s := range qs {
-				re := bson.M{"$regex": s}
-				query = append(query, bson.M{"$or": []interface{}{
-					bson.M{"article.title": re},
-					bson.M{"article.body": re}}})
-			}
-			cond = bson.M{"$and": query}
-		}
+// canViewPage reports whether the user may read p.
+func canViewPage(u *user, db *docdb, p *page) (bool, error) {
+	v, err := pageVisibilityOf(u, db)
+	if err != nil {
+		return false, err
 	}
+	return v.allows(p), nil
+}
 
-	return cond, nil
+// pageSearchWords returns the words of the "q" parameter.
+func pageSearchWords(r *http.Request) []string {
+	r.ParseForm()
 
+	if q := r.FormValue("q"); q != "" {
+		return strings.Split(q, " ")
+	}
+	return nil
 }
 
 func apiPageListGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	docdb := getDocDb(c)
 	user := getSessionUser(c)
 
-	cond, err := pageQuery(r, user, docdb)
+	v, err := pageVisibilityOf(user, docdb)
 	if err != nil {
 		log.Println("apiPageListGetHandler Failed: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	var pages []page
-
-	err = docdb.Db.C("pages").Find(cond).Select(bson.M{"history": 0}).Sort("-article.date").All(&pages)
+	pages, err := docdb.Pages.Find(v, pageSearchWords(r))
 	if err != nil {
 		log.Println("apiPageListGetHandler Find Failed: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	user.localizePages(pages)
+
 	js, err := json.Marshal(pages)
 	if err != nil {
 		log.Println("apiPageListGetHandler json Marshal Failed: ", err)
@@ -447,12 +1062,10 @@ func apiPageListGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 func apiUserListGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	docdb := getDocDb(c)
 
-	users := []user{}
-
-	err := docdb.Db.C("users").Find(bson.M{"$or": []interface{}{
-		bson.M{"disabled": bson.M{"$exists": false}},
-		bson.M{"disabled": false}}}).All(&users)
+	// user managers may list disabled users to re-enable them
+	all := r.FormValue("all") != "" && getSessionUser(c).HasPermission(USER_MANAGE)
 
+	users, err := docdb.Users.List(all)
 	if err != nil {
 		log.Println("apiUserListGetHandler: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -472,20 +1085,23 @@ func apiUserListGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 
 func apiUserGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	docdb := getDocDb(c)
-	userId := bson.ObjectIdHex(c.URLParams["userId"])
 
-	if !userId.Valid() {
+	if !isObjectIdHex(c.URLParams["userId"]) {
 		log.Println("apiUserListGetHandler: userId invalid")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	userId := objectIdHex(c.URLParams["userId"])
 
-	user := user{}
-	err := docdb.Db.C("users").FindId(userId).One(&user)
-	if err == mgo.ErrNotFound {
+	user, err := docdb.Users.Get(userId)
+	if err == ErrNotFound {
 		log.Println("apiUserListGetHandler: user not found:", userId.Hex())
 		w.WriteHeader(http.StatusNotFound)
 		return
+	} else if err != nil {
+		log.Println("apiUserListGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
 	// FIXME: remove detail info
@@ -514,8 +1130,8 @@ func apiOwnUserGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 }
 
 func apiUserDeleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
-	uid := bson.ObjectIdHex(c.URLParams["userId"])
-	if !uid.Valid() {
+	uid := objectIdHex(c.URLParams["userId"])
+	if uid.IsZero() {
 		log.Println("uid invalid: ", uid)
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -523,8 +1139,14 @@ func apiUserDeleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 
 	docdb := getDocDb(c)
 
-	err := docdb.Db.C("users").UpdateId(uid, bson.M{"disabled": true})
-	if err == mgo.ErrNotFound {
+	if uid == getSessionUser(c).Id {
+		log.Println("user can not disable oneself: ", uid)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	u, err := docdb.Users.Get(uid)
+	if err == ErrNotFound {
 		log.Println("user not found: ", uid)
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -534,6 +1156,29 @@ func apiUserDeleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if ok, err := canManageAccount(docdb, getSessionUser(c), u); err != nil {
+		log.Println("user delete failed: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	err = docdb.Users.SetDisabled(uid, true)
+	if err == ErrNotFound {
+		log.Println("user not found: ", uid)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("user delete failed: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(docdb, r, getSessionUser(c), "user.disable", "user:"+uid.Hex(),
+		bson.M{"disabled": false}, bson.M{"disabled": true})
+
 	w.WriteHeader(http.StatusAccepted)
 	return
 }
@@ -552,42 +1197,43 @@ func apiUserPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// FIXME: veirfy
-	if len(u.Name) < 4 || u.Email == "" {
-		log.Println("user is imcomplete, ", u)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	var errs []validationError
+	if len(u.Name) < 4 {
+		errs = append(errs, validationError{Field: "name", Code: "too_short", Message: "name must be at least 4 characters"})
+	}
+	if u.Email == "" {
+		errs = append(errs, validationError{Field: "email", Code: "required", Message: "email is required"})
 	}
+	errs = append(errs, validatePassword("password", u.Password, u.Name)...)
 
-	if len(u.Password) < 8 {
-		log.Println("password is too short.")
-		w.WriteHeader(http.StatusBadRequest)
+	if len(errs) > 0 {
+		log.Println("user is invalid, ", u.Name, errs)
+		writeValidationErrors(w, errs)
 		return
 	}
 
 	user := &user{
-		Name:        u.Name,
-		EMail:       u.Email,
-		Password:    HashPassword(u.Password),
-		Permissions: map[permission]bool{EDITOR: true}, //FIXME
-		Disabled:    false,
+		Name:     u.Name,
+		EMail:    u.Email,
+		Password: HashPassword(u.Password),
+		Roles:    []roleBinding{{Role: string(EDITOR)}},
+		Disabled: false,
 	}
 
 	docdb := getDocDb(c)
-	// Register user only if user.Email not found.
-	changeinfo, err := docdb.Db.C("users").Upsert(bson.M{"email": user.EMail},
-		bson.M{"$setOnInsert": user})
-	if err != nil {
+	// Register user only if user.Name and user.Email are not found.
+	err := docdb.Users.Insert(user)
+	if err == ErrDuplicate {
+		log.Println("user.name or user.email already exists:", user.Name, user.EMail)
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if changeinfo.UpsertedId == nil {
-		log.Println("user.email already exists:", user.EMail)
-		w.WriteHeader(http.StatusConflict)
-		return
-	}
+	recordAudit(docdb, r, getSessionUser(c), "user.create", "user:"+user.Id.Hex(), nil, summarizeUser(user))
 
 	w.WriteHeader(http.StatusCreated)
 }
@@ -608,7 +1254,7 @@ var sigilconfig = gen.Sigil{
 
 func rgb(r, g, b uint8) color.NRGBA { return color.NRGBA{r, g, b, 255} }
 
-func writeDefaultIcon(w http.ResponseWriter, id bson.ObjectId) {
+func writeDefaultIcon(w http.ResponseWriter, id primitive.ObjectID) {
 	h := sha1.New()
 	io.WriteString(h, id.Hex())
 
@@ -625,8 +1271,8 @@ func apiOwnIconHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 func apiUserIconHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	userid := c.URLParams["userId"]
 
-	id := bson.ObjectIdHex(userid)
-	if !id.Valid() {
+	id := objectIdHex(userid)
+	if id.IsZero() {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -653,12 +1299,18 @@ func apiPasswordHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	err := bcrypt.CompareHashAndPassword(user.Password, []byte(p.CurrentPassword))
 	if err != nil {
 		log.Println("apiPasswordHandler Failed: Password Incorrect")
-		w.WriteHeader(http.StatusBadRequest)
+		writeValidationErrors(w, []validationError{
+			{Field: "currentPassword", Code: "incorrect", Message: "current password is incorrect"}})
+		return
+	}
+
+	if errs := validatePassword("newPassword", p.NewPassword, user.Name); len(errs) > 0 {
+		writeValidationErrors(w, errs)
 		return
 	}
 
 	docdb := getDocDb(c)
-	err = docdb.Db.C("users").UpdateId(user.Id, bson.M{"$set": bson.M{"password": HashPassword(p.NewPassword)}})
+	err = docdb.Users.SetPassword(user.Id, HashPassword(p.NewPassword))
 	if err != nil {
 		log.Println("apiPasswordHandler Failed: Update password")
 		w.WriteHeader(http.StatusInternalServerError)
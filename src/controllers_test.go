@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// serve runs the handler h for the user u on the memory stores db.
+func serve(db *docdb, u *user, h func(web.C, http.ResponseWriter, *http.Request), params map[string]string, method string, target string, body string) *httptest.ResponseRecorder {
+	c := web.C{
+		URLParams: params,
+		Env:       map[interface{}]interface{}{"docdb": db, "user": u},
+	}
+	w := httptest.NewRecorder()
+	h(c, w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+func addTestUser(t *testing.T, db *docdb, name string, perms ...permission) *user {
+	u := &user{Name: name, EMail: name + "@example.com"}
+	u.perms = &userPermissions{global: permissionSet{}, projects: map[primitive.ObjectID]permissionSet{}}
+	u.perms.global.add(perms)
+	if err := db.Users.Insert(u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestPageHandlers(t *testing.T) {
+	db := newMemoryDocDb()
+	author := addTestUser(t, db, "author", PAGE_CREATE, PAGE_DELETE)
+	other := addTestUser(t, db, "other", PAGE_CREATE)
+
+	w := serve(db, author, apiPageCreateHandler, nil, "POST", "/api/pages",
+		`{"article":{"title":"secret plan","body":"hidden"},"access":"private"}`)
+	if w.Code != http.StatusOK {
+		t.Fatal("create page failed:", w.Code, w.Body.String())
+	}
+	var p page
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+
+	params := map[string]string{"pageId": p.Id.Hex()}
+	if w := serve(db, author, apiPageGetHandler, params, "GET", "/api/pages/"+p.Id.Hex(), ""); w.Code != http.StatusOK {
+		t.Error("author should read own page:", w.Code)
+	}
+	if w := serve(db, other, apiPageGetHandler, params, "GET", "/api/pages/"+p.Id.Hex(), ""); w.Code != http.StatusNotFound {
+		t.Error("private page should be missing for others:", w.Code)
+	}
+
+	w = serve(db, author, apiPageUpdateHandler, params, "POST", "/api/pages/"+p.Id.Hex(),
+		`{"article":{"title":"public plan","body":"shared"},"access":"public"}`)
+	if w.Code != http.StatusOK {
+		t.Fatal("update page failed:", w.Code, w.Body.String())
+	}
+
+	var pages []page
+	w = serve(db, other, apiPageListGetHandler, nil, "GET", "/api/pages?q=plan+shared", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &pages); err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 1 || pages[0].Article.Title != "public plan" {
+		t.Error("search unexpected:", pages)
+	}
+
+	var revs []pageRevision
+	w = serve(db, other, apiPageRevisionListGetHandler, params, "GET", "/api/pages/"+p.Id.Hex()+"/revisions", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &revs); err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 1 || revs[0].Title != "secret plan" || revs[0].Body != "" {
+		t.Fatal("update should keep the previous version:", revs)
+	}
+
+	var rev pageRevision
+	revParams := map[string]string{"pageId": p.Id.Hex(), "revisionId": revs[0].Id.Hex()}
+	w = serve(db, other, apiPageRevisionGetHandler, revParams, "GET", "/api/pages/"+p.Id.Hex()+"/revisions/"+revs[0].Id.Hex(), "")
+	if err := json.Unmarshal(w.Body.Bytes(), &rev); err != nil || rev.Body != "hidden" {
+		t.Error("revision unexpected:", rev, err)
+	}
+
+	if w := serve(db, other, apiPageDeleteHandler, params, "DELETE", "/api/pages/"+p.Id.Hex(), ""); w.Code != http.StatusUnauthorized {
+		t.Error("others should not delete the page:", w.Code)
+	}
+	if w := serve(db, author, apiPageDeleteHandler, params, "DELETE", "/api/pages/"+p.Id.Hex(), ""); w.Code != http.StatusNoContent {
+		t.Error("author should delete the page:", w.Code)
+	}
+
+	if revs, _ := db.Revisions.List(p.Id); len(revs) != 0 {
+		t.Error("revisions should be removed with the page:", revs)
+	}
+
+	entries := db.Audit.(*memoryAuditStore).entries
+	if len(entries) != 3 || entries[2].Action != "page.delete" {
+		t.Error("audit unexpected:", entries)
+	}
+}
+
+func TestGroupHandlers(t *testing.T) {
+	db := newMemoryDocDb()
+	manager := addTestUser(t, db, "manager", GROUP_MANAGE)
+	member := addTestUser(t, db, "member")
+
+	create := applyFilter(apiGroupCreateHandler, apiNeedPermission(GROUP_MANAGE))
+	if w := serve(db, member, create, nil, "POST", "/api/groups", `{"name":"dev"}`); w.Code != http.StatusUnauthorized {
+		t.Error("members should not create groups:", w.Code)
+	}
+	if w := serve(db, manager, create, nil, "POST", "/api/groups", `{"name":"dev"}`); w.Code != http.StatusCreated {
+		t.Fatal("create group failed:", w.Code)
+	}
+	if w := serve(db, manager, create, nil, "POST", "/api/groups", `{"name":"dev"}`); w.Code != http.StatusConflict {
+		t.Error("duplicated group name should conflict:", w.Code)
+	}
+
+	g, err := db.Groups.FindByName("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := map[string]string{"groupId": g.Id.Hex(), "userId": member.Id.Hex()}
+	if w := serve(db, member, apiGroupGetHandler, params, "GET", "/api/groups/"+g.Id.Hex(), ""); w.Code != http.StatusNotFound {
+		t.Error("group should be invisible to non members:", w.Code)
+	}
+
+	add := applyFilter(apiGroupMemberPostHandler, apiNeedGroupManager)
+	if w := serve(db, manager, add, params, "POST", "/api/groups/"+g.Id.Hex()+"/members/"+member.Id.Hex(), ""); w.Code != http.StatusNoContent {
+		t.Fatal("add member failed:", w.Code)
+	}
+	if w := serve(db, member, apiGroupGetHandler, params, "GET", "/api/groups/"+g.Id.Hex(), ""); w.Code != http.StatusOK {
+		t.Error("group should be visible to members:", w.Code)
+	}
+
+	params["userId"] = primitive.NewObjectID().Hex()
+	if w := serve(db, manager, add, params, "POST", "/api/groups/"+g.Id.Hex()+"/members/"+params["userId"], ""); w.Code != http.StatusNotFound {
+		t.Error("unknown user should be missing:", w.Code)
+	}
+}
+
+func TestProjectsPostHandler(t *testing.T) {
+	db := newMemoryDocDb()
+	manager := addTestUser(t, db, "manager", PROJECT_MANAGE)
+
+	if w := serve(db, manager, apiProjectsPostHandler, nil, "POST", "/api/projects", `{"name":"alpha"}`); w.Code != http.StatusCreated {
+		t.Fatal("create project failed:", w.Code)
+	}
+	w := serve(db, manager, apiProjectsPostHandler, nil, "POST", "/api/projects", `{"name":"alpha"}`)
+	var ve validationErrors
+	json.Unmarshal(w.Body.Bytes(), &ve)
+	if w.Code != http.StatusConflict || len(ve.Errors) != 1 || ve.Errors[0].Code != "taken" {
+		t.Error("duplicated project name should conflict:", w.Code, w.Body.String())
+	}
+}
+
+func TestProjectPutHandler(t *testing.T) {
+	db := newMemoryDocDb()
+	owner := addTestUser(t, db, "owner")
+	member := addTestUser(t, db, "member")
+
+	for _, name := range []string{"alpha", "beta"} {
+		if err := db.Projects.Insert(&project{Name: name, Owners: []primitive.ObjectID{owner.Id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p, _ := db.Projects.FindByName("alpha")
+
+	put := applyFilter(apiProjectPutHandler, apiNeedProjectOwner)
+	params := map[string]string{"projectId": p.Id.Hex()}
+
+	if w := serve(db, owner, put, params, "PUT", "/api/projects/"+p.Id.Hex(), `{"name":"beta"}`); w.Code != http.StatusUnauthorized {
+		t.Error("owners should not rename projects:", w.Code)
+	}
+	if w := serve(db, owner, put, params, "PUT", "/api/projects/"+p.Id.Hex(), `{"slackurl":"http://10.0.0.1/"}`); w.Code != http.StatusUnauthorized {
+		t.Error("owners should not change the slack webhook:", w.Code)
+	}
+
+	body := `{"members":["` + member.Id.Hex() + `","` + member.Id.Hex() + `"]}`
+	if w := serve(db, owner, put, params, "PUT", "/api/projects/"+p.Id.Hex(), body); w.Code != http.StatusOK {
+		t.Fatal("owner should change members:", w.Code, w.Body.String())
+	}
+
+	p, _ = db.Projects.Get(p.Id)
+	if len(p.Members) != 1 || p.Members[0] != member.Id {
+		t.Error("members unexpected:", p.Members)
+	}
+	if w := serve(db, member, apiProjectGetHandler, params, "GET", "/api/projects/"+p.Id.Hex(), ""); w.Code != http.StatusOK {
+		t.Error("project should be visible to members:", w.Code)
+	}
+}
+
+func TestManagerFiltersTokenScope(t *testing.T) {
+	db := newMemoryDocDb()
+	manager := addTestUser(t, db, "manager", GROUP_MANAGE, PROJECT_MANAGE)
+	owner := addTestUser(t, db, "owner")
+
+	g := &group{Name: "dev", Admins: []primitive.ObjectID{owner.Id}}
+	p := &project{Name: "alpha", Owners: []primitive.ObjectID{owner.Id}}
+	if err := db.Groups.Insert(g); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Projects.Insert(p); err != nil {
+		t.Fatal(err)
+	}
+
+	pass := func(c web.C, w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	filters := []handleFilter{apiNeedGroupManager, apiNeedProjectOwner}
+	params := map[string]string{"groupId": g.Id.Hex(), "projectId": p.Id.Hex()}
+
+	call := func(u *user, f handleFilter, scope tokenScope) int {
+		c := web.C{
+			URLParams: params,
+			Env: map[interface{}]interface{}{"docdb": db, "user": u,
+				"token": &apiToken{UserId: u.Id, Scopes: []tokenScope{scope}}},
+		}
+		w := httptest.NewRecorder()
+		applyFilter(pass, f)(c, w, httptest.NewRequest("PUT", "/", nil))
+		return w.Code
+	}
+
+	for _, f := range filters {
+		if code := call(manager, f, SCOPE_WRITE); code != http.StatusForbidden {
+			t.Error("managing permissions need the admin scope:", code)
+		}
+		if code := call(manager, f, SCOPE_ADMIN); code != http.StatusNoContent {
+			t.Error("admin scope should use managing permissions:", code)
+		}
+		if code := call(owner, f, SCOPE_WRITE); code != http.StatusNoContent {
+			t.Error("owners should not need the admin scope:", code)
+		}
+	}
+}
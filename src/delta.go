@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// A delta rebuilds a target text from a base text with a sequence of
+// operations: copying a range of the base, or inserting literal bytes.
+//
+//	copy:   DELTA_COPY   uvarint(offset) uvarint(length)
+//	insert: DELTA_INSERT uvarint(length) bytes
+const (
+	DELTA_COPY   byte = 0
+	DELTA_INSERT byte = 1
+
+	// candidates of a line tried when matching, bounding the time spent on
+	// texts repeating the same lines
+	deltaMaxCandidates = 8
+)
+
+var ErrInvalidDelta = errors.New("invalid delta")
+
+type deltaWriter struct {
+	buf bytes.Buffer
+	// pending operation, merged with the next one when contiguous
+	copyOff, copyLen int
+	insert           []byte
+}
+
+func (d *deltaWriter) uvarint(n int) {
+	var b [binary.MaxVarintLen64]byte
+	d.buf.Write(b[:binary.PutUvarint(b[:], uint64(n))])
+}
+
+func (d *deltaWriter) flush() {
+	if d.copyLen > 0 {
+		d.buf.WriteByte(DELTA_COPY)
+		d.uvarint(d.copyOff)
+		d.uvarint(d.copyLen)
+		d.copyLen = 0
+	}
+	if len(d.insert) > 0 {
+		d.buf.WriteByte(DELTA_INSERT)
+		d.uvarint(len(d.insert))
+		d.buf.Write(d.insert)
+		d.insert = nil
+	}
+}
+
+func (d *deltaWriter) copy(off int, n int) {
+	if len(d.insert) == 0 && d.copyLen > 0 && d.copyOff+d.copyLen == off {
+		d.copyLen += n
+		return
+	}
+	d.flush()
+	d.copyOff, d.copyLen = off, n
+}
+
+func (d *deltaWriter) add(b []byte) {
+	if d.copyLen > 0 {
+		d.flush()
+	}
+	d.insert = append(d.insert, b...)
+}
+
+// splitLines splits text after each newline, returning the lines and the
+// offset of each one.
+func splitLines(text []byte) ([][]byte, []int) {
+	var lines [][]byte
+	var offsets []int
+	for off := 0; off < len(text); {
+		n := bytes.IndexByte(text[off:], '\n') + 1
+		if n == 0 {
+			n = len(text) - off
+		}
+		lines = append(lines, text[off:off+n])
+		offsets = append(offsets, off)
+		off += n
+	}
+	return lines, offsets
+}
+
+// makeDelta returns the delta rebuilding target from base. Lines of target
+// found in base are copied, preferring the longest run of matching lines.
+func makeDelta(base []byte, target []byte) []byte {
+	baseLines, baseOffsets := splitLines(base)
+	index := map[string][]int{}
+	for i, l := range baseLines {
+		if len(index[string(l)]) < deltaMaxCandidates {
+			index[string(l)] = append(index[string(l)], i)
+		}
+	}
+
+	targetLines, _ := splitLines(target)
+	d := &deltaWriter{}
+	for i := 0; i < len(targetLines); {
+		best, bestLen := -1, 0
+		for _, j := range index[string(targetLines[i])] {
+			n := 0
+			for j+n < len(baseLines) && i+n < len(targetLines) && bytes.Equal(baseLines[j+n], targetLines[i+n]) {
+				n++
+			}
+			if n > bestLen {
+				best, bestLen = j, n
+			}
+		}
+
+		if best < 0 {
+			d.add(targetLines[i])
+			i++
+			continue
+		}
+
+		end := baseOffsets[best+bestLen-1] + len(baseLines[best+bestLen-1])
+		d.copy(baseOffsets[best], end-baseOffsets[best])
+		i += bestLen
+	}
+	d.flush()
+	return d.buf.Bytes()
+}
+
+// applyDelta rebuilds the target of delta from base.
+func applyDelta(base []byte, delta []byte) ([]byte, error) {
+	var out bytes.Buffer
+	r := bytes.NewReader(delta)
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return out.Bytes(), nil
+		}
+
+		switch op {
+		case DELTA_COPY:
+			off, err1 := binary.ReadUvarint(r)
+			n, err2 := binary.ReadUvarint(r)
+			if err1 != nil || err2 != nil || off+n > uint64(len(base)) {
+				return nil, ErrInvalidDelta
+			}
+			out.Write(base[off : off+n])
+
+		case DELTA_INSERT:
+			n, err := binary.ReadUvarint(r)
+			if err != nil || n > uint64(r.Len()) {
+				return nil, ErrInvalidDelta
+			}
+			b := make([]byte, n)
+			r.Read(b)
+			out.Write(b)
+
+		default:
+			return nil, ErrInvalidDelta
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	base := "# notes\nfirst line\nsecond line\nthird line\nlast line"
+	for _, target := range []string{
+		base,
+		"",
+		"# notes\nfirst line\nchanged line\nthird line\nlast line",
+		"third line\n# notes\nfirst line\nsecond line\nnew end\n",
+		"# notes\nfirst line\nfirst line\nsecond line\nlast",
+		"entirely new text",
+	} {
+		delta := makeDelta([]byte(base), []byte(target))
+		got, err := applyDelta([]byte(base), delta)
+		if err != nil || string(got) != target {
+			t.Errorf("delta to %q rebuilt %q: %v", target, got, err)
+		}
+	}
+
+	// a small edit of a large text makes a small delta
+	large := bytes.Repeat([]byte("a line of a large page\n"), 1000)
+	edited := append([]byte("a new first line\n"), large...)
+	if delta := makeDelta(large, edited); len(delta) > 32 {
+		t.Error("delta of a small edit is large:", len(delta))
+	}
+
+	for _, delta := range [][]byte{{DELTA_COPY, 50, 20}, {DELTA_INSERT, 10, 'a'}, {7}} {
+		if _, err := applyDelta([]byte(base), delta); err != ErrInvalidDelta {
+			t.Errorf("delta %v should be invalid: %v", delta, err)
+		}
+	}
+}
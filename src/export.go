@@ -0,0 +1,289 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/zenazn/goji/web"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The Markdown export writes each page visible to a user as a Markdown file
+// with a YAML front matter, in the folder of its first project by name, the
+// pages of no project at the top. Paths only depend on the pages, so that
+// exports can be committed to git one over another.
+
+// exportName returns s usable as a file or folder name.
+func exportName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.IsSpace(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '-'
+		}
+		return r
+	}, strings.TrimSpace(s))
+
+	// no hidden files nor ".."
+	s = strings.Trim(s, ".-")
+	if rs := []rune(s); len(rs) > 80 {
+		s = string(rs[:80])
+	}
+	if s == "" {
+		return "untitled"
+	}
+	return s
+}
+
+// yamlValue returns v as a YAML flow value: JSON strings and arrays are.
+func yamlValue(v interface{}) string {
+	js, _ := json.Marshal(v)
+	return string(js)
+}
+
+// markdownExporter caches the names of the users and projects of the pages.
+type markdownExporter struct {
+	db       *docdb
+	users    map[primitive.ObjectID]*user
+	projects map[primitive.ObjectID]*project
+	paths    map[string]bool
+}
+
+func (e *markdownExporter) user(id primitive.ObjectID) (*user, error) {
+	if u, ok := e.users[id]; ok {
+		return u, nil
+	}
+	u, err := e.db.Users.Get(id)
+	if err == ErrNotFound {
+		u, err = &user{Id: id}, nil
+	}
+	e.users[id] = u
+	return u, err
+}
+
+// projectNames returns the names of the projects ids, sorted.
+func (e *markdownExporter) projectNames(ids []primitive.ObjectID) ([]string, error) {
+	names := []string{}
+	for _, id := range ids {
+		p, ok := e.projects[id]
+		if !ok {
+			var err error
+			if p, err = e.db.Projects.Get(id); err == ErrNotFound {
+				p = nil
+			} else if err != nil {
+				return nil, err
+			}
+			e.projects[id] = p
+		}
+		if p != nil {
+			names = append(names, p.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// pagePath returns the path of p, the first one taking the name of its
+// title, the others with their id appended.
+func (e *markdownExporter) pagePath(p *page, projects []string) string {
+	dir := ""
+	if len(projects) > 0 {
+		dir = exportName(projects[0])
+	}
+
+	name := exportName(p.Article.Title)
+	file := path.Join(dir, name+".md")
+	// case insensitive file systems would merge the files
+	if e.paths[strings.ToLower(file)] {
+		file = path.Join(dir, name+"-"+p.Id.Hex()+".md")
+	}
+	e.paths[strings.ToLower(file)] = true
+	return file
+}
+
+func (e *markdownExporter) render(p *page, projects []string) ([]byte, error) {
+	author, err := e.user(p.Author)
+	if err != nil {
+		return nil, err
+	}
+	editor, err := e.user(p.Article.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("---\n")
+	fmt.Fprintf(&buf, "id: %s\n", yamlValue(p.Id.Hex()))
+	fmt.Fprintf(&buf, "title: %s\n", yamlValue(p.Article.Title))
+	fmt.Fprintf(&buf, "author: %s\n", yamlValue(author.Name))
+	fmt.Fprintf(&buf, "author_email: %s\n", yamlValue(author.EMail))
+	fmt.Fprintf(&buf, "updated_by: %s\n", yamlValue(editor.Name))
+	fmt.Fprintf(&buf, "projects: %s\n", yamlValue(projects))
+	fmt.Fprintf(&buf, "access: %s\n", yamlValue(p.Access))
+	if !p.Created.IsZero() {
+		fmt.Fprintf(&buf, "created: %s\n", p.Created.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(&buf, "updated: %s\n", p.Article.Date.UTC().Format(time.RFC3339))
+	buf.WriteString("---\n\n")
+
+	buf.WriteString(p.Article.Body)
+	if !strings.HasSuffix(p.Article.Body, "\n") {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// exportMarkdown calls write with the path and content of every page u can
+// read, returning how many were written.
+func exportMarkdown(db *docdb, u *user, write func(name string, modified time.Time, data []byte) error) (int, error) {
+	v, err := pageVisibilityOf(u, db)
+	if err != nil {
+		return 0, err
+	}
+	pages, err := db.Pages.Find(v, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// the oldest page keeps the plain name
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Id.Hex() < pages[j].Id.Hex() })
+
+	e := &markdownExporter{
+		db:       db,
+		users:    map[primitive.ObjectID]*user{},
+		projects: map[primitive.ObjectID]*project{},
+		paths:    map[string]bool{},
+	}
+	for i := range pages {
+		p := &pages[i]
+		projects, err := e.projectNames(p.Projects)
+		if err != nil {
+			return i, err
+		}
+		data, err := e.render(p, projects)
+		if err != nil {
+			return i, err
+		}
+		if err := write(e.pagePath(p, projects), p.Article.Date, data); err != nil {
+			return i, err
+		}
+	}
+	return len(pages), nil
+}
+
+func apiMarkdownExportGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="irori-markdown.zip"`)
+
+	zw := zip.NewWriter(w)
+	_, err := exportMarkdown(getDocDb(c), getSessionUser(c), func(name string, modified time.Time, data []byte) error {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		// the response has started: the zip is left truncated
+		log.Println("apiMarkdownExportGetHandler: ", err)
+	}
+}
+
+// EXPORT_MANIFEST lists the files written by the last export of a directory.
+const EXPORT_MANIFEST = ".irori-export"
+
+// exportDirectory mirrors the pages u can read into dir: the files the
+// previous export wrote, as listed in its EXPORT_MANIFEST, of the pages
+// renamed, removed or no longer readable since are deleted. Any other file
+// is kept.
+func exportDirectory(db *docdb, u *user, dir string) (int, error) {
+	manifest := filepath.Join(dir, EXPORT_MANIFEST)
+	var previous []string
+	if data, err := os.ReadFile(manifest); err == nil {
+		previous = strings.Fields(string(data))
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	written := map[string]bool{}
+	var names []string
+	n, err := exportMarkdown(db, u, func(name string, modified time.Time, data []byte) error {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			return err
+		}
+		written[name] = true
+		names = append(names, name)
+		return os.Chtimes(file, modified, modified)
+	})
+	if err != nil {
+		return n, err
+	}
+
+	for _, name := range previous {
+		// the names come from the file, keep them in dir
+		if written[name] || !filepath.IsLocal(filepath.FromSlash(name)) {
+			continue
+		}
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return n, err
+		}
+		// folders left empty go too
+		for d := filepath.Dir(file); d != filepath.Clean(dir); d = filepath.Dir(d) {
+			if entries, err := os.ReadDir(d); err != nil || len(entries) > 0 || os.Remove(d) != nil {
+				break
+			}
+		}
+	}
+
+	sort.Strings(names)
+	return n, os.WriteFile(manifest, []byte(strings.Join(names, "\n")+"\n"), 0644)
+}
+
+// exportCommand runs "irori export -user name [-o dir]".
+func exportCommand(db *docdb, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	name := fs.String("user", "", "export the pages the user `name` can read")
+	dir := fs.String("o", "irori-markdown", "directory written")
+	fs.Parse(args)
+
+	if *name == "" {
+		return errors.New("usage: irori export -user name [-o dir]")
+	}
+	u, err := db.Users.FindByName(*name)
+	if err == ErrNotFound {
+		return fmt.Errorf("no user %s", *name)
+	} else if err != nil {
+		return err
+	}
+
+	if err := resolvePermissions(db, u); err != nil {
+		return err
+	}
+
+	n, err := exportDirectory(db, u, *dir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d pages exported to %s\n", n, *dir)
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestExportName(t *testing.T) {
+	for s, want := range map[string]string{
+		"Meeting notes":  "Meeting-notes",
+		"a/b: c?":        "a-b--c",
+		"../..":          "untitled",
+		"  .hidden ":     "hidden",
+		"議事録 2024/03/20": "議事録-2024-03-20",
+	} {
+		if got := exportName(s); got != want {
+			t.Errorf("exportName(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestMarkdownExport(t *testing.T) {
+	db := newMemoryDocDb()
+	alice := addTestUser(t, db, "alice")
+	bob := addTestUser(t, db, "bob")
+	handbook := &project{Name: "handbook"}
+	if err := db.Projects.Insert(handbook); err != nil {
+		t.Fatal(err)
+	}
+
+	date := time.Date(2024, 3, 20, 12, 0, 0, 0, time.UTC)
+	for _, p := range []*page{
+		{Author: alice.Id, Access: PUBLIC, Projects: []primitive.ObjectID{handbook.Id}, Created: date,
+			Article: article{Title: "Welcome", Body: "# hello", UserId: bob.Id, Date: date}},
+		{Author: bob.Id, Access: PUBLIC, Article: article{Title: "welcome", Body: "again\n", UserId: bob.Id, Date: date}},
+		{Author: alice.Id, Access: PRIVATE, Article: article{Title: "welcome", Body: "mine", UserId: alice.Id, Date: date}},
+		{Author: bob.Id, Access: PRIVATE, Article: article{Title: "secret", Body: "bob only", UserId: bob.Id, Date: date}},
+	} {
+		p.Id = primitive.NewObjectID()
+		if err := db.Pages.Insert(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := serve(db, alice, apiMarkdownExportGetHandler, nil, "GET", "/api/export/markdown", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatal("export failed:", w.Code)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{}
+	for _, f := range zr.File {
+		r, _ := f.Open()
+		data, _ := io.ReadAll(r)
+		files[f.Name] = string(data)
+	}
+	if len(files) != 3 {
+		t.Fatal("the pages alice can read should be exported:", files)
+	}
+
+	welcome := files["handbook/Welcome.md"]
+	for _, line := range []string{`title: "Welcome"`, `author: "alice"`, `author_email: "alice@example.com"`,
+		`updated_by: "bob"`, `projects: ["handbook"]`, `access: "public"`, "created: 2024-03-20T12:00:00Z", "---\n\n# hello\n"} {
+		if !strings.Contains(welcome, line) {
+			t.Errorf("front matter should contain %q: %s", line, welcome)
+		}
+	}
+	if files["welcome.md"] == "" {
+		t.Error("pages of no project should be at the top:", files)
+	}
+	if strings.Contains(files["welcome.md"], "created:") {
+		t.Error("missing creation date should be omitted:", files["welcome.md"])
+	}
+}
+
+func TestExportDirectory(t *testing.T) {
+	db := newMemoryDocDb()
+	alice := addTestUser(t, db, "alice")
+	bob := addTestUser(t, db, "bob")
+	handbook := &project{Name: "handbook"}
+	if err := db.Projects.Insert(handbook); err != nil {
+		t.Fatal(err)
+	}
+
+	date := time.Date(2024, 3, 20, 12, 0, 0, 0, time.UTC)
+	pages := []*page{
+		{Author: alice.Id, Access: PUBLIC, Projects: []primitive.ObjectID{handbook.Id}, Article: article{Title: "Welcome", UserId: alice.Id, Date: date}},
+		{Author: bob.Id, Access: PUBLIC, Article: article{Title: "notes", UserId: bob.Id, Date: date}},
+		{Author: bob.Id, Access: PUBLIC, Article: article{Title: "plans", UserId: bob.Id, Date: date}},
+	}
+	for _, p := range pages {
+		p.Id = primitive.NewObjectID()
+		if err := db.Pages.Insert(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// files of the directory not written by an export are kept
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "README.md"), []byte("# wiki\n"), 0644)
+	if n, err := exportDirectory(db, alice, dir); err != nil || n != 3 {
+		t.Fatal("export failed:", n, err)
+	}
+	git := filepath.Join(dir, ".git", "HEAD")
+	os.MkdirAll(filepath.Dir(git), 0755)
+	os.WriteFile(git, []byte("ref: refs/heads/main\n"), 0644)
+
+	// renamed, no longer readable and removed pages
+	pages[0].Article.Title = "Hello"
+	pages[0].Projects = nil
+	pages[1].Access = PRIVATE
+	for _, p := range pages[:2] {
+		if err := db.Pages.Update(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Pages.Remove(pages[2].Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := exportDirectory(db, alice, dir); err != nil || n != 1 {
+		t.Fatal("export failed:", n, err)
+	}
+	var files []string
+	filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if !d.IsDir() {
+			rel, _ := filepath.Rel(dir, file)
+			files = append(files, filepath.ToSlash(rel))
+		} else if file != dir && d.Name() != ".git" {
+			if entries, _ := os.ReadDir(file); len(entries) == 0 {
+				t.Error("empty folder should be removed:", file)
+			}
+		}
+		return nil
+	})
+	if strings.Join(files, ",") != ".git/HEAD,.irori-export,Hello.md,README.md" {
+		t.Error("export should mirror the readable pages:", files)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/flosch/pongo2"
+)
+
+const (
+	LOCALE_DIR = "locale"
+
+	// DEFAULT_LOCALE is the site language unless configured otherwise.
+	DEFAULT_LOCALE = "ja"
+	// FALLBACK_LOCALE has every message and is used for missing ones.
+	FALLBACK_LOCALE = "en"
+)
+
+// catalogs holds the messages of every locale, catalogs[locale][key].
+var catalogs = map[string]map[string]string{}
+
+// loadCatalogs reads every <locale>.json under dir.
+func loadCatalogs(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+
+		messages := map[string]string{}
+		if err := json.Unmarshal(b, &messages); err != nil {
+			return fmt.Errorf("%s: %v", f, err)
+		}
+
+		locale := strings.TrimSuffix(filepath.Base(f), ".json")
+		catalogs[locale] = messages
+	}
+
+	return nil
+}
+
+func siteLocale() string {
+	if IroriConfig.Language != "" {
+		return IroriConfig.Language
+	}
+	return DEFAULT_LOCALE
+}
+
+// T returns the message of key in locale, falling back to the site locale,
+// the fallback locale and then to key itself. args are applied with
+// fmt.Sprintf.
+func T(locale string, key string, args ...interface{}) string {
+	msg := key
+	for _, l := range []string{locale, siteLocale(), FALLBACK_LOCALE} {
+		if m, ok := catalogs[l][key]; ok {
+			msg = m
+			break
+		}
+	}
+
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+type acceptLanguage struct {
+	tag string
+	q   float64
+}
+
+// parseAcceptLanguage returns the language tags of the header ordered by
+// preference.
+func parseAcceptLanguage(header string) []string {
+	var langs []acceptLanguage
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		al := acceptLanguage{tag: part, q: 1}
+		if i := strings.Index(part, ";"); i >= 0 {
+			al.tag = strings.TrimSpace(part[:i])
+			param := strings.TrimSpace(part[i+1:])
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					al.q = q
+				}
+			}
+		}
+		if al.q > 0 {
+			langs = append(langs, al)
+		}
+	}
+
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+
+	tags := make([]string, len(langs))
+	for i, al := range langs {
+		tags[i] = strings.ToLower(al.tag)
+	}
+	return tags
+}
+
+// negotiateLocale picks the locale from the user preference, then from the
+// Accept-Language header of the request.
+func negotiateLocale(u *user, r *http.Request) string {
+	if u != nil && u.Language != "" {
+		if _, ok := catalogs[u.Language]; ok {
+			return u.Language
+		}
+	}
+
+	if r != nil {
+		for _, tag := range parseAcceptLanguage(r.Header.Get("Accept-Language")) {
+			if _, ok := catalogs[tag]; ok {
+				return tag
+			}
+			// "ja-JP" matches "ja"
+			if i := strings.Index(tag, "-"); i > 0 {
+				if _, ok := catalogs[tag[:i]]; ok {
+					return tag[:i]
+				}
+			}
+		}
+	}
+
+	return siteLocale()
+}
+
+// Locale returns the locale negotiated for the logged in user.
+func (u *user) Locale() string {
+	if u.locale != "" {
+		return u.locale
+	}
+	if u.Language != "" {
+		return u.Language
+	}
+	return siteLocale()
+}
+
+// filterTrans translates the message key to the locale given as parameter,
+// either a locale name or a user:
+// {{ "nav.logout"|trans:loginuser }} or {{ "login.title"|trans:locale }}
+func filterTrans(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	locale := siteLocale()
+	switch p := param.Interface().(type) {
+	case *user:
+		if p != nil {
+			locale = p.Locale()
+		}
+	case string:
+		if p != "" {
+			locale = p
+		}
+	}
+
+	return pongo2.AsValue(T(locale, in.String())), nil
+}
+
+func init() {
+	pongo2.RegisterFilter("trans", filterTrans)
+}
+
+func initCatalogs() {
+	if err := loadCatalogs(LOCALE_DIR); err != nil {
+		log.Println("loadCatalogs failed: ", err)
+	}
+}
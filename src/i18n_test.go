@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	got := parseAcceptLanguage("en-US;q=0.8, ja-JP, fr;q=0, en;q=0.5")
+	want := []string{"ja-jp", "en-us", "en"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseAcceptLanguage = %v, want %v", got, want)
+	}
+
+	if got := parseAcceptLanguage(""); len(got) != 0 {
+		t.Errorf("empty header should give no language: %v", got)
+	}
+}
+
+func TestNegotiateLocale(t *testing.T) {
+	saved := catalogs
+	defer func() { catalogs = saved }()
+	catalogs = map[string]map[string]string{
+		"en": {"hello": "Hello %s"},
+		"ja": {"hello": "こんにちは %s"},
+	}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Language", "de, ja-JP;q=0.9, en;q=0.8")
+
+	if l := negotiateLocale(nil, r); l != "ja" {
+		t.Errorf("negotiateLocale from header = %s, want ja", l)
+	}
+	if l := negotiateLocale(&user{Language: "en"}, r); l != "en" {
+		t.Errorf("user preference should win: %s", l)
+	}
+	if l := negotiateLocale(&user{Language: "xx"}, nil); l != siteLocale() {
+		t.Errorf("unknown preference should fall back to the site locale: %s", l)
+	}
+
+	if msg := T("en", "hello", "irori"); msg != "Hello irori" {
+		t.Errorf("T = %q", msg)
+	}
+	if msg := T("de", "missing"); msg != "missing" {
+		t.Errorf("missing key should return the key: %q", msg)
+	}
+}
@@ -0,0 +1,846 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zenazn/goji/web"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PAGE_IMPORT_MAX_SIZE bounds the archives and directories imported.
+const PAGE_IMPORT_MAX_SIZE = 64 * 1024 * 1024
+
+// importDoc is a page read from an import, before it is stored.
+type importDoc struct {
+	// Path identifies the source of the page in the import.
+	Path  string
+	Title string
+	Body  string
+	// AuthorEmail or else AuthorName maps the author, EditorName the last
+	// editor.
+	AuthorEmail string
+	AuthorName  string
+	EditorName  string
+	Projects    []string
+	Access      AccessLevel
+	Created     time.Time
+	Updated     time.Time
+}
+
+type importedPage struct {
+	Path  string             `json:"path"`
+	Id    primitive.ObjectID `json:"id"`
+	Title string             `json:"title"`
+}
+
+type skippedFile struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+type pageImportReport struct {
+	DryRun      bool           `json:"dryRun"`
+	Pages       []importedPage `json:"pages"`
+	Attachments int            `json:"attachments"`
+	Skipped     []skippedFile  `json:"skipped"`
+	// Warnings are the changes made to the imported pages, such as links
+	// left pointing to nothing.
+	Warnings []string `json:"warnings"`
+}
+
+// pageImporter stores the pages of an import for user, who authors the
+// pages whose author is unknown.
+type pageImporter struct {
+	db     *docdb
+	user   *user
+	r      *http.Request
+	dryRun bool
+	// mapAuthors keeps the authors and editors of the import, for the
+	// admins and the command line. Otherwise the pages are the user's, so
+	// that nobody creates pages in the name of others.
+	mapAuthors bool
+	// projects are assigned to every page
+	projects []primitive.ObjectID
+
+	report  pageImportReport
+	ids     map[string]primitive.ObjectID
+	byEmail map[string]*user
+	byName  map[string]*user
+	// project ids by name, nil when missing
+	projectIds map[string]*primitive.ObjectID
+}
+
+func newPageImporter(db *docdb, u *user, dryRun bool) (*pageImporter, error) {
+	users, err := db.Users.List(true)
+	if err != nil {
+		return nil, err
+	}
+
+	imp := &pageImporter{
+		db:         db,
+		user:       u,
+		dryRun:     dryRun,
+		mapAuthors: u.HasPermission(ADMIN),
+		report:     pageImportReport{DryRun: dryRun, Pages: []importedPage{}, Skipped: []skippedFile{}, Warnings: []string{}},
+		ids:        map[string]primitive.ObjectID{},
+		byEmail:    map[string]*user{},
+		byName:     map[string]*user{},
+		projectIds: map[string]*primitive.ObjectID{},
+	}
+	for i := range users {
+		if users[i].EMail != "" {
+			imp.byEmail[strings.ToLower(users[i].EMail)] = &users[i]
+		}
+		imp.byName[users[i].Name] = &users[i]
+	}
+	return imp, nil
+}
+
+func (imp *pageImporter) skip(path string, format string, args ...interface{}) {
+	imp.report.Skipped = append(imp.report.Skipped, skippedFile{Path: path, Reason: fmt.Sprintf(format, args...)})
+}
+
+func (imp *pageImporter) warn(path string, format string, args ...interface{}) {
+	imp.report.Warnings = append(imp.report.Warnings, path+": "+fmt.Sprintf(format, args...))
+}
+
+// assignIds gives their page id to docs, so that the pages can link to each
+// other before they are stored.
+func (imp *pageImporter) assignIds(docs []importDoc) {
+	for _, d := range docs {
+		imp.ids[d.Path] = primitive.NewObjectID()
+	}
+}
+
+func (imp *pageImporter) projectId(name string) (*primitive.ObjectID, error) {
+	if id, ok := imp.projectIds[name]; ok {
+		return id, nil
+	}
+
+	p, err := imp.db.Projects.FindByName(name)
+	if err == ErrNotFound {
+		imp.projectIds[name] = nil
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	imp.projectIds[name] = &p.Id
+	return &p.Id, nil
+}
+
+func (imp *pageImporter) author(d *importDoc) *user {
+	if !imp.mapAuthors {
+		if who := strings.TrimSpace(d.AuthorEmail + " " + d.AuthorName); who != "" {
+			imp.warn(d.Path, "author %s imported as %s", who, imp.user.Name)
+		}
+		return imp.user
+	}
+
+	if u := imp.byEmail[strings.ToLower(d.AuthorEmail)]; d.AuthorEmail != "" && u != nil {
+		return u
+	}
+	if u := imp.byName[d.AuthorName]; d.AuthorName != "" && u != nil {
+		return u
+	}
+
+	if who := strings.TrimSpace(d.AuthorEmail + " " + d.AuthorName); who != "" {
+		imp.warn(d.Path, "author %s unknown, imported as %s", who, imp.user.Name)
+	}
+	return imp.user
+}
+
+// store saves d as a new page, or skips it, returning whether it was
+// stored.
+func (imp *pageImporter) store(d *importDoc) (bool, error) {
+	if d.Title == "" {
+		d.Title = strings.TrimSuffix(path.Base(d.Path), path.Ext(d.Path))
+	}
+
+	now := time.Now()
+	p := &page{
+		Id:       imp.ids[d.Path],
+		Author:   imp.author(d).Id,
+		Projects: append([]primitive.ObjectID{}, imp.projects...),
+		Access:   d.Access,
+		Groups:   []primitive.ObjectID{},
+		Created:  d.Created,
+		Article: article{
+			Id:     primitive.NewObjectID(),
+			Title:  d.Title,
+			Body:   d.Body,
+			UserId: imp.user.Id,
+			Date:   d.Updated,
+		},
+	}
+	if p.Access == "" {
+		p.Access = PUBLIC
+	}
+	if p.Article.Date.IsZero() {
+		p.Article.Date = now
+	}
+	if p.Created.IsZero() {
+		p.Created = p.Article.Date
+	}
+	if imp.mapAuthors {
+		if u := imp.byName[d.EditorName]; u != nil {
+			p.Article.UserId = u.Id
+		} else if d.EditorName == "" {
+			p.Article.UserId = p.Author
+		}
+	}
+
+	for _, name := range d.Projects {
+		id, err := imp.projectId(name)
+		if err != nil {
+			return false, err
+		}
+		if id == nil {
+			imp.warn(d.Path, "project %s unknown, not assigned", name)
+		} else if !containsId(p.Projects, *id) {
+			p.Projects = append(p.Projects, *id)
+		}
+	}
+
+	if errs := validatePageAccess(p); len(errs) > 0 {
+		imp.skip(d.Path, "access %s: %s", p.Access, errs[0].Message)
+		return false, nil
+	}
+	if !imp.user.canCreatePage(p.Projects) {
+		imp.skip(d.Path, "no permission to create the page in its projects")
+		return false, nil
+	}
+	if errs, err := validatePageProjects(imp.db, p, nil); err != nil {
+		return false, err
+	} else if len(errs) > 0 {
+		imp.skip(d.Path, "%s", errs[0].Message)
+		return false, nil
+	}
+
+	if !imp.dryRun {
+		if err := imp.db.Pages.Insert(p); err != nil {
+			return false, err
+		}
+		recordAudit(imp.db, imp.r, imp.user, "page.import", "page:"+p.Id.Hex(), nil, summarizePage(p))
+	}
+	imp.report.Pages = append(imp.report.Pages, importedPage{Path: d.Path, Id: p.Id, Title: p.Article.Title})
+	return true, nil
+}
+
+// parseYAMLScalar reads a YAML scalar: quoted, or plain up to a comment.
+func parseYAMLScalar(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("unterminated string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	return s, nil
+}
+
+// parseYAMLFlowList reads a list written [a, "b", 'c'].
+func parseYAMLFlowList(s string) ([]string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("unterminated list %s", s)
+	}
+	s = s[1 : len(s)-1]
+
+	var items []string
+	var quote rune
+	start := 0
+	for i, r := range s + "," {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ',':
+			if item := strings.TrimSpace(s[start:i]); item != "" {
+				v, err := parseYAMLScalar(item)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, v)
+			}
+			start = i + 1
+		}
+	}
+	return items, nil
+}
+
+// parseFrontMatter splits the YAML front matter of a Markdown file from its
+// body. It reads the part of YAML front matters use: top level keys with a
+// scalar or a list, nested maps being ignored.
+func parseFrontMatter(text string) (map[string]interface{}, string, error) {
+	text = strings.TrimPrefix(text, "\ufeff")
+	if !strings.HasPrefix(text, "---\n") && !strings.HasPrefix(text, "---\r\n") {
+		return nil, text, nil
+	}
+
+	lines := strings.SplitAfter(text, "\n")
+	fm := map[string]interface{}{}
+	key := ""
+	for i := 1; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r\n")
+		if line == "---" || line == "..." {
+			body := strings.TrimLeft(strings.Join(lines[i+1:], ""), "\r\n")
+			return fm, body, nil
+		}
+
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+		case line[0] == ' ' || line[0] == '\t' || line[0] == '-':
+			// the items of a block list, or a nested map ignored
+			if !strings.HasPrefix(trimmed, "- ") || key == "" {
+				continue
+			}
+			v, err := parseYAMLScalar(trimmed[2:])
+			if err != nil {
+				return nil, "", fmt.Errorf("front matter line %d: %v", i+1, err)
+			}
+			list, _ := fm[key].([]string)
+			fm[key] = append(list, v)
+
+		default:
+			colon := strings.Index(line, ":")
+			if colon < 0 {
+				return nil, "", fmt.Errorf("front matter line %d: no key", i+1)
+			}
+			key = strings.TrimSpace(line[:colon])
+			value := strings.TrimSpace(line[colon+1:])
+
+			var err error
+			switch {
+			case value == "":
+				fm[key] = []string{}
+			case strings.HasPrefix(value, "["):
+				fm[key], err = parseYAMLFlowList(value)
+			default:
+				fm[key], err = parseYAMLScalar(value)
+			}
+			if err != nil {
+				return nil, "", fmt.Errorf("front matter line %d: %v", i+1, err)
+			}
+		}
+	}
+	return nil, "", errors.New("front matter not terminated")
+}
+
+// frontMatterTime reads a date of a front matter, zero when missing.
+func frontMatterTime(fm map[string]interface{}, key string) (time.Time, error) {
+	s, _ := fm[key].(string)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, siteLocation); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid %s date %s", key, s)
+}
+
+var markdownTitle = regexp.MustCompile(`^#\s+(.+?)\s*#*\s*$`)
+
+// parseMarkdownDoc reads the Markdown file name of an import. The title is
+// taken from the front matter, the leading heading or the file name.
+func parseMarkdownDoc(name string, data []byte) (*importDoc, error) {
+	if !utf8.Valid(data) {
+		return nil, errors.New("not UTF-8 text")
+	}
+	fm, body, err := parseFrontMatter(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	d := &importDoc{Path: name, Body: body}
+	d.Title, _ = fm["title"].(string)
+	d.AuthorEmail, _ = fm["author_email"].(string)
+	if d.AuthorEmail == "" {
+		d.AuthorEmail, _ = fm["email"].(string)
+	}
+	d.AuthorName, _ = fm["author"].(string)
+	if strings.Contains(d.AuthorName, "@") && d.AuthorEmail == "" {
+		d.AuthorEmail, d.AuthorName = d.AuthorName, ""
+	}
+	d.EditorName, _ = fm["updated_by"].(string)
+	access, _ := fm["access"].(string)
+	d.Access = AccessLevel(access)
+
+	switch projects := fm["projects"].(type) {
+	case []string:
+		d.Projects = projects
+	case string:
+		d.Projects = []string{projects}
+	}
+
+	if d.Created, err = frontMatterTime(fm, "created"); err != nil {
+		return nil, err
+	}
+	if d.Updated, err = frontMatterTime(fm, "updated"); err != nil {
+		return nil, err
+	}
+	if d.Updated.IsZero() {
+		d.Updated, _ = frontMatterTime(fm, "date")
+	}
+
+	if d.Title == "" {
+		first, rest, _ := strings.Cut(d.Body, "\n")
+		if m := markdownTitle.FindStringSubmatch(strings.TrimRight(first, "\r")); m != nil {
+			d.Title, d.Body = m[1], strings.TrimLeft(rest, "\r\n")
+		}
+	}
+	return d, nil
+}
+
+var (
+	markdownLink    = regexp.MustCompile(`(!?)\[([^\]]*)\]\(\s*(<[^>]*>|[^)\s]+)(\s+"[^"]*")?\s*\)`)
+	markdownLinkDef = regexp.MustCompile(`^(\s{0,3}\[[^\]]+\]:\s*)(\S+)(.*)$`)
+)
+
+// markdownImport imports a tree of Markdown files: the links between them
+// become links to the pages, the files they reference attachments.
+type markdownImport struct {
+	*pageImporter
+	files map[string][]byte
+	pages map[string]bool
+	// attachments of the page being imported by path, nil when the file
+	// can't be attached. Each page has its own copy of the files it shares
+	// with others, as readable as the page.
+	attachments map[string]*attachment
+	// referenced are the files linked to by the pages
+	referenced map[string]bool
+}
+
+func isMarkdownFile(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".md" || ext == ".markdown"
+}
+
+// resolve returns the URL replacing the link target of the page d.
+func (mi *markdownImport) resolve(d *importDoc, target string, image bool) (string, bool) {
+	target = strings.Trim(target, "<>")
+	if u, err := url.Parse(target); err != nil || u.Scheme != "" || u.Host != "" ||
+		strings.HasPrefix(target, "/") || strings.HasPrefix(target, "#") {
+		return "", false
+	}
+
+	file, fragment, _ := strings.Cut(target, "#")
+	if unescaped, err := url.PathUnescape(file); err == nil {
+		file = unescaped
+	}
+	file = path.Join(path.Dir(d.Path), file)
+	if file == ".." || strings.HasPrefix(file, "../") {
+		imp := mi.pageImporter
+		imp.warn(d.Path, "link to %s outside of the import kept", target)
+		return "", false
+	}
+	if fragment != "" {
+		fragment = "#" + fragment
+	}
+
+	if !image {
+		for _, name := range []string{file, file + ".md", file + ".markdown"} {
+			if mi.pages[name] {
+				if id, ok := mi.ids[name]; ok {
+					return "/docs/" + id.Hex() + fragment, true
+				}
+			}
+		}
+	}
+
+	data, ok := mi.files[file]
+	if !ok || mi.pages[file] {
+		mi.warn(d.Path, "link to %s not found, kept", target)
+		return "", false
+	}
+
+	a, seen := mi.attachments[file]
+	if !seen {
+		if len(data) <= ATTACHMENT_MAX_SIZE {
+			a = newAttachment(mi.ids[d.Path], file, data)
+		} else if !mi.referenced[file] {
+			mi.skip(file, "larger than %d bytes", ATTACHMENT_MAX_SIZE)
+		}
+		mi.attachments[file] = a
+	}
+	mi.referenced[file] = true
+	if a == nil {
+		return "", false
+	}
+	return a.url(), true
+}
+
+// attach stores the attachments of the page just imported. They are only
+// stored with their page, so that no attachment is left to a skipped page.
+func (mi *markdownImport) attach() {
+	var files []string
+	for file := range mi.attachments {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		a := mi.attachments[file]
+		if a == nil {
+			continue
+		}
+		if !mi.dryRun {
+			if err := mi.db.Attachments.Insert(a); err != nil {
+				log.Println("markdownImport.attach: ", err)
+				continue
+			}
+		}
+		mi.report.Attachments++
+	}
+}
+
+// rewriteLinks rewrites the links and images of the body of d, except in
+// the code blocks.
+func (mi *markdownImport) rewriteLinks(d *importDoc) {
+	lines := strings.SplitAfter(d.Body, "\n")
+	fence := ""
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fence = trimmed[:3]
+			continue
+		}
+
+		line = markdownLink.ReplaceAllStringFunc(line, func(link string) string {
+			m := markdownLink.FindStringSubmatch(link)
+			if u, ok := mi.resolve(d, m[3], m[1] == "!"); ok {
+				return m[1] + "[" + m[2] + "](" + u + m[4] + ")"
+			}
+			return link
+		})
+		if m := markdownLinkDef.FindStringSubmatch(strings.TrimRight(line, "\r\n")); m != nil {
+			if u, ok := mi.resolve(d, m[2], false); ok {
+				line = m[1] + u + m[3] + line[len(strings.TrimRight(line, "\r\n")):]
+			}
+		}
+		lines[i] = line
+	}
+	d.Body = strings.Join(lines, "")
+}
+
+// importMarkdown imports the Markdown files of files, keyed by their slash
+// separated path in the import.
+func (imp *pageImporter) importMarkdown(files map[string][]byte) error {
+	mi := &markdownImport{pageImporter: imp, files: files, pages: map[string]bool{}, referenced: map[string]bool{}}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var docs []importDoc
+	for _, name := range names {
+		if !isMarkdownFile(name) {
+			continue
+		}
+		d, err := parseMarkdownDoc(name, files[name])
+		if err != nil {
+			imp.skip(name, "%v", err)
+			continue
+		}
+		mi.pages[name] = true
+		docs = append(docs, *d)
+	}
+
+	imp.assignIds(docs)
+	for i := range docs {
+		mi.attachments = map[string]*attachment{}
+		mi.rewriteLinks(&docs[i])
+		stored, err := imp.store(&docs[i])
+		if err != nil {
+			return err
+		}
+		if stored {
+			mi.attach()
+		}
+	}
+
+	for _, name := range names {
+		if !isMarkdownFile(name) && !mi.referenced[name] {
+			imp.skip(name, "not a Markdown file nor referenced by one")
+		}
+	}
+	return nil
+}
+
+// readImportZip returns the files of a zip, without the directories.
+func readImportZip(data []byte) (map[string][]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{}
+	total := uint64(0)
+	for _, f := range zr.File {
+		name := path.Clean(strings.ReplaceAll(f.Name, `\`, "/"))
+		if f.FileInfo().IsDir() || strings.HasPrefix(name, "../") || strings.HasPrefix(path.Base(name), ".") ||
+			strings.HasPrefix(name, "__MACOSX/") {
+			continue
+		}
+		if total += f.UncompressedSize64; total > PAGE_IMPORT_MAX_SIZE {
+			return nil, fmt.Errorf("more than %d bytes to import", PAGE_IMPORT_MAX_SIZE)
+		}
+
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(r, PAGE_IMPORT_MAX_SIZE))
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		files[strings.TrimPrefix(name, "/")] = data
+	}
+	return files, nil
+}
+
+// readImportDir returns the files under dir, without the hidden ones.
+func readImportDir(dir string) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	total := int64(0)
+	err := filepath.WalkDir(dir, func(file string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if file != dir && strings.HasPrefix(e.Name(), ".") {
+			if e.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !e.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		if total += info.Size(); total > PAGE_IMPORT_MAX_SIZE {
+			return fmt.Errorf("more than %d bytes to import", PAGE_IMPORT_MAX_SIZE)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, file)
+		files[filepath.ToSlash(rel)] = data
+		return nil
+	})
+	return files, err
+}
+
+func apiPageImportPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	docdb := getDocDb(c)
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+
+	var data []byte
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err = r.ParseMultipartForm(PAGE_IMPORT_MAX_SIZE); err == nil {
+			f, _, ferr := r.FormFile("file")
+			if err = ferr; err == nil {
+				data, err = io.ReadAll(f)
+				f.Close()
+			}
+		}
+	} else {
+		defer r.Body.Close()
+		data, err = io.ReadAll(io.LimitReader(r.Body, PAGE_IMPORT_MAX_SIZE))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	imp, err := newPageImporter(docdb, getSessionUser(c), dryRun)
+	if err != nil {
+		log.Println("apiPageImportPostHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	imp.r = r
+
+	if pid := r.URL.Query().Get("project"); pid != "" {
+		if !isObjectIdHex(pid) {
+			writeValidationErrors(w, []validationError{{Field: "project", Code: "invalid", Message: "unknown project"}})
+			return
+		}
+		if _, err := docdb.Projects.Get(objectIdHex(pid)); err == ErrNotFound {
+			writeValidationErrors(w, []validationError{{Field: "project", Code: "invalid", Message: "unknown project"}})
+			return
+		} else if err != nil {
+			log.Println("apiPageImportPostHandler: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		imp.projects = []primitive.ObjectID{objectIdHex(pid)}
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "markdown":
+		files, zerr := readImportZip(data)
+		if zerr != nil {
+			http.Error(w, zerr.Error(), http.StatusBadRequest)
+			return
+		}
+		err = imp.importMarkdown(files)
+	case "mediawiki":
+		err = imp.importMediaWiki(bytes.NewReader(data))
+		if errors.Is(err, ErrImportInvalid) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		writeValidationErrors(w, []validationError{{Field: "format", Code: "invalid", Message: "format is markdown or mediawiki"}})
+		return
+	}
+	if err != nil {
+		log.Println("apiPageImportPostHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(imp.report)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// importCommand runs "irori import -user name [-project name] [-dry-run] path",
+// path being a directory or a zip of Markdown files, or a MediaWiki XML export.
+func importCommand(db *docdb, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	name := fs.String("user", "", "import as the user `name`, author of the pages of unknown author")
+	project := fs.String("project", "", "add the pages to the project `name`")
+	dryRun := fs.Bool("dry-run", false, "only report what would be imported")
+	fs.Parse(args)
+
+	if *name == "" || fs.NArg() != 1 {
+		return errors.New("usage: irori import -user name [-project name] [-dry-run] path")
+	}
+	u, err := db.Users.FindByName(*name)
+	if err == ErrNotFound {
+		return fmt.Errorf("no user %s", *name)
+	} else if err != nil {
+		return err
+	}
+	if err := resolvePermissions(db, u); err != nil {
+		return err
+	}
+
+	imp, err := newPageImporter(db, u, *dryRun)
+	if err != nil {
+		return err
+	}
+	imp.mapAuthors = true
+	if *project != "" {
+		p, err := db.Projects.FindByName(*project)
+		if err == ErrNotFound {
+			return fmt.Errorf("no project %s", *project)
+		} else if err != nil {
+			return err
+		}
+		imp.projects = []primitive.ObjectID{p.Id}
+	}
+
+	src := fs.Arg(0)
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.IsDir():
+		files, err := readImportDir(src)
+		if err == nil {
+			err = imp.importMarkdown(files)
+		}
+		if err != nil {
+			return err
+		}
+
+	case strings.HasSuffix(strings.ToLower(src), ".xml"):
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		err = imp.importMediaWiki(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+	default:
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		files, err := readImportZip(data)
+		if err == nil {
+			err = imp.importMarkdown(files)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	verb := "imported"
+	if *dryRun {
+		verb = "would import"
+	}
+	for _, p := range imp.report.Pages {
+		fmt.Printf("%s %s as %s\n", verb, p.Path, p.Id.Hex())
+	}
+	for _, s := range imp.report.Skipped {
+		fmt.Printf("skipped %s: %s\n", s.Path, s.Reason)
+	}
+	for _, warning := range imp.report.Warnings {
+		fmt.Println("warning:", warning)
+	}
+	fmt.Printf("%d pages and %d attachments %s, %d files skipped\n",
+		len(imp.report.Pages), imp.report.Attachments, verb, len(imp.report.Skipped))
+	return nil
+}
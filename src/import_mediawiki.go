@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrImportInvalid is returned for an import that can't be read.
+var ErrImportInvalid = errors.New("invalid import")
+
+// mediaWikiPage is the part of a page of a MediaWiki XML export
+// (Special:Export, dumpBackup.php) the import reads. Of the history only the
+// first and the last revisions are kept.
+type mediaWikiPage struct {
+	Title    string
+	Ns       int
+	Redirect *struct {
+		Title string `xml:"title,attr"`
+	}
+	First *mediaWikiRevision
+	Last  *mediaWikiRevision
+}
+
+type mediaWikiRevision struct {
+	Timestamp   time.Time `xml:"timestamp"`
+	Contributor struct {
+		Username string `xml:"username"`
+		IP       string `xml:"ip"`
+	} `xml:"contributor"`
+	Text string `xml:"text"`
+}
+
+// decodeMediaWikiPage reads the page element just started from dec, one
+// revision at a time.
+func decodeMediaWikiPage(dec *xml.Decoder) (*mediaWikiPage, error) {
+	wp := &mediaWikiPage{}
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "title":
+				err = dec.DecodeElement(&wp.Title, &t)
+			case "ns":
+				err = dec.DecodeElement(&wp.Ns, &t)
+			case "redirect":
+				err = dec.DecodeElement(&wp.Redirect, &t)
+			case "revision":
+				var rev mediaWikiRevision
+				err = dec.DecodeElement(&rev, &t)
+				// exports list the revisions from the oldest
+				if wp.First == nil {
+					wp.First = &rev
+				}
+				wp.Last = &rev
+			default:
+				err = dec.Skip()
+			}
+			if err != nil {
+				return nil, err
+			}
+		case xml.EndElement:
+			return wp, nil
+		}
+	}
+}
+
+// readMediaWikiPages calls f with each page of the MediaWiki XML export r in
+// turn, so that large exports are not read into memory at once.
+func readMediaWikiPages(r io.Reader, f func(wp *mediaWikiPage)) error {
+	dec := xml.NewDecoder(r)
+	root := false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF && root {
+			return nil
+		} else if err == io.EOF {
+			return fmt.Errorf("%w: no MediaWiki export", ErrImportInvalid)
+		} else if err != nil {
+			return fmt.Errorf("%w: %v", ErrImportInvalid, err)
+		}
+
+		if t, ok := tok.(xml.StartElement); ok {
+			root = true
+			if t.Name.Local == "page" {
+				wp, err := decodeMediaWikiPage(dec)
+				if err != nil {
+					return fmt.Errorf("%w: %v", ErrImportInvalid, err)
+				}
+				f(wp)
+			}
+		}
+	}
+}
+
+// mediaWikiTitle normalises a page title the way MediaWiki compares them.
+func mediaWikiTitle(s string) string {
+	s = strings.TrimSpace(strings.ReplaceAll(s, "_", " "))
+	s = strings.Join(strings.Fields(s), " ")
+	if s == "" {
+		return s
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[size:]
+}
+
+var (
+	wikiHeading      = regexp.MustCompile(`^(={1,6})\s*(.*?)\s*={1,6}\s*$`)
+	wikiList         = regexp.MustCompile(`^([*#:;]+)\s*(.*)$`)
+	wikiBoldItalic   = regexp.MustCompile(`'''''(.+?)'''''`)
+	wikiBold         = regexp.MustCompile(`'''(.+?)'''`)
+	wikiItalic       = regexp.MustCompile(`''(.+?)''`)
+	wikiInternalLink = regexp.MustCompile(`\[\[([^\]|]+)(?:\|([^\]]*))?\]\]`)
+	wikiExternalLink = regexp.MustCompile(`\[((?:https?|ftp|mailto):[^\s\]]+)(?:\s+([^\]]*))?\]`)
+	wikiTemplate     = regexp.MustCompile(`\{\{[^{}]*\}\}`)
+	wikiCodeOpen     = regexp.MustCompile(`^\s*<(pre|syntaxhighlight|source)(?:\s+lang="?([\w+-]*)"?)?[^>]*>(.*)$`)
+	wikiCodeClose    = regexp.MustCompile(`</(pre|syntaxhighlight|source)>\s*$`)
+)
+
+// mediaWikiConverter converts the wikitext of a page to Markdown, the links
+// to pages of the import becoming links to the imported pages.
+type mediaWikiConverter struct {
+	imp  *pageImporter
+	path string
+	// page paths by normalised title
+	titles map[string]string
+}
+
+func (mc *mediaWikiConverter) inline(s string) string {
+	s = wikiTemplate.ReplaceAllStringFunc(s, func(t string) string {
+		mc.imp.warn(mc.path, "template %s removed", t)
+		return ""
+	})
+
+	s = wikiInternalLink.ReplaceAllStringFunc(s, func(link string) string {
+		m := wikiInternalLink.FindStringSubmatch(link)
+		target, text := strings.TrimSpace(m[1]), m[2]
+		if text == "" {
+			text = target
+		}
+
+		if ns, _, ok := strings.Cut(target, ":"); ok {
+			switch strings.ToLower(ns) {
+			case "file", "image", "media":
+				mc.imp.warn(mc.path, "file %s not imported", target)
+				return ""
+			case "category":
+				return ""
+			}
+		}
+
+		title, fragment, _ := strings.Cut(target, "#")
+		if p, ok := mc.titles[mediaWikiTitle(title)]; ok {
+			u := "/docs/" + mc.imp.ids[p].Hex()
+			if fragment != "" {
+				u += "#" + fragment
+			}
+			return "[" + text + "](" + u + ")"
+		}
+		if title == "" {
+			return "[" + text + "](#" + fragment + ")"
+		}
+		mc.imp.warn(mc.path, "link to %s not found, kept as text", target)
+		return text
+	})
+
+	s = wikiExternalLink.ReplaceAllStringFunc(s, func(link string) string {
+		m := wikiExternalLink.FindStringSubmatch(link)
+		if m[2] == "" {
+			return "<" + m[1] + ">"
+		}
+		return "[" + m[2] + "](" + m[1] + ")"
+	})
+
+	s = wikiBoldItalic.ReplaceAllString(s, "***$1***")
+	s = wikiBold.ReplaceAllString(s, "**$1**")
+	s = wikiItalic.ReplaceAllString(s, "*$1*")
+	return s
+}
+
+// convert returns text as Markdown. Headings, lists, emphasis, links and
+// code blocks are converted; tables are kept as they are, with a warning.
+func (mc *mediaWikiConverter) convert(text string) string {
+	var out []string
+	code := false
+	table := false
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		if code {
+			if m := wikiCodeClose.FindStringIndex(line); m != nil {
+				if rest := line[:m[0]]; rest != "" {
+					out = append(out, rest)
+				}
+				out = append(out, "```")
+				code = false
+			} else {
+				out = append(out, line)
+			}
+			continue
+		}
+		if m := wikiCodeOpen.FindStringSubmatch(line); m != nil {
+			out = append(out, "```"+m[2])
+			rest := m[3]
+			if c := wikiCodeClose.FindStringIndex(rest); c != nil {
+				if rest[:c[0]] != "" {
+					out = append(out, rest[:c[0]])
+				}
+				out = append(out, "```")
+			} else {
+				if rest != "" {
+					out = append(out, rest)
+				}
+				code = true
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "{|") {
+			table = true
+			mc.imp.warn(mc.path, "table kept as wikitext")
+			out = append(out, "```", line)
+			continue
+		}
+		if table {
+			out = append(out, line)
+			if strings.HasPrefix(line, "|}") {
+				out = append(out, "```")
+				table = false
+			}
+			continue
+		}
+
+		switch {
+		case wikiHeading.MatchString(line):
+			m := wikiHeading.FindStringSubmatch(line)
+			out = append(out, strings.Repeat("#", len(m[1]))+" "+mc.inline(m[2]))
+		case wikiList.MatchString(line):
+			m := wikiList.FindStringSubmatch(line)
+			indent := strings.Repeat("  ", len(m[1])-1)
+			switch m[1][len(m[1])-1] {
+			case '*':
+				out = append(out, indent+"- "+mc.inline(m[2]))
+			case '#':
+				out = append(out, indent+"1. "+mc.inline(m[2]))
+			case ';':
+				out = append(out, indent+"**"+mc.inline(m[2])+"**")
+			default:
+				out = append(out, indent+"> "+mc.inline(m[2]))
+			}
+		case strings.TrimSpace(line) == "----":
+			out = append(out, "---")
+		case strings.HasPrefix(line, " ") && strings.TrimSpace(line) != "":
+			// a preformatted line
+			out = append(out, "   "+line)
+		default:
+			out = append(out, mc.inline(line))
+		}
+	}
+	if code || table {
+		out = append(out, "```")
+	}
+	return strings.TrimSpace(strings.Join(out, "\n")) + "\n"
+}
+
+// importMediaWiki imports the articles of a MediaWiki XML export, with the
+// date and contributors of their first and last revisions.
+func (imp *pageImporter) importMediaWiki(r io.Reader) error {
+	mc := &mediaWikiConverter{imp: imp, titles: map[string]string{}}
+	var docs []importDoc
+	var pages []*mediaWikiPage
+	err := readMediaWikiPages(r, func(wp *mediaWikiPage) {
+		switch {
+		case wp.Ns != 0:
+			imp.skip(wp.Title, "not an article (namespace %d)", wp.Ns)
+		case wp.Redirect != nil:
+			imp.skip(wp.Title, "redirect to %s", wp.Redirect.Title)
+		case wp.Last == nil:
+			imp.skip(wp.Title, "no revision")
+		case mc.titles[mediaWikiTitle(wp.Title)] != "":
+			imp.skip(wp.Title, "duplicate title")
+		default:
+			mc.titles[mediaWikiTitle(wp.Title)] = wp.Title
+			docs = append(docs, importDoc{Path: wp.Title, Title: wp.Title})
+			pages = append(pages, wp)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	imp.assignIds(docs)
+	for i, wp := range pages {
+		d := &docs[i]
+		first, last := wp.First, wp.Last
+		d.AuthorName = first.Contributor.Username
+		d.EditorName = last.Contributor.Username
+		d.Created = first.Timestamp
+		d.Updated = last.Timestamp
+
+		mc.path = d.Path
+		d.Body = mc.convert(last.Text)
+		if _, err := imp.store(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
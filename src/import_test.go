@@ -0,0 +1,356 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFrontMatter(t *testing.T) {
+	fm, body, err := parseFrontMatter("---\n" +
+		"title: \"Notes: \\\"draft\\\"\"\n" +
+		"author: 'O''Brien'\n" +
+		"access: private # for now\n" +
+		"projects: [handbook, \"ops, infra\"]\n" +
+		"tags:\n  - a\n  - 'b'\n" +
+		"meta:\n  key: value\n" +
+		"---\n\nbody\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"title":    `Notes: "draft"`,
+		"author":   "O'Brien",
+		"access":   "private",
+		"projects": []string{"handbook", "ops, infra"},
+		"tags":     []string{"a", "b"},
+		"meta":     []string{},
+	}
+	if !reflect.DeepEqual(fm, want) || body != "body\n" {
+		t.Errorf("parseFrontMatter = %#v %q", fm, body)
+	}
+
+	if fm, body, err := parseFrontMatter("# no front matter\n"); err != nil || fm != nil || body != "# no front matter\n" {
+		t.Error("text without front matter should be the body:", fm, body, err)
+	}
+	if _, _, err := parseFrontMatter("---\ntitle: x\n"); err == nil {
+		t.Error("unterminated front matter should fail")
+	}
+}
+
+func TestMarkdownImport(t *testing.T) {
+	db := newMemoryDocDb()
+	alice := addTestUser(t, db, "alice", ADMIN, PAGE_CREATE)
+	bob := addTestUser(t, db, "bob")
+	handbook := &project{Name: "handbook"}
+	if err := db.Projects.Insert(handbook); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"index.md": "---\ntitle: Home\nauthor_email: BOB@example.com\nprojects: [handbook, missing]\n" +
+			"updated: 2024-03-20T12:00:00Z\n---\n" +
+			"See [the guide](docs/guide.md#setup), [faq](docs/faq) and [gone](nothing.md).\n" +
+			"![logo](img/logo.png \"Logo\") [site](https://example.com) [top](#top)\n\n" +
+			"```\n[not a link](docs/guide.md)\n```\n\n[ref]: docs/guide.md\n",
+		"docs/guide.md": "# Guide\n\nBack [home](../index.md), ![logo](../img/logo.png).\n",
+		"docs/faq.md":   "---\nauthor: carol\naccess: private\n---\nFAQ\n",
+		"img/logo.png":  "\x89PNG\r\n\x1a\nlogo",
+		"notes.txt":     "unreferenced",
+		"broken.md":     "---\ntitle: [oops\n---\n",
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		f, _ := zw.Create(name)
+		f.Write([]byte(data))
+	}
+	zw.Close()
+
+	w := serve(db, alice, apiPageImportPostHandler, nil, "POST", "/api/import/pages?dryRun=true", buf.String())
+	var report pageImportReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(w.Code, err)
+	}
+	if !report.DryRun || len(report.Pages) != 3 {
+		t.Fatal("dry run should report the pages:", report)
+	}
+	if _, err := db.Pages.Get(report.Pages[0].Id); err != ErrNotFound {
+		t.Fatal("dry run should not store the pages:", err)
+	}
+
+	w = serve(db, alice, apiPageImportPostHandler, nil, "POST", "/api/import/pages", buf.String())
+	report = pageImportReport{}
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(w.Code, err)
+	}
+	if len(report.Pages) != 3 || report.Attachments != 2 || len(report.Skipped) != 2 {
+		t.Fatal("import unexpected:", report)
+	}
+	ids := map[string]string{}
+	for _, p := range report.Pages {
+		ids[p.Path] = p.Id.Hex()
+	}
+
+	home, err := db.Pages.Get(report.Pages[2].Id)
+	if err != nil || report.Pages[2].Path != "index.md" {
+		t.Fatal(report.Pages, err)
+	}
+	if home.Article.Title != "Home" || home.Author != bob.Id || home.Article.UserId != bob.Id ||
+		len(home.Projects) != 1 || home.Projects[0] != handbook.Id ||
+		!home.Article.Date.Equal(time.Date(2024, 3, 20, 12, 0, 0, 0, time.UTC)) {
+		t.Error("front matter should be imported:", home)
+	}
+	body := home.Article.Body
+	for _, s := range []string{
+		"[the guide](/docs/" + ids["docs/guide.md"] + "#setup)",
+		"[faq](/docs/" + ids["docs/faq.md"] + ")",
+		"[gone](nothing.md)",
+		"[site](https://example.com) [top](#top)",
+		"```\n[not a link](docs/guide.md)\n```",
+		"[ref]: /docs/" + ids["docs/guide.md"] + "\n",
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("body should contain %q: %s", s, body)
+		}
+	}
+
+	guide, _ := db.Pages.Get(report.Pages[1].Id)
+	if guide.Article.Title != "Guide" || strings.Contains(guide.Article.Body, "# Guide") ||
+		!strings.Contains(guide.Article.Body, "[home](/docs/"+ids["index.md"]+")") {
+		t.Error("title should be taken from the heading:", guide.Article)
+	}
+	faq, _ := db.Pages.Get(report.Pages[0].Id)
+	if faq.Author != alice.Id || faq.Access != PRIVATE {
+		t.Error("unknown authors should be the importing user:", faq)
+	}
+
+	// the logo is attached to each page using it
+	logo := func(body string) (string, map[string]string) {
+		start := strings.Index(body, "![logo](") + len("![logo](")
+		url := body[start : start+strings.IndexAny(body[start:], " )")]
+		parts := strings.Split(url, "/")
+		if len(parts) != 6 {
+			t.Fatal("images should become attachments:", body)
+		}
+		return url, map[string]string{"pageId": parts[3], "attachmentId": parts[5]}
+	}
+	homeLogo, homeParams := logo(body)
+	guideLogo, guideParams := logo(guide.Article.Body)
+	if homeParams["pageId"] != ids["index.md"] || guideParams["pageId"] != ids["docs/guide.md"] {
+		t.Fatal("logo should be attached to each page:", homeLogo, guideLogo)
+	}
+	w = serve(db, bob, apiPageAttachmentGetHandler, guideParams, "GET", guideLogo, "")
+	if w.Code != http.StatusOK || w.Body.String() != files["img/logo.png"] ||
+		w.Header().Get("Content-Type") != "image/png" || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("attachment should be served:", w.Code, w.Header())
+	}
+
+	// the attachments are as readable as their page
+	guide.Access = PRIVATE
+	if err := db.Pages.Update(guide); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(db, bob, apiPageAttachmentGetHandler, guideParams, "GET", guideLogo, ""); w.Code != http.StatusNotFound {
+		t.Error("attachment of a private page should be missing:", w.Code)
+	}
+	if w := serve(db, bob, apiPageAttachmentGetHandler, homeParams, "GET", homeLogo, ""); w.Code != http.StatusOK {
+		t.Error("attachment of the other page should be served:", w.Code)
+	}
+
+	attachments := len(db.Attachments.(*memoryAttachmentStore).attachments)
+	if w := serve(db, bob, apiPageImportPostHandler, nil, "POST", "/api/import/pages", buf.String()); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), `"pages":[]`) || !strings.Contains(w.Body.String(), `"attachments":0`) {
+		t.Error("users who can't create pages should import nothing:", w.Body.String())
+	}
+	if n := len(db.Attachments.(*memoryAttachmentStore).attachments); n != attachments {
+		t.Error("skipped pages should attach nothing:", n)
+	}
+
+	// the editors author the pages they import
+	carol := addTestUser(t, db, "carol", PAGE_CREATE)
+	w = serve(db, carol, apiPageImportPostHandler, nil, "POST", "/api/import/pages", buf.String())
+	report = pageImportReport{}
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(w.Code, err)
+	}
+	if len(report.Pages) != 3 {
+		t.Fatal("import unexpected:", report)
+	}
+	for _, ip := range report.Pages {
+		if p, _ := db.Pages.Get(ip.Id); p.Author != carol.Id || p.Article.UserId != carol.Id {
+			t.Error("editors should not import pages in the name of others:", p)
+		}
+	}
+	if !strings.Contains(strings.Join(report.Warnings, "\n"), "author BOB@example.com imported as carol") {
+		t.Error("the original author should be reported:", report.Warnings)
+	}
+}
+
+func TestMediaWikiTitle(t *testing.T) {
+	for s, want := range map[string]string{
+		" setup_guide ": "Setup guide",
+		"main   page":   "Main page",
+		"éclair":        "Éclair",
+		"あいさつ":          "あいさつ",
+		"":              "",
+	} {
+		if got := mediaWikiTitle(s); got != want {
+			t.Errorf("mediaWikiTitle(%q) = %q, want %q", s, got, want)
+		}
+	}
+
+	// the titles differ only in the lead byte of their first character
+	db := newMemoryDocDb()
+	alice := addTestUser(t, db, "alice", PAGE_CREATE)
+	imp, err := newPageImporter(db, alice, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	export := `<mediawiki>
+  <page><title>あ</title><ns>0</ns><revision><text>[[䁂]]</text></revision></page>
+  <page><title>䁂</title><ns>0</ns><revision><text>[[あ]]</text></revision></page>
+</mediawiki>`
+	if err := imp.importMediaWiki(strings.NewReader(export)); err != nil {
+		t.Fatal(err)
+	}
+	if len(imp.report.Pages) != 2 || len(imp.report.Skipped) != 0 {
+		t.Fatal("Japanese titles should not collide:", imp.report)
+	}
+	first, _ := db.Pages.Get(imp.report.Pages[0].Id)
+	if first.Article.Body != "[䁂](/docs/"+imp.report.Pages[1].Id.Hex()+")\n" {
+		t.Error("link should go to the other page:", first.Article.Body)
+	}
+}
+
+const testMediaWikiExport = `<mediawiki xmlns="http://www.mediawiki.org/xml/export-0.10/">
+  <page>
+    <title>Main Page</title>
+    <ns>0</ns>
+    <revision>
+      <timestamp>2020-01-02T03:04:05Z</timestamp>
+      <contributor><username>bob</username></contributor>
+      <text>old</text>
+    </revision>
+    <revision>
+      <timestamp>2021-01-02T03:04:05Z</timestamp>
+      <contributor><username>alice</username></contributor>
+      <text>== Welcome ==
+'''Bold''' and ''italic'' see [[setup guide#Linux|the guide]], [[Missing]] and [https://example.com site].
+* one
+** two
+# first
+{{Infobox}}[[File:Logo.png]]
+&lt;pre&gt;
+x &lt; y
+&lt;/pre&gt;
+{|
+| cell
+|}</text>
+    </revision>
+  </page>
+  <page>
+    <title>Setup guide</title>
+    <ns>0</ns>
+    <revision>
+      <timestamp>2020-05-06T00:00:00Z</timestamp>
+      <contributor><ip>127.0.0.1</ip></contributor>
+      <text>Back to [[Main_Page]].</text>
+    </revision>
+  </page>
+  <page>
+    <title>Old name</title>
+    <ns>0</ns>
+    <redirect title="Setup guide" />
+    <revision><text>#REDIRECT [[Setup guide]]</text></revision>
+  </page>
+  <page>
+    <title>Talk:Main Page</title>
+    <ns>1</ns>
+    <revision><text>chat</text></revision>
+  </page>
+</mediawiki>`
+
+func TestReadMediaWikiPages(t *testing.T) {
+	export := `<mediawiki>
+  <siteinfo><sitename>Wiki</sitename></siteinfo>
+  <page>
+    <title>History</title>
+    <ns>0</ns>
+    <id>1</id>
+    <revision><text>one</text></revision>
+    <revision><text>two</text></revision>
+    <revision><text>three</text></revision>
+  </page>
+  <page><title>Empty</title><ns>0</ns></page>
+</mediawiki>`
+
+	var pages []*mediaWikiPage
+	if err := readMediaWikiPages(strings.NewReader(export), func(wp *mediaWikiPage) { pages = append(pages, wp) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 2 || pages[0].Title != "History" || pages[0].First.Text != "one" || pages[0].Last.Text != "three" {
+		t.Fatal("the first and the last revisions should be kept:", pages)
+	}
+	if pages[1].Title != "Empty" || pages[1].First != nil || pages[1].Last != nil {
+		t.Error("page without revision unexpected:", pages[1])
+	}
+
+	for _, invalid := range []string{"", "<mediawiki><page><title>x</title>"} {
+		if err := readMediaWikiPages(strings.NewReader(invalid), func(*mediaWikiPage) {}); !errors.Is(err, ErrImportInvalid) {
+			t.Errorf("%q should be invalid: %v", invalid, err)
+		}
+	}
+}
+
+func TestMediaWikiImport(t *testing.T) {
+	db := newMemoryDocDb()
+	alice := addTestUser(t, db, "alice", PAGE_CREATE)
+	bob := addTestUser(t, db, "bob")
+
+	imp, err := newPageImporter(db, alice, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as on the command line
+	imp.mapAuthors = true
+	if err := imp.importMediaWiki(strings.NewReader(testMediaWikiExport)); err != nil {
+		t.Fatal(err)
+	}
+	if len(imp.report.Pages) != 2 || len(imp.report.Skipped) != 2 {
+		t.Fatal("import unexpected:", imp.report)
+	}
+
+	home, _ := db.Pages.Get(imp.report.Pages[0].Id)
+	guideId := imp.report.Pages[1].Id.Hex()
+	if home.Article.Title != "Main Page" || home.Author != bob.Id || home.Article.UserId != alice.Id ||
+		!home.Created.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Error("contributors and dates should be imported:", home)
+	}
+	want := "## Welcome\n" +
+		"**Bold** and *italic* see [the guide](/docs/" + guideId + "#Linux), Missing and [site](https://example.com).\n" +
+		"- one\n  - two\n1. first\n\n" +
+		"```\nx < y\n```\n" +
+		"```\n{|\n| cell\n|}\n```\n"
+	if home.Article.Body != want {
+		t.Errorf("body = %q, want %q", home.Article.Body, want)
+	}
+	if len(imp.report.Warnings) != 4 {
+		t.Error("templates, files, tables and missing links should be reported:", imp.report.Warnings)
+	}
+
+	guide, _ := db.Pages.Get(imp.report.Pages[1].Id)
+	if guide.Author != alice.Id || guide.Article.Body != "Back to [Main_Page](/docs/"+home.Id.Hex()+").\n" {
+		t.Error("page of an anonymous contributor unexpected:", guide)
+	}
+
+	if err := imp.importMediaWiki(strings.NewReader("<mediawiki>")); err == nil {
+		t.Error("invalid XML should fail")
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// collectionIndexes declares the indexes of each collection, ensured on
+// startup. The unique indexes are what keeps the names and emails unique:
+// the stores insert and map the duplicate key error to ErrDuplicate.
+var collectionIndexes = map[string][]mongo.IndexModel{
+	"users": {
+		unique(index("name"), nil),
+		// users may have no email
+		unique(index("email"), bson.M{"email": bson.M{"$gt": ""}}),
+	},
+	"groups":             {unique(index("name"), nil)},
+	"projects":           {unique(index("name"), nil)},
+	"roles":              {unique(index("name"), nil)},
+	"pages":              {index("author"), index("access"), index("groups"), index("projects"), index("-article.date")},
+	"revisions":          {index("pageid", "-date")},
+	"attachments":        {index("pageid")},
+	"audit":              {index("-date")},
+	"tokens":             {index("hash")},
+	"passwordresets":     {index("hash")},
+	"emailverifications": {index("hash")},
+}
+
+// index returns the model of an index on keys, descending when they start
+// with '-', named as MongoDB names them by default.
+func index(keys ...string) mongo.IndexModel {
+	var doc bson.D
+	var names []string
+	for _, k := range keys {
+		order := 1
+		if k[0] == '-' {
+			k, order = k[1:], -1
+		}
+		doc = append(doc, bson.E{Key: k, Value: order})
+		names = append(names, fmt.Sprintf("%s_%d", k, order))
+	}
+	return mongo.IndexModel{Keys: doc, Options: options.Index().SetName(strings.Join(names, "_"))}
+}
+
+// unique makes model a unique index, only over the documents matching
+// partial when it is set.
+func unique(model mongo.IndexModel, partial bson.M) mongo.IndexModel {
+	model.Options.SetUnique(true)
+	if partial != nil {
+		model.Options.SetPartialFilterExpression(partial)
+	}
+	return model
+}
+
+// indexNames returns the names of the indexes of collection.
+func indexNames(db *docdb, collection string) (map[string]bool, error) {
+	specs, err := db.Db.Collection(collection).Indexes().ListSpecifications(db.Ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for _, s := range specs {
+		names[s.Name] = true
+	}
+	return names, nil
+}
+
+// indexSpec is the part of an index compared with its declaration, and
+// recreated when its replacement fails.
+type indexSpec struct {
+	Name    string `bson:"name"`
+	Key     bson.D `bson:"key"`
+	Unique  bool   `bson:"unique,omitempty"`
+	Partial bson.M `bson:"partialFilterExpression,omitempty"`
+}
+
+// model returns the index of s.
+func (s indexSpec) model() mongo.IndexModel {
+	model := mongo.IndexModel{Keys: s.Key, Options: options.Index().SetName(s.Name)}
+	if s.Unique {
+		model = unique(model, s.Partial)
+	}
+	return model
+}
+
+func specOf(model mongo.IndexModel) indexSpec {
+	s := indexSpec{Name: *model.Options.Name}
+	if model.Options.Unique != nil {
+		s.Unique = *model.Options.Unique
+	}
+	if model.Options.PartialFilterExpression != nil {
+		s.Partial = model.Options.PartialFilterExpression.(bson.M)
+	}
+	return s
+}
+
+// indexReport is the difference between the declared indexes of a
+// collection and the existing ones.
+type indexReport struct {
+	Collection string
+	// Missing are declared but don't exist.
+	Missing []mongo.IndexModel
+	// Changed exist with other options, and are dropped then created.
+	Changed []mongo.IndexModel
+	// Extra exist but aren't declared. They are kept.
+	Extra []string
+}
+
+func compareIndexes(collection string, declared []mongo.IndexModel, existing []indexSpec) indexReport {
+	report := indexReport{Collection: collection}
+	byName := map[string]indexSpec{}
+	for _, s := range existing {
+		byName[s.Name] = s
+	}
+
+	names := map[string]bool{"_id_": true}
+	for _, model := range declared {
+		want := specOf(model)
+		names[want.Name] = true
+
+		if got, ok := byName[want.Name]; !ok {
+			report.Missing = append(report.Missing, model)
+		} else if got.Unique != want.Unique || !reflect.DeepEqual(got.Partial, want.Partial) {
+			report.Changed = append(report.Changed, model)
+		}
+	}
+
+	for _, s := range existing {
+		if !names[s.Name] {
+			report.Extra = append(report.Extra, s.Name)
+		}
+	}
+	return report
+}
+
+// duplicatesPipeline returns the aggregation finding the keys held by
+// several documents, over which the unique index model can't be built. It
+// returns nil for the other indexes.
+func duplicatesPipeline(model mongo.IndexModel) []bson.M {
+	if model.Options.Unique == nil || !*model.Options.Unique {
+		return nil
+	}
+
+	var pipeline []bson.M
+	if model.Options.PartialFilterExpression != nil {
+		pipeline = append(pipeline, bson.M{"$match": model.Options.PartialFilterExpression})
+	}
+	var key bson.D
+	for _, e := range model.Keys.(bson.D) {
+		key = append(key, bson.E{Key: e.Key, Value: "$" + e.Key})
+	}
+	return append(pipeline,
+		bson.M{"$group": bson.M{"_id": key, "n": bson.M{"$sum": 1}}},
+		bson.M{"$match": bson.M{"n": bson.M{"$gt": 1}}},
+		bson.M{"$sort": bson.M{"_id": 1}})
+}
+
+// duplicateKeys describes the keys of collection held by several documents,
+// that the unique index model can't be built over.
+func duplicateKeys(db *docdb, collection string, model mongo.IndexModel) ([]string, error) {
+	pipeline := duplicatesPipeline(model)
+	if pipeline == nil {
+		return nil, nil
+	}
+
+	var groups []struct {
+		Key bson.D `bson:"_id"`
+		N   int    `bson:"n"`
+	}
+	if err := db.C(collection).aggregate(pipeline, &groups); err != nil {
+		return nil, err
+	}
+
+	var dups []string
+	for _, g := range groups {
+		var fields []string
+		for _, e := range g.Key {
+			fields = append(fields, e.Key+" "+yamlValue(e.Value))
+		}
+		dups = append(dups, fmt.Sprintf("%s held by %d documents", strings.Join(fields, ", "), g.N))
+	}
+	return dups, nil
+}
+
+// ensureIndexes creates the missing indexes of collectionIndexes and
+// recreates the changed ones, reporting them to out with the extra indexes.
+// With dryRun nothing is changed.
+//
+// The duplicate keys of the unique indexes to build are reported first: the
+// indexes of a collection holding some are left as they are, and an error
+// is returned once every collection is checked.
+func ensureIndexes(db *docdb, dryRun bool, out io.Writer) error {
+	if !db.hasMongo() {
+		return nil
+	}
+
+	var collections []string
+	for name := range collectionIndexes {
+		collections = append(collections, name)
+	}
+	sort.Strings(collections)
+
+	would := ""
+	if dryRun {
+		would = "would "
+	}
+
+	var blocked []string
+	for _, name := range collections {
+		indexes := db.Db.Collection(name).Indexes()
+		cur, err := indexes.List(db.Ctx)
+		if err != nil {
+			return err
+		}
+		var existing []indexSpec
+		if err := cur.All(db.Ctx, &existing); err != nil {
+			return err
+		}
+
+		report := compareIndexes(name, collectionIndexes[name], existing)
+		models := append(append([]mongo.IndexModel{}, report.Missing...), report.Changed...)
+		dups := 0
+		for _, model := range models {
+			keys, err := duplicateKeys(db, name, model)
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				fmt.Fprintf(out, "index %s.%s: duplicate %s\n", name, *model.Options.Name, key)
+			}
+			dups += len(keys)
+		}
+		if dups > 0 {
+			blocked = append(blocked, name)
+		}
+
+		for _, model := range report.Missing {
+			fmt.Fprintf(out, "index %s.%s: %screate\n", name, *model.Options.Name, would)
+		}
+		for _, model := range report.Changed {
+			fmt.Fprintf(out, "index %s.%s: %srecreate with the declared options\n", name, *model.Options.Name, would)
+		}
+		for _, extra := range report.Extra {
+			fmt.Fprintf(out, "index %s.%s: not declared, kept\n", name, extra)
+		}
+		if dryRun || dups > 0 || len(models) == 0 {
+			continue
+		}
+
+		byName := map[string]indexSpec{}
+		for _, s := range existing {
+			byName[s.Name] = s
+		}
+		var dropped []mongo.IndexModel
+		for _, model := range report.Changed {
+			if _, err := indexes.DropOne(db.Ctx, *model.Options.Name); err != nil {
+				return err
+			}
+			dropped = append(dropped, byName[*model.Options.Name].model())
+		}
+		if _, err := indexes.CreateMany(db.Ctx, models); err != nil {
+			// a duplicate inserted since the check: the dropped indexes
+			// are put back
+			if len(dropped) > 0 {
+				if _, rerr := indexes.CreateMany(db.Ctx, dropped); rerr != nil {
+					fmt.Fprintf(out, "restoring the indexes of %s failed: %v\n", name, rerr)
+				}
+			}
+			return fmt.Errorf("creating the indexes of %s failed: %v", name, err)
+		}
+	}
+
+	if len(blocked) > 0 && !dryRun {
+		return fmt.Errorf("duplicate keys in %s keep the unique indexes from being built: fix the documents reported", strings.Join(blocked, ", "))
+	}
+	return nil
+}
+
+// indexesCommand runs "irori indexes [-dry-run]".
+func indexesCommand(db *docdb, args []string) error {
+	fs := flag.NewFlagSet("indexes", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only report the missing, changed and extra indexes")
+	fs.Parse(args)
+
+	if !db.hasMongo() {
+		return fmt.Errorf("indexes %w", ErrUnsupported)
+	}
+	return ensureIndexes(db, *dryRun, os.Stdout)
+}
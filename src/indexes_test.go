@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestIndex(t *testing.T) {
+	model := index("pageid", "-date")
+	if name := *model.Options.Name; name != "pageid_1_date_-1" {
+		t.Error("index name unexpected:", name)
+	}
+	if keys := model.Keys.(bson.D); len(keys) != 2 || keys[1].Key != "date" || keys[1].Value != -1 {
+		t.Error("index keys unexpected:", keys)
+	}
+}
+
+func TestCompareIndexes(t *testing.T) {
+	partial := bson.M{"email": bson.M{"$gt": ""}}
+	declared := []mongo.IndexModel{unique(index("name"), nil), unique(index("email"), partial), index("-date")}
+
+	// the indexes of migration 1, not unique yet
+	existing := []indexSpec{{Name: "_id_"}, {Name: "name_1"}, {Name: "email_1"}, {Name: "nick_1"}}
+	report := compareIndexes("users", declared, existing)
+	if len(report.Missing) != 1 || *report.Missing[0].Options.Name != "date_-1" {
+		t.Error("missing indexes unexpected:", report.Missing)
+	}
+	if len(report.Changed) != 2 {
+		t.Error("indexes not unique should be changed:", report.Changed)
+	}
+	if len(report.Extra) != 1 || report.Extra[0] != "nick_1" {
+		t.Error("extra indexes unexpected:", report.Extra)
+	}
+
+	existing = []indexSpec{{Name: "_id_"}, {Name: "name_1", Unique: true},
+		{Name: "email_1", Unique: true, Partial: bson.M{"email": bson.M{"$gt": ""}}}, {Name: "date_-1"}}
+	report = compareIndexes("users", declared, existing)
+	if len(report.Missing) != 0 || len(report.Changed) != 0 || len(report.Extra) != 0 {
+		t.Error("declared indexes should match:", report)
+	}
+}
+
+func TestDuplicatesPipeline(t *testing.T) {
+	if p := duplicatesPipeline(index("author")); p != nil {
+		t.Error("indexes not unique can't hold duplicates:", p)
+	}
+
+	partial := bson.M{"email": bson.M{"$gt": ""}}
+	p := duplicatesPipeline(unique(index("email"), partial))
+	if len(p) != 4 || !reflect.DeepEqual(p[0], bson.M{"$match": partial}) {
+		t.Fatal("users without email should not be grouped:", p)
+	}
+	if group := p[1]["$group"].(bson.M); !reflect.DeepEqual(group["_id"], bson.D{{Key: "email", Value: "$email"}}) {
+		t.Error("documents should be grouped by key:", group)
+	}
+
+	// the index put back when its replacement fails
+	spec := indexSpec{Name: "email_1", Key: bson.D{{Key: "email", Value: 1}}, Unique: true, Partial: partial}
+	if got := specOf(spec.model()); !reflect.DeepEqual(got, indexSpec{Name: "email_1", Unique: true, Partial: partial}) {
+		t.Error("index spec should be recreated:", got)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/smtp"
+	"strconv"
+	"strings"
+)
+
+var ErrMailNotConfigured = errors.New("smtp_settings not configured")
+
+// member name and hcl name must be same (ignore case)
+type mailconfig struct {
+	Smtp_Settings smtpsettings
+}
+
+type smtpsettings struct {
+	Address   string
+	Port      int
+	User_Name string
+	Password  string
+	From      string
+}
+
+var MailConfig mailconfig
+
+func (s *smtpsettings) from() string {
+	if s.From != "" {
+		return s.From
+	}
+	if strings.Contains(s.User_Name, "@") {
+		return s.User_Name
+	}
+	return "irori@" + IroriConfig.HostName
+}
+
+var headerReplacer = strings.NewReplacer("\r", "", "\n", "")
+
+func buildMail(from string, to string, subject string, body string) []byte {
+	header := []string{
+		"From: " + headerReplacer.Replace(from),
+		"To: " + headerReplacer.Replace(to),
+		"Subject: " + mime.QEncoding.Encode("utf-8", headerReplacer.Replace(subject)),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"Content-Transfer-Encoding: 8bit",
+	}
+
+	return []byte(strings.Join(header, "\r\n") + "\r\n\r\n" +
+		strings.Replace(body, "\n", "\r\n", -1))
+}
+
+func sendMail(to string, subject string, body string) error {
+	s := &MailConfig.Smtp_Settings
+	if s.Address == "" {
+		return ErrMailNotConfigured
+	}
+
+	port := s.Port
+	if port == 0 {
+		port = 25
+	}
+	addr := s.Address + ":" + strconv.Itoa(port)
+
+	var auth smtp.Auth
+	if s.User_Name != "" {
+		auth = smtp.PlainAuth("", s.User_Name, s.Password, s.Address)
+	}
+
+	err := smtp.SendMail(addr, auth, s.from(), []string{to}, buildMail(s.from(), to, subject, body))
+	if err != nil {
+		log.Println("sendMail failed: ", err)
+		return fmt.Errorf("send mail to %s: %v", to, err)
+	}
+	return nil
+}
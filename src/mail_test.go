@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeSMTP points the mail settings to a local SMTP server for the test and
+// returns the messages it receives.
+func fakeSMTP(t *testing.T) <-chan string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := MailConfig
+	MailConfig.Smtp_Settings = smtpsettings{Address: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port}
+	t.Cleanup(func() {
+		l.Close()
+		MailConfig = saved
+	})
+
+	mails := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			serveSMTP(conn, mails)
+		}
+	}()
+	return mails
+}
+
+// serveSMTP accepts every mail of the connection without extensions.
+func serveSMTP(conn net.Conn, mails chan<- string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 localhost\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(line); {
+		case strings.HasPrefix(cmd, "DATA"):
+			fmt.Fprint(conn, "354 go on\r\n")
+			var msg []string
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg = append(msg, l)
+			}
+			mails <- strings.Join(msg, "")
+			fmt.Fprint(conn, "250 ok\r\n")
+		case strings.HasPrefix(cmd, "QUIT"):
+			fmt.Fprint(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 ok\r\n")
+		}
+	}
+}
+
+func TestBuildMail(t *testing.T) {
+	msg := string(buildMail("irori@example.com", "guest@example.com\r\nBcc: x@example.com",
+		"Password reset", "line1\nline2"))
+
+	if strings.Contains(msg, "\r\nBcc:") {
+		t.Error("header injection", msg)
+	}
+
+	if !strings.HasSuffix(msg, "\r\n\r\nline1\r\nline2") {
+		t.Error("unexpected body", msg)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -15,9 +16,10 @@ import (
 	"github.com/gorilla/sessions"
 	"github.com/zenazn/goji"
 	"github.com/zenazn/goji/web"
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 )
 
 var ErrUserNotFound = errors.New("user not found")
@@ -31,33 +33,27 @@ type AccessLevel string
 const (
 	PUBLIC  AccessLevel = "public"
 	GROUP   AccessLevel = "group"
+	PROJECT AccessLevel = "project" // members of the page's projects
 	PRIVATE AccessLevel = "private"
 )
 
 type page struct {
-	Id       bson.ObjectId   `bson:"_id" json:"id"`
-	Author   bson.ObjectId   `json:"author"`
-	Article  article         `json:"article"`
-	History  []history       `json:"-"`
-	Projects []bson.ObjectId `json:"projects"`
-	Access   AccessLevel     `json:"access"`
-	Groups   []bson.ObjectId `json:"groups"`
+	Id       primitive.ObjectID   `bson:"_id" json:"id"`
+	Author   primitive.ObjectID   `json:"author"`
+	Article  article              `json:"article"`
+	Projects []primitive.ObjectID `json:"projects"`
+	Access   AccessLevel          `json:"access"`
+	Groups   []primitive.ObjectID `json:"groups"`
+	Created  time.Time            `bson:"created,omitempty" json:"created"`
+	Views    int                  `bson:"views,omitempty" json:"views"`
 }
 
 type article struct {
-	Id     bson.ObjectId `bson:"_id,omitempty" json:"id"`
-	Title  string        `json:"title"`
-	Body   string        `json:"body"`
-	UserId bson.ObjectId `json:"userId"`
-	Date   time.Time     `json:"date"`
-}
-
-type history struct {
-	Id     bson.ObjectId `bson:"_id,omitempty"`
-	Title  []byte
-	Body   []byte
-	UserId bson.ObjectId
-	Date   time.Time
+	Id     primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Title  string             `json:"title"`
+	Body   string             `json:"body"`
+	UserId primitive.ObjectID `json:"userId"`
+	Date   time.Time          `json:"date"`
 }
 
 type permission string
@@ -68,32 +64,71 @@ const (
 )
 
 type user struct {
-	Id          bson.ObjectId          `bson:"_id,omitempty" json:"id"`
-	Name        string                 `json:"name"`
-	EMail       string                 `json:"email"`
-	Password    []byte                 `json:"-"`
-	Permissions map[permission]bool    `json:"permissions"`
-	Projects    map[bson.ObjectId]bool `json:"projects"`
-	Disabled    bool                   `json:"disabled"`
+	Id          primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	Name        string              `json:"name"`
+	EMail       string              `json:"email"`
+	Password    []byte              `json:"-"`
+	Permissions map[permission]bool `json:"permissions"`
+	Roles       []roleBinding       `bson:"roles,omitempty" json:"roles"`
+	Disabled    bool                `json:"disabled"`
+
+	PendingEmail string `bson:"pendingemail,omitempty" json:"pendingEmail,omitempty"`
+	Timezone     string `bson:"timezone,omitempty" json:"timezone"`
+	Language     string `bson:"language,omitempty" json:"language"`
+	Bio          string `bson:"bio,omitempty" json:"bio"`
+
+	TOTPEnabled   bool     `bson:"totpenabled,omitempty" json:"totpEnabled"`
+	TOTPSecret    string   `bson:"totpsecret,omitempty" json:"-"`
+	TOTPLastStep  int64    `bson:"totplaststep,omitempty" json:"-"`
+	RecoveryCodes []string `bson:"recoverycodes,omitempty" json:"-"`
+	// wrong authentication codes in a row, the last one at TOTPFailedAt
+	TOTPFailures int       `bson:"totpfailures,omitempty" json:"-"`
+	TOTPFailedAt time.Time `bson:"totpfailedat,omitempty" json:"-"`
+
+	perms  *userPermissions
+	locale string
 }
 
 type project struct {
-	Id       bson.ObjectId `bson:"_id,omitempty" json:"id,omitempty"`
-	Name     string        `json:"name"`
-	SlackURL string        `bson:"slackurl,omitempty" json:"slackurl,omitempty"`
-}
+	Id       primitive.ObjectID   `bson:"_id,omitempty" json:"id,omitempty"`
+	Name     string               `json:"name"`
+	SlackURL string               `bson:"slackurl,omitempty" json:"slackurl,omitempty"`
+	Members  []primitive.ObjectID `bson:"members,omitempty" json:"members"`
+	Owners   []primitive.ObjectID `bson:"owners,omitempty" json:"owners"`
 
-func (u *user) HasPermission(perm permission) bool {
-	b, ok := u.Permissions[perm]
-	return ok && b
+	Archived   bool      `bson:"archived,omitempty" json:"archived"`
+	ArchivedAt time.Time `bson:"archivedat,omitempty" json:"archivedAt,omitempty"`
 }
 
 func (u *user) Is_admin() *pongo2.Value {
+	return pongo2.AsValue(u.isManager())
+}
+
+// Is_siteadmin is true for users with the ADMIN permission itself.
+func (u *user) Is_siteadmin() *pongo2.Value {
 	return pongo2.AsValue(u.HasPermission(ADMIN))
 }
 
+// docdb holds the stores of the documents. Db is the underlying MongoDB
+// database, nil on the embedded storage, for the migrations, the indexes and
+// the backups, to run with Ctx.
 type docdb struct {
-	Db *mgo.Database
+	Db  *mongo.Database
+	Ctx context.Context
+
+	Pages       PageStore
+	Users       UserStore
+	Groups      GroupStore
+	Projects    ProjectStore
+	Audit       AuditStore
+	Revisions   RevisionStore
+	Attachments AttachmentStore
+
+	Roles              RoleStore
+	Tokens             TokenStore
+	PasswordResets     PasswordResetStore
+	EmailVerifications EmailVerificationStore
+	Settings           SettingsStore
 }
 
 func encodeFromText(text string) ([]byte, error) {
@@ -105,57 +140,52 @@ func decodeFromBlob(data []byte) (string, error) {
 	return string(data), error
 }
 
-func (a *article) createHistoryData() (*history, error) {
-	title, err := encodeFromText(a.Title)
-	if err != nil {
-		return nil, err
-	}
+// save replaces old by p, keeping the article of old as a revision. It fails
+// with ErrConflict when the page was saved by someone else since old was read.
+func (p *page) save(c web.C, old *page) error {
+	user := getSessionUser(c)
+	docdb := getDocDb(c)
+
+	p.Article.Id = primitive.NewObjectID()
+	p.Article.UserId = user.Id
+	p.Article.Date = time.Now()
 
-	body, err := encodeFromText(a.Body)
+	revs, err := docdb.Revisions.List(old.Id)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	history := history{}
-	history.Id = a.Id
-	history.Title = title
-	history.Body = body
-	history.UserId = a.UserId
-	history.Date = a.Date
-
-	return &history, nil
-}
-
-func (p *page) save(c web.C, r *http.Request) error {
-	user := getSessionUser(c)
-
-	p.Article.Id = bson.NewObjectId()
-	history, err := p.Article.createHistoryData()
+	rev, err := old.Article.createRevision(old.Id, &p.Article, needsSnapshot(revs))
 	if err != nil {
 		return err
 	}
+	// the revision goes in first so that the history never misses a
+	// version; it is a delta against p, so it goes away again when old is
+	// no longer the stored page
+	if err := docdb.Revisions.Insert(rev); err != nil {
+		return err
+	}
 
-	p.Article.UserId = user.Id
-	p.Article.Date = time.Now()
-
-	docdb := getDocDb(c)
+	if err := docdb.Pages.Swap(p, old.Article.Id); err != nil {
+		if rerr := docdb.Revisions.Remove(old.Id, []primitive.ObjectID{rev.Id}); rerr != nil {
+			log.Println("page.save: remove revision failed: ", rerr)
+		}
+		return err
+	}
 
-	return docdb.Db.C("pages").UpdateId(p.Id,
-		bson.M{"$set": bson.M{"article": p.Article, "projects": p.Projects, "access": p.Access, "groups": p.Groups},
-			"$push": bson.M{"history": history}})
+	if err := pruneRevisions(docdb, p); err != nil {
+		log.Println("page.save: prune revisions failed: ", err)
+	}
+	return nil
 }
 
 func getPageFromDb(c web.C, pageId string) (*page, error) {
 	docdb := getDocDb(c)
 
-	if !bson.IsObjectIdHex(pageId) {
-		return nil, mgo.ErrNotFound
+	if !isObjectIdHex(pageId) {
+		return nil, ErrNotFound
 	}
 
-	id := bson.ObjectIdHex(pageId)
-
-	p := page{}
-	err := docdb.Db.C("pages").FindId(id).One(&p)
+	p, err := docdb.Pages.Get(objectIdHex(pageId))
 	if err != nil {
 		fmt.Printf("getPageFromDb failed : %s\n", pageId)
 		return nil, err
@@ -163,13 +193,11 @@ func getPageFromDb(c web.C, pageId string) (*page, error) {
 
 	fmt.Printf("getPageFromDb success : %s\n", pageId)
 
-	return &p, nil
+	return p, nil
 }
 
-func getUserById(db *mgo.Database, id bson.ObjectId) (*user, error) {
-	user := user{}
-	err := db.C("users").FindId(id).One(&user)
-	return &user, err
+func getUserById(db *docdb, id primitive.ObjectID) (*user, error) {
+	return db.Users.Get(id)
 }
 
 func executeWriterFromFile(w http.ResponseWriter, path string, context *pongo2.Context) error {
@@ -196,9 +224,7 @@ func createNewPageGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	user := getSessionUser(c)
 
 	docdb := getDocDb(c)
-	projects := []project{}
-
-	err := docdb.Db.C("projects").Find(bson.M{}).All(&projects)
+	projects, err := docdb.Projects.List(projectQuery{IncludeArchived: true})
 	if err != nil {
 		log.Fatal("@@@ projects")
 	}
@@ -207,7 +233,7 @@ func createNewPageGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		&pongo2.Context{
 			"loginuser": user,
 			"page":      page{},
-			"isEditor":  user.HasPermission(EDITOR),
+			"isEditor":  user.mayCreatePages(),
 			"projects":  projects,
 		})
 
@@ -229,11 +255,23 @@ func viewPageGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 
 	// get current login user info
 	user := getSessionUser(c)
+	docdb := getDocDb(c)
+
+	if ok, err := canViewPage(user, docdb, page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := docdb.Pages.IncViews(page.Id); err != nil {
+		log.Println("viewPageGetHandler: ", err)
+	}
 
 	// get last edited user info
-	docdb := getDocDb(c)
-	editeduser, err := getUserById(docdb.Db, page.Article.UserId)
-	if err == mgo.ErrNotFound {
+	editeduser, err := docdb.Users.Get(page.Article.UserId)
+	if err == ErrNotFound {
 		// TODO : when user is removed?
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -242,15 +280,11 @@ func viewPageGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// time.location
-	jst := time.FixedZone("Asia/Tokyo", 9*60*60)
-	edittime := page.Article.Date.In(jst)
-
 	// genarate html
 	pongoCtx := pongo2.Context{
 		"loginuser":  user,
 		"pageid":     page.Id.Hex(),
-		"edittime":   edittime.Format("2006/01/02 15:04"),
+		"edittime":   user.formatTime(page.Article.Date),
 		"editeduser": editeduser}
 
 	err = executeWriterFromFile(w, "view/view.html", &pongoCtx)
@@ -266,16 +300,27 @@ func editPageGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		// FIXME : redirect to top page or "NotFound" page
 		http.Error(w, err.Error(), http.StatusNotFound)
+		return
 	}
 
 	user := getSessionUser(c)
 
 	docdb := getDocDb(c)
-	projects := []project{}
+	if ok, err := canViewPage(user, docdb, page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.NotFound(w, r)
+		return
+	}
 
-	err = docdb.Db.C("projects").Find(bson.M{}).All(&projects)
+	// archived projects can't be picked for pages
+	q := projectListQuery(user)
+	q.IncludeArchived = false
+	projects, err := docdb.Projects.List(q)
 	if err != nil {
-		log.Fatal("@@@ projects")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	log.Println("Projects:", projects)
@@ -285,7 +330,7 @@ func editPageGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		&pongo2.Context{
 			"loginuser": user,
 			"page":      page,
-			"isEditor":  user.HasPermission(EDITOR),
+			"isEditor":  user.canEditPage(page),
 			"projects":  projects,
 		})
 
@@ -316,14 +361,16 @@ func getDocDb(c web.C) *docdb { return c.Env["docdb"].(*docdb) }
 func HashPassword(password string) []byte {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		log.Fatalln("Hash password failed: %v", err)
+		log.Fatalln("Hash password failed:", err)
 		panic(err)
 	}
 	return hash
 }
 
 func loginPageGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
-	err := executeWriterFromFile(w, "view/login.html", &pongo2.Context{})
+	err := executeWriterFromFile(w, "view/login.html", &pongo2.Context{
+		"locale": negotiateLocale(nil, r),
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -339,17 +386,27 @@ func loginPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 
 	delete(session.Values, "userid")
+	delete(session.Values, "pending2fa")
 	sessions.Save(r, w)
 
 	docdb := getDocDb(c)
 	name := r.FormValue("username")
 	password := r.FormValue("password")
 
-	user := user{}
-	err := docdb.Db.C("users").Find(bson.M{"name": name}).One(&user)
-	if err == nil {
+	user, err := docdb.Users.FindByName(name)
+	if err == nil && !user.Disabled {
 		err = bcrypt.CompareHashAndPassword(user.Password, []byte(password))
-		if err == nil {
+		if err == nil && user.TOTPEnabled && user.totpLocked(time.Now()) {
+			render2FALocked(w, r, user)
+			return
+		} else if err == nil && user.TOTPEnabled {
+			// password is correct, wait for the authentication code
+			session.Values["pending2fa"] = user.Id.Hex()
+			session.Values["pending2faAt"] = time.Now().Unix()
+			sessions.Save(r, w)
+			http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+			return
+		} else if err == nil {
 			session.Values["userid"] = user.Id.Hex()
 			sessions.Save(r, w)
 			http.Redirect(w, r, "/home", http.StatusSeeOther)
@@ -358,8 +415,10 @@ func loginPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.WriteHeader(http.StatusUnauthorized)
+	locale := negotiateLocale(nil, r)
 	executeWriterFromFile(w, "view/login.html", &pongo2.Context{
-		"error": "Incorrect username or password.",
+		"locale": locale,
+		"error":  T(locale, "login.error.incorrect"),
 	})
 }
 
@@ -387,14 +446,11 @@ func staticPageHandler(path string) func(c web.C, w http.ResponseWriter, r *http
 	}
 }
 
-func includeDb(db *mgo.Database) func(c *web.C, h http.Handler) http.Handler {
-	docdb := &docdb{
-		Db: db,
-	}
-
+func includeDb(docdb *docdb) func(c *web.C, h http.Handler) http.Handler {
 	return func(c *web.C, h http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
-			c.Env["docdb"] = docdb
+			// the queries stop when the client goes away
+			c.Env["docdb"] = docdb.withContext(r.Context())
 			h.ServeHTTP(w, r)
 		}
 		return http.HandlerFunc(fn)
@@ -409,13 +465,14 @@ func getUserIfLoggedin(c web.C, r *http.Request) (*user, error) {
 	}
 
 	docdb := getDocDb(c)
-	user, err := getUserById(docdb.Db, bson.ObjectIdHex(id.(string)))
-	if err == mgo.ErrNotFound {
+	user, err := docdb.Users.Get(objectIdHex(id.(string)))
+	if err == ErrNotFound || (err == nil && user.Disabled) {
 		return nil, ErrUserNotFound
 	} else if err != nil {
 		return nil, err
 	}
 
+	err = resolvePermissions(docdb, user)
 	return user, err
 }
 
@@ -434,9 +491,15 @@ func needLogin(c *web.C, h http.Handler) http.Handler {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		} else {
+			user.locale = negotiateLocale(user, r)
 			c.Env["user"] = user
 		}
 
+		if !allowedWithout2FA(r.URL.Path) && need2FAEnrollment(getDocDb(*c), user) {
+			http.Redirect(w, r, "/profile/2fa", http.StatusFound)
+			return
+		}
+
 		h.ServeHTTP(w, r)
 	}
 	return http.HandlerFunc(fn)
@@ -446,7 +509,7 @@ func needAdmin(c *web.C, h http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		user := getSessionUser(*c)
 
-		if !user.HasPermission(ADMIN) {
+		if !user.isManager() {
 			http.Error(w, "You are not admin", http.StatusMethodNotAllowed)
 			return
 		}
@@ -456,40 +519,45 @@ func needAdmin(c *web.C, h http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
-func addTestData(db *mgo.Database) {
-	guestHash, _ := bcrypt.GenerateFromPassword([]byte("guest"), bcrypt.DefaultCost)
-	u := &user{
-		Name:     "guest",
-		Password: guestHash,
+// ensureUser registers u unless a user of the same name exists.
+func ensureUser(db *docdb, u *user) {
+	_, err := db.Users.FindByName(u.Name)
+	if err == ErrNotFound {
+		err = db.Users.Insert(u)
 	}
-
-	_, err := db.C("users").Upsert(bson.M{"name": u.Name},
-		bson.M{"$setOnInsert": u})
 	if err != nil {
 		log.Fatalln(err)
 	}
+}
+
+func addTestData(db *docdb) {
+	guestHash, _ := bcrypt.GenerateFromPassword([]byte("guest"), bcrypt.DefaultCost)
+	ensureUser(db, &user{
+		Name:     "guest",
+		Password: guestHash,
+	})
 
 	adminHash, _ := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.DefaultCost)
-	admin := &user{
+	ensureUser(db, &user{
 		Name:        "admin",
 		Password:    adminHash,
 		Permissions: map[permission]bool{ADMIN: true, EDITOR: true},
-	}
-
-	_, err = db.C("users").Upsert(bson.M{"name": admin.Name},
-		bson.M{"$setOnInsert": admin})
-	if err != nil {
-		log.Fatalln(err)
-	}
+	})
 }
 
-func setRoute(db *mgo.Database) {
+func setRoute(db *docdb) {
 	addTestData(db)
 
 	m := web.New()
 	m.Get("/login", loginPageGetHandler)
 	m.Post("/login", loginPostHandler)
+	m.Get("/login/2fa", login2FAPageGetHandler)
+	m.Post("/login/2fa", login2FAPostHandler)
 	m.Post("/logout", logoutPostHandler)
+	m.Get("/password/forgot", forgotPasswordPageGetHandler)
+	m.Post("/password/forgot", forgotPasswordPostHandler)
+	m.Get("/password/reset", resetPasswordPageGetHandler)
+	m.Post("/password/reset", resetPasswordPostHandler)
 	m.Get("/", rootHandler)
 
 	loginUserActionMux := web.New()
@@ -505,35 +573,80 @@ func setRoute(db *mgo.Database) {
 	adminMux.Get("/admin/groups", staticPageHandler("view/groups.html"))
 	adminMux.Get("/admin/groups/:groupId", groupEditHandler)
 	adminMux.Get("/admin/users", staticPageHandler("view/users.html"))
+	adminMux.Get("/admin/users/import", staticPageHandler("view/import-users.html"))
+	adminMux.Get("/admin/users/:userId", userEditHandler)
+	adminMux.Get("/admin/roles", staticPageHandler("view/roles.html"))
+	adminMux.Get("/admin/settings", staticPageHandler("view/settings.html"))
+	adminMux.Get("/admin/audit", staticPageHandler("view/audit.html"))
 	adminMux.Get("/admin", staticPageHandler("view/admin.html"))
 
 	apiMux := web.New()
-	apiMux.Use(needLogin)
+	apiMux.Use(needApiLogin)
 	apiMux.Get("/api/projects", apiProjectListGetHandler)
+	apiMux.Get("/api/projects/:projectId/dashboard", apiProjectDashboardGetHandler)
 	apiMux.Get("/api/projects/:projectId", apiProjectGetHandler)
-	apiMux.Put("/api/projects/:projectId", applyFilter(apiProjectPutHandler, apiNeedPermission(ADMIN)))
-	apiMux.Post("/api/projects", applyFilter(apiProjectsPostHandler, apiNeedPermission(ADMIN)))
+	apiMux.Put("/api/projects/:projectId", applyFilter(apiProjectPutHandler, apiNeedProjectOwner))
+	apiMux.Delete("/api/projects/:projectId", applyFilter(apiProjectDeleteHandler, apiNeedPermission(ADMIN), apiNeedProjectOwner))
+	apiMux.Post("/api/projects/:projectId/archive", applyFilter(apiProjectArchivePostHandler, apiNeedPermission(ADMIN), apiNeedProjectOwner))
+	apiMux.Delete("/api/projects/:projectId/archive", applyFilter(apiProjectArchiveDeleteHandler, apiNeedPermission(ADMIN), apiNeedProjectOwner))
+	apiMux.Post("/api/projects/:projectId/members/:userId", applyFilter(apiProjectMemberPostHandler, apiNeedProjectOwner))
+	apiMux.Delete("/api/projects/:projectId/members/:userId", applyFilter(apiProjectMemberDeleteHandler, apiNeedProjectOwner))
+	apiMux.Post("/api/projects", applyFilter(apiProjectsPostHandler, apiNeedPermission(PROJECT_MANAGE)))
 
 	apiMux.Get("/api/pages/own", apiOwnPageGetHandler)
+	apiMux.Get("/api/pages/:pageId/revisions/:revisionId", apiPageRevisionGetHandler)
+	apiMux.Get("/api/pages/:pageId/revisions", apiPageRevisionListGetHandler)
+	apiMux.Get("/api/pages/:pageId/attachments/:attachmentId", apiPageAttachmentGetHandler)
 	apiMux.Get("/api/pages/:pageId", apiPageGetHandler)
 	apiMux.Get("/api/pages", apiPageListGetHandler)
-	apiMux.Post("/api/pages/:pageId", applyFilter(apiPageUpdateHandler, apiNeedPermission(EDITOR)))
-	apiMux.Post("/api/pages", applyFilter(apiPageCreateHandler, apiNeedPermission(EDITOR)))
+	apiMux.Delete("/api/pages/:pageId", apiPageDeleteHandler)
+	apiMux.Post("/api/pages/:pageId", apiPageUpdateHandler)
+	apiMux.Post("/api/pages", apiPageCreateHandler)
+	apiMux.Get("/api/export/markdown", apiMarkdownExportGetHandler)
+	apiMux.Post("/api/import/pages", apiPageImportPostHandler)
 
-	apiMux.Post("/api/groups", applyFilter(apiGroupCreateHandler, apiNeedPermission(ADMIN)))
+	apiMux.Post("/api/groups", applyFilter(apiGroupCreateHandler, apiNeedPermission(GROUP_MANAGE)))
 	apiMux.Get("/api/groups/:groupId", apiGroupGetHandler)
-	apiMux.Put("/api/groups/:groupId", applyFilter(apiGroupPutHandler, apiNeedPermission(ADMIN)))
+	apiMux.Put("/api/groups/:groupId", applyFilter(apiGroupPutHandler, apiNeedGroupManager))
+	apiMux.Delete("/api/groups/:groupId", applyFilter(apiGroupDeleteHandler, apiNeedPermission(GROUP_MANAGE)))
+	apiMux.Post("/api/groups/:groupId/members/:userId", applyFilter(apiGroupMemberPostHandler, apiNeedGroupManager))
+	apiMux.Delete("/api/groups/:groupId/members/:userId", applyFilter(apiGroupMemberDeleteHandler, apiNeedGroupManager))
+	apiMux.Put("/api/groups/:groupId/roles", applyFilter(apiGroupRolesPutHandler, apiNeedPermission(ADMIN)))
 	apiMux.Get("/api/groups", apiGroupListGetHandler)
 
 	apiMux.Get("/api/users", apiUserListGetHandler)
-	apiMux.Post("/api/users", applyFilter(apiUserPostHandler, apiNeedPermission(ADMIN)))
+	apiMux.Post("/api/users", applyFilter(apiUserPostHandler, apiNeedPermission(USER_MANAGE)))
+	apiMux.Get("/api/users/export", applyFilter(apiUserExportGetHandler, apiNeedPermission(USER_MANAGE)))
+	apiMux.Post("/api/users/import", applyFilter(apiUserImportPostHandler, apiNeedPermission(USER_MANAGE)))
 	apiMux.Get("/api/users/own", apiOwnUserGetHandler)
+	apiMux.Put("/api/users/own", applyFilter(apiOwnUserPutHandler, apiNeedSession))
+	apiMux.Get("/api/users/own/totp", apiOwnTOTPGetHandler)
+	apiMux.Post("/api/users/own/totp", applyFilter(apiOwnTOTPPostHandler, apiNeedSession))
+	apiMux.Put("/api/users/own/totp", applyFilter(apiOwnTOTPPutHandler, apiNeedSession))
+	apiMux.Delete("/api/users/own/totp", applyFilter(apiOwnTOTPDeleteHandler, apiNeedSession))
 	apiMux.Get("/api/users/icon", apiOwnIconHandler)
 	apiMux.Get("/api/users/:userId/icon", apiUserIconHandler)
-	apiMux.Delete("/api/users/:userId", applyFilter(apiUserDeleteHandler, apiNeedPermission(ADMIN)))
+	apiMux.Delete("/api/users/:userId", applyFilter(apiUserDeleteHandler, apiNeedPermission(USER_MANAGE)))
+	apiMux.Put("/api/users/:userId", applyFilter(apiUserPutHandler, apiNeedPermission(USER_MANAGE)))
+	apiMux.Put("/api/users/:userId/roles", applyFilter(apiUserRolesPutHandler, apiNeedPermission(ADMIN)))
+	apiMux.Post("/api/users/:userId/password_reset", applyFilter(apiUserPasswordResetPostHandler, apiNeedPermission(USER_MANAGE)))
 	apiMux.Get("/api/users/:userId", apiUserGetHandler)
 
-	apiMux.Put("/api/password", apiPasswordHandler)
+	apiMux.Put("/api/password", applyFilter(apiPasswordHandler, apiNeedSession))
+
+	apiMux.Get("/api/roles", apiRoleListGetHandler)
+	apiMux.Post("/api/roles", applyFilter(apiRolePostHandler, apiNeedPermission(ADMIN)))
+	apiMux.Put("/api/roles/:roleId", applyFilter(apiRolePutHandler, apiNeedPermission(ADMIN)))
+	apiMux.Delete("/api/roles/:roleId", applyFilter(apiRoleDeleteHandler, apiNeedPermission(ADMIN)))
+
+	apiMux.Get("/api/admin/audit/export", applyFilter(apiAuditExportGetHandler, apiNeedPermission(ADMIN)))
+	apiMux.Get("/api/admin/audit", applyFilter(apiAuditGetHandler, apiNeedPermission(ADMIN)))
+	apiMux.Get("/api/admin/settings", applyFilter(apiSettingsGetHandler, apiNeedPermission(ADMIN)))
+	apiMux.Put("/api/admin/settings", applyFilter(apiSettingsPutHandler, apiNeedPermission(ADMIN)))
+
+	apiMux.Get("/api/tokens", applyFilter(apiTokenListGetHandler, apiNeedSession))
+	apiMux.Post("/api/tokens", applyFilter(apiTokenPostHandler, apiNeedSession))
+	apiMux.Delete("/api/tokens/:tokenId", applyFilter(apiTokenDeleteHandler, apiNeedSession))
 
 	// Mux : create new page or show a page created already
 	pageMux := web.New()
@@ -546,20 +659,30 @@ func setRoute(db *mgo.Database) {
 	homeMux.Use(needLogin)
 	homeMux.Get("/home", staticPageHandler("view/home-pages.html"))
 
+	groupMux := web.New()
+	groupMux.Use(needLogin)
+	groupMux.Get("/groups/:groupId", groupEditHandler)
+
 	projectMux := web.New()
 	projectMux.Use(needLogin)
-	projectMux.Get("/project/:projectId", staticPageHandler("view/project.html"))
+	projectMux.Get("/project/:projectId/members", projectPageHandler("view/project-members.html"))
+	projectMux.Get("/project/:projectId", projectPageHandler("view/project.html"))
 
 	profileMux := web.New()
 	profileMux.Use(needLogin)
 	profileMux.Get("/profile", staticPageHandler("view/profile.html"))
 	profileMux.Get("/profile/password/edit", staticPageHandler("view/profile-password.html"))
+	profileMux.Get("/profile/email/verify", verifyEmailGetHandler)
+	profileMux.Get("/profile/2fa", staticPageHandler("view/profile-2fa.html"))
+	profileMux.Get("/profile/tokens", staticPageHandler("view/profile-tokens.html"))
+	profileMux.Get("/profile/groups", staticPageHandler("view/profile-groups.html"))
 
 	goji.Use(includeDb(db))
 	goji.Get("/assets/*", http.FileServer(http.Dir(".")))
 	goji.Handle("/docs/*", pageMux)
 	goji.Handle("/docs", pageMux)
 	goji.Handle("/home", homeMux)
+	goji.Handle("/groups/*", groupMux)
 	goji.Handle("/project/*", projectMux)
 	goji.Handle("/action/*", loginUserActionMux)
 	goji.Handle("/admin/*", adminMux)
@@ -599,6 +722,12 @@ func apiNeedPermission(p permission) handleFilter {
 			return false
 		}
 
+		// a token must carry the admin scope to use managing permissions
+		if t := getSessionToken(c); t != nil && p.administrative() && !t.HasScope(SCOPE_ADMIN) {
+			w.WriteHeader(http.StatusForbidden)
+			return false
+		}
+
 		return true
 	}
 }
@@ -606,15 +735,38 @@ func apiNeedPermission(p permission) handleFilter {
 type iroriconfig struct {
 	HostName string
 	Port     int
+	Timezone string
+	Language string
 }
 
 var IroriConfig iroriconfig
 
+// siteURL returns the absolute url of path for links sent outside of irori.
+func siteURL(path string) string {
+	portstr := ""
+	if IroriConfig.Port != 0 {
+		portstr = ":" + strconv.Itoa(IroriConfig.Port)
+	}
+
+	return fmt.Sprintf("http://%s%s%s", IroriConfig.HostName, portstr, path)
+}
+
 func Initialize() {
 
 	AddDecoder(&IroriConfig)
+	AddDecoder(&MailConfig)
+	AddDecoder(&PasswordConfig)
+	AddDecoder(&StorageConfig)
+	AddDecoder(&HistoryConfig)
 	ReadConfig()
 
+	setSiteTimezone(IroriConfig.Timezone)
+	initCatalogs()
+
+	if PasswordConfig.Password_Policy.Min_Length <= 0 {
+		PasswordConfig.Password_Policy.Min_Length = 8
+	}
+
 	hostname := os.Getenv("IRORI_HOSTNAME")
 	if hostname != "" {
 		IroriConfig.HostName = hostname
@@ -631,23 +783,80 @@ func Initialize() {
 	log.Println(IroriConfig)
 }
 
-func main() {
-	Initialize()
+// openDocDb opens the configured storage. closeDb releases it.
+func openDocDb() (db *docdb, closeDb func(), err error) {
+	switch StorageConfig.Storage.Backend {
+	case "", STORAGE_MONGODB:
+		client, mdb, err := connectMongo(StorageConfig.Storage)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newMongoDocDb(mdb, context.Background()), func() { client.Disconnect(context.Background()) }, nil
 
-	url := os.Getenv("MONGODB_URL")
-	if url == "" {
-		url = "localhost/irori"
+	case STORAGE_BOLT:
+		path := StorageConfig.Storage.Path
+		if path == "" {
+			path = DEFAULT_BOLT_PATH
+		}
+
+		bdb, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		db, err := newBoltDocDb(bdb)
+		if err != nil {
+			bdb.Close()
+			return nil, nil, err
+		}
+		return db, func() { bdb.Close() }, nil
 	}
 
-	session, err := mgo.Dial(url)
+	return nil, nil, fmt.Errorf("unknown storage backend: %s", StorageConfig.Storage.Backend)
+}
+
+// commands are run by "irori <command> [args]" instead of serving.
+var commands = map[string]func(db *docdb, args []string) error{
+	"migrate": migrateCommand,
+	"indexes": indexesCommand,
+	"backup":  backupCommand,
+	"restore": restoreCommand,
+	"export":  exportCommand,
+	"import":  importCommand,
+}
+
+func main() {
+	Initialize()
+
+	db, closeDb, err := openDocDb()
 	if err != nil {
 		log.Fatalln(err)
 	}
-	defer session.Close()
+	defer closeDb()
+
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(db, os.Args[2:]); err != nil {
+				closeDb()
+				log.Fatalln(err)
+			}
+			return
+		}
+	}
 
-	session.SetMode(mgo.Monotonic, true)
+	if !StorageConfig.Storage.Manual_Migrations {
+		if err := runMigrations(db, false, os.Stdout); err != nil {
+			closeDb()
+			log.Fatalln(err)
+		}
+	}
 
-	db := session.DB("")
+	// the unique indexes keep the names and emails unique, irori can't
+	// serve without them
+	if err := ensureIndexes(db, false, os.Stdout); err != nil {
+		closeDb()
+		log.Fatalln(err)
+	}
 
 	pageHooks = append(pageHooks, pageHookSlack{db: db})
 
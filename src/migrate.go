@@ -0,0 +1,254 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// migration changes the documents of the database from one shape to the
+// next. Versions only grow: a released migration is never edited, a new one
+// is appended instead.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(m *migrator) error
+}
+
+// appliedMigration records a migration run on the database.
+type appliedMigration struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"appliedat"`
+}
+
+var migrations = []migration{
+	{1, "create the indexes of the queries", func(m *migrator) error {
+		if err := m.createIndexes("users", index("name"), index("email")); err != nil {
+			return err
+		}
+		return m.createIndexes("pages", index("author"), index("access"), index("groups"), index("-article.date"))
+	}},
+	{2, "set disabled on the users registered before it existed", func(m *migrator) error {
+		return m.updateAll("users", bson.M{"disabled": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"disabled": false}})
+	}},
+	{3, "replace the missing groups and projects of pages by empty lists", func(m *migrator) error {
+		for _, field := range []string{"groups", "projects"} {
+			err := m.updateAll("pages", bson.M{field: nil}, bson.M{"$set": bson.M{field: bson.A{}}})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{4, "drop the unused slacksettings collection", func(m *migrator) error {
+		return m.dropCollection("slacksettings")
+	}},
+	{5, "move the page history to the revisions collection", func(m *migrator) error {
+		if err := m.createIndexes("revisions", index("pageid", "-date")); err != nil {
+			return err
+		}
+		return m.moveHistory()
+	}},
+}
+
+// migrator runs the steps of a migration, or only reports what they would
+// change when dryRun is set.
+type migrator struct {
+	db     *docdb
+	dryRun bool
+	out    io.Writer
+}
+
+func (m *migrator) report(format string, args ...interface{}) {
+	if m.dryRun {
+		format = "  would " + format
+	} else {
+		format = "  " + format
+	}
+	fmt.Fprintf(m.out, format+"\n", args...)
+}
+
+func (m *migrator) updateAll(collection string, filter bson.M, update bson.M) error {
+	c := m.db.C(collection)
+	if m.dryRun {
+		n, err := c.count(filter)
+		if err == nil {
+			m.report("update %d documents of %s", n, collection)
+		}
+		return err
+	}
+
+	n, err := c.updateAll(filter, update)
+	if err == nil {
+		m.report("updated %d documents of %s", n, collection)
+	}
+	return err
+}
+
+func (m *migrator) createIndexes(collection string, models ...mongo.IndexModel) error {
+	existing, err := indexNames(m.db, collection)
+	if err != nil {
+		return err
+	}
+
+	var missing []mongo.IndexModel
+	for _, model := range models {
+		if name := *model.Options.Name; !existing[name] {
+			m.report("create index %s on %s", name, collection)
+			missing = append(missing, model)
+		}
+	}
+	if m.dryRun || len(missing) == 0 {
+		return nil
+	}
+
+	_, err = m.db.Db.Collection(collection).Indexes().CreateMany(m.db.Ctx, missing)
+	return err
+}
+
+func (m *migrator) dropCollection(name string) error {
+	names, err := m.db.Db.ListCollectionNames(m.db.Ctx, bson.M{"name": name})
+	if err != nil || len(names) == 0 {
+		return err
+	}
+
+	m.report("drop %s", name)
+	if m.dryRun {
+		return nil
+	}
+	return m.db.Db.Collection(name).Drop(m.db.Ctx)
+}
+
+// moveHistory moves the history kept in the pages to the revisions, one page
+// at a time so that an interrupted run can be resumed.
+func (m *migrator) moveHistory() error {
+	pages := m.db.C("pages")
+	legacy := bson.M{"history": bson.M{"$exists": true}}
+	if m.dryRun {
+		n, err := pages.count(legacy)
+		if err == nil {
+			m.report("move the history of %d pages", n)
+		}
+		return err
+	}
+
+	cur, err := pages.c.Find(m.db.Ctx, legacy, options.Find().SetProjection(bson.M{"history": 1, "article._id": 1}))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(m.db.Ctx)
+
+	n := 0
+	for cur.Next(m.db.Ctx) {
+		var d struct {
+			Id      primitive.ObjectID `bson:"_id"`
+			Article article            `bson:"article"`
+			History []revision         `bson:"history"`
+		}
+		if err := cur.Decode(&d); err != nil {
+			return err
+		}
+
+		// revisions of a page moved before an interruption are replaced
+		if err := m.db.Revisions.RemovePage(d.Id); err != nil {
+			return err
+		}
+		for _, rev := range legacyRevisions(d.Id, d.Article.Id, d.History) {
+			if err := m.db.Revisions.Insert(rev); err != nil {
+				return err
+			}
+		}
+		if err := pages.updateId(d.Id, bson.M{"$unset": bson.M{"history": ""}}); err != nil {
+			return err
+		}
+		n++
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	m.report("moved the history of %d pages", n)
+	return nil
+}
+
+// legacyRevisions returns the revisions of the history of the page pageId.
+// The history kept the current article too, which stays in the page.
+func legacyRevisions(pageId primitive.ObjectID, articleId primitive.ObjectID, history []revision) []*revision {
+	var revs []*revision
+	for i := range history {
+		if history[i].Id == articleId {
+			continue
+		}
+		rev := history[i]
+		rev.Id = primitive.NewObjectID()
+		rev.PageId = pageId
+		revs = append(revs, &rev)
+	}
+	return revs
+}
+
+// pendingMigrations returns the migrations of all not yet applied, in order.
+func pendingMigrations(all []migration, applied map[int]bool) []migration {
+	var pending []migration
+	for _, mi := range all {
+		if !applied[mi.Version] {
+			pending = append(pending, mi)
+		}
+	}
+	return pending
+}
+
+// runMigrations applies the pending migrations to db in order, stopping at
+// the first failure, and reports them to out. With dryRun nothing is changed.
+func runMigrations(db *docdb, dryRun bool, out io.Writer) error {
+	if !db.hasMongo() {
+		return nil
+	}
+
+	var records []appliedMigration
+	if err := db.C("migrations").findAll(bson.M{}, &records); err != nil {
+		return err
+	}
+	applied := map[int]bool{}
+	for _, a := range records {
+		applied[a.Version] = true
+	}
+
+	m := &migrator{db: db, dryRun: dryRun, out: out}
+	for _, mi := range pendingMigrations(migrations, applied) {
+		fmt.Fprintf(out, "migration %d: %s\n", mi.Version, mi.Name)
+		if err := mi.Up(m); err != nil {
+			return fmt.Errorf("migration %d failed: %v", mi.Version, err)
+		}
+		if dryRun {
+			continue
+		}
+
+		err := db.C("migrations").insert(appliedMigration{Version: mi.Version, Name: mi.Name, AppliedAt: time.Now()})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateCommand runs "irori migrate [-dry-run]".
+func migrateCommand(db *docdb, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only report what the pending migrations would change")
+	fs.Parse(args)
+
+	if !db.hasMongo() {
+		return fmt.Errorf("migrate %w", ErrUnsupported)
+	}
+	return runMigrations(db, *dryRun, os.Stdout)
+}
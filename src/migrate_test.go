@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMigrationVersions(t *testing.T) {
+	for i, mi := range migrations {
+		if mi.Version != i+1 {
+			t.Errorf("migration %q has version %d, want %d", mi.Name, mi.Version, i+1)
+		}
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	pending := pendingMigrations(migrations, map[int]bool{1: true, 3: true})
+	if len(pending) != len(migrations)-2 || pending[0].Version != 2 || pending[1].Version != 4 {
+		t.Error("pending unexpected:", pending)
+	}
+	if pending := pendingMigrations(migrations, map[int]bool{}); len(pending) != len(migrations) {
+		t.Error("every migration should be pending:", len(pending))
+	}
+}
+
+func TestIndexName(t *testing.T) {
+	if name := *index("-article.date").Options.Name; name != "article.date_-1" {
+		t.Error("name unexpected:", name)
+	}
+	if name := *index("project", "name").Options.Name; name != "project_1_name_1" {
+		t.Error("name unexpected:", name)
+	}
+}
+
+func TestLegacyRevisions(t *testing.T) {
+	pageId, current := primitive.NewObjectID(), primitive.NewObjectID()
+	history := []revision{
+		{Id: primitive.NewObjectID(), Body: []byte("first")},
+		{Id: primitive.NewObjectID(), Body: []byte("second")},
+		{Id: current, Body: []byte("current")},
+	}
+
+	revs := legacyRevisions(pageId, current, history)
+	if len(revs) != 2 || string(revs[0].Body) != "first" || string(revs[1].Body) != "second" {
+		t.Fatal("the current article should stay out of the revisions:", revs)
+	}
+	for i, rev := range revs {
+		if rev.PageId != pageId || rev.Id == history[i].Id {
+			t.Error("revision unexpected:", rev)
+		}
+	}
+}
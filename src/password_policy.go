@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// bcrypt ignores (or refuses) bytes after the 72nd
+const PASSWORD_MAX_LENGTH = 72
+
+// member name and hcl name must be same (ignore case)
+type passwordconfig struct {
+	Password_Policy passwordpolicy
+}
+
+type passwordpolicy struct {
+	Min_Length     int
+	Require_Upper  bool
+	Require_Lower  bool
+	Require_Digit  bool
+	Require_Symbol bool
+	Denylist       []string
+}
+
+var PasswordConfig = passwordconfig{
+	Password_Policy: passwordpolicy{Min_Length: 8},
+}
+
+var commonPasswords = []string{
+	"password", "password1", "password123", "passw0rd", "12345678", "123456789",
+	"1234567890", "qwerty123", "qwertyuiop", "1q2w3e4r", "1qaz2wsx", "abc12345",
+	"iloveyou", "sunshine", "princess", "football", "baseball", "welcome1",
+	"admin123", "letmein1", "trustno1", "11111111", "00000000", "87654321",
+	"asdfghjkl", "zaq12wsx", "superman", "starwars", "dragon12", "monkey12",
+	"changeme", "irori123",
+}
+
+type validationError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type validationErrors struct {
+	Errors []validationError `json:"errors"`
+}
+
+func (p *passwordpolicy) denied(password string) bool {
+	lower := strings.ToLower(password)
+	for _, list := range [][]string{commonPasswords, p.Denylist} {
+		for _, d := range list {
+			if lower == strings.ToLower(d) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validate returns every rule password breaks. field is the name reported
+// in the errors.
+func (p *passwordpolicy) validate(field string, password string, username string) []validationError {
+	var errs []validationError
+	add := func(code string, msg string) {
+		errs = append(errs, validationError{Field: field, Code: code, Message: msg})
+	}
+
+	if len([]rune(password)) < p.Min_Length {
+		add("too_short", fmt.Sprintf("password must be at least %d characters", p.Min_Length))
+	}
+	if len(password) > PASSWORD_MAX_LENGTH {
+		add("too_long", fmt.Sprintf("password must be at most %d bytes", PASSWORD_MAX_LENGTH))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			symbol = true
+		}
+	}
+
+	if p.Require_Upper && !upper {
+		add("require_upper", "password must contain an uppercase letter")
+	}
+	if p.Require_Lower && !lower {
+		add("require_lower", "password must contain a lowercase letter")
+	}
+	if p.Require_Digit && !digit {
+		add("require_digit", "password must contain a digit")
+	}
+	if p.Require_Symbol && !symbol {
+		add("require_symbol", "password must contain a symbol")
+	}
+
+	if p.denied(password) {
+		add("common", "password is too common")
+	}
+	if username != "" && strings.EqualFold(password, username) {
+		add("same_as_username", "password must not be the same as the user name")
+	}
+
+	return errs
+}
+
+func validatePassword(field string, password string, username string) []validationError {
+	return PasswordConfig.Password_Policy.validate(field, password, username)
+}
+
+func writeValidationErrors(w http.ResponseWriter, errs []validationError) {
+	writeValidationErrorsStatus(w, http.StatusBadRequest, errs)
+}
+
+// writeValidationErrorsStatus is writeValidationErrors with another status,
+// such as 409 for a name already used.
+func writeValidationErrorsStatus(w http.ResponseWriter, status int, errs []validationError) {
+	js, _ := json.Marshal(validationErrors{Errors: errs})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
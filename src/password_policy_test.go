@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func hasCode(errs []validationError, code string) bool {
+	for _, e := range errs {
+		if e.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	p := passwordpolicy{Min_Length: 8, Require_Digit: true, Denylist: []string{"irori-wiki"}}
+
+	if errs := p.validate("password", "correct horse 1", "guest"); len(errs) != 0 {
+		t.Error("unexpected errors", errs)
+	}
+
+	tests := []struct {
+		password string
+		code     string
+	}{
+		{"", "too_short"},
+		{"short1", "too_short"},
+		{strings.Repeat("a1", 40), "too_long"},
+		{"no digits here", "require_digit"},
+		{"Password1", "common"},
+		{"IRORI-WIKI", "common"},
+		{"guestuser1", "same_as_username"},
+	}
+
+	for _, tt := range tests {
+		errs := p.validate("password", tt.password, "GuestUser1")
+		if !hasCode(errs, tt.code) {
+			t.Error("expected", tt.code, "for", tt.password, errs)
+		}
+		for _, e := range errs {
+			if e.Field != "password" {
+				t.Error("unexpected field", e.Field)
+			}
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"github.com/zenazn/goji/web"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const PASSWORD_RESET_EXPIRE = 1 * time.Hour
+
+// passwordReset is a single-use reset token. As with apiToken only the hash
+// is stored.
+type passwordReset struct {
+	Id        primitive.ObjectID `bson:"_id,omitempty"`
+	UserId    primitive.ObjectID `bson:"userid"`
+	Hash      string             `bson:"hash"`
+	CreatedAt time.Time          `bson:"createdat"`
+	ExpiresAt time.Time          `bson:"expiresat"`
+}
+
+func createPasswordReset(db *docdb, u *user, expire time.Duration) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	pr := passwordReset{
+		Id:        primitive.NewObjectID(),
+		UserId:    u.Id,
+		Hash:      hashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(expire),
+	}
+
+	if err := db.PasswordResets.Insert(&pr); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// findPasswordReset returns the user of a valid reset token.
+func findPasswordReset(db *docdb, token string) (*user, error) {
+	pr, err := db.PasswordResets.FindByHash(hashToken(token))
+	if err == ErrNotFound {
+		return nil, ErrTokenInvalid
+	} else if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(pr.ExpiresAt) {
+		return nil, ErrTokenInvalid
+	}
+
+	u, err := getUserById(db, pr.UserId)
+	if err == ErrNotFound || (err == nil && u.Disabled) {
+		return nil, ErrTokenInvalid
+	}
+	return u, err
+}
+
+func sendPasswordResetMail(db *docdb, u *user, byAdmin bool) error {
+	if u.EMail == "" {
+		return fmt.Errorf("user %s has no email", u.Name)
+	}
+
+	token, err := createPasswordReset(db, u, PASSWORD_RESET_EXPIRE)
+	if err != nil {
+		return err
+	}
+
+	link := siteURL("/password/reset?token=" + url.QueryEscape(token))
+
+	reason := "Someone requested a password reset for your irori account."
+	if byAdmin {
+		reason = "An administrator requested a password reset for your irori account."
+	}
+
+	body := fmt.Sprintf("Hello %s,\n\n%s\nOpen the link below within %d minutes to choose a new password.\n\n%s\n\nIf you did not request this, you can ignore this mail.\n",
+		u.Name, reason, int(PASSWORD_RESET_EXPIRE/time.Minute), link)
+
+	return sendMail(u.EMail, "[irori] Password reset", body)
+}
+
+func forgotPasswordPageGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	err := executeWriterFromFile(w, "view/password-forgot.html", &pongo2.Context{
+		"locale": negotiateLocale(nil, r),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func forgotPasswordPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	docdb := getDocDb(c)
+	email := r.FormValue("email")
+
+	u, err := docdb.Users.FindByEmail(email)
+	if err == nil && !u.Disabled {
+		if err := sendPasswordResetMail(docdb, u, false); err != nil {
+			log.Println("forgotPasswordPostHandler: ", err)
+		}
+	} else if err != ErrNotFound && err != nil {
+		log.Println("forgotPasswordPostHandler: ", err)
+	}
+
+	// same response whether the address is known or not
+	locale := negotiateLocale(nil, r)
+	executeWriterFromFile(w, "view/password-forgot.html", &pongo2.Context{
+		"locale": locale,
+		"info":   T(locale, "password.forgot.sent"),
+	})
+}
+
+func resetPasswordPageGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+
+	locale := negotiateLocale(nil, r)
+	ctx := pongo2.Context{"token": token, "locale": locale}
+	if _, err := findPasswordReset(getDocDb(c), token); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		ctx["error"] = T(locale, "password.reset.invalid")
+	}
+
+	err := executeWriterFromFile(w, "view/password-reset.html", &ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func resetPasswordPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	docdb := getDocDb(c)
+	token := r.FormValue("token")
+	password := r.FormValue("password")
+	locale := negotiateLocale(nil, r)
+
+	u, err := findPasswordReset(docdb, token)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		executeWriterFromFile(w, "view/password-reset.html", &pongo2.Context{
+			"locale": locale,
+			"error":  T(locale, "password.reset.invalid"),
+		})
+		return
+	}
+
+	msg := ""
+	if errs := validatePassword("password", password, u.Name); len(errs) > 0 {
+		msg = errs[0].Message
+	} else if password != r.FormValue("confirmation") {
+		msg = T(locale, "password.reset.mismatch")
+	}
+
+	if msg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		executeWriterFromFile(w, "view/password-reset.html", &pongo2.Context{
+			"locale": locale,
+			"token":  token,
+			"error":  msg,
+		})
+		return
+	}
+
+	if err := docdb.Users.SetPassword(u.Id, HashPassword(password)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// every outstanding reset of the user is consumed
+	if err := docdb.PasswordResets.RemoveUser(u.Id); err != nil {
+		log.Println("resetPasswordPostHandler: ", err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	executeWriterFromFile(w, "view/login.html", &pongo2.Context{
+		"locale": locale,
+		"info":   T(locale, "password.reset.done"),
+	})
+}
+
+func apiUserPasswordResetPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uid := c.URLParams["userId"]
+	if !isObjectIdHex(uid) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	docdb := getDocDb(c)
+	u, err := getUserById(docdb, objectIdHex(uid))
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("apiUserPasswordResetPostHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if ok, err := canManageAccount(docdb, getSessionUser(c), u); err != nil {
+		log.Println("apiUserPasswordResetPostHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if err := sendPasswordResetMail(docdb, u, true); err != nil {
+		log.Println("apiUserPasswordResetPostHandler: ", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	recordAudit(docdb, r, getSessionUser(c), "user.password_reset", "user:"+u.Id.Hex(), nil, nil)
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// chdirRoot runs the test from the repository root, where the handlers find
+// the templates and the messages.
+func chdirRoot(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	if err := loadCatalogs(LOCALE_DIR); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveForm posts the form values to the handler h as the user u, nil
+// before logging in.
+func serveForm(db *docdb, u *user, h func(web.C, http.ResponseWriter, *http.Request), target string, form url.Values) *httptest.ResponseRecorder {
+	c := web.C{Env: map[interface{}]interface{}{"docdb": db}}
+	if u != nil {
+		c.Env["user"] = u
+	}
+	r := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h(c, w, r)
+	return w
+}
+
+func resetForm(token string, password string) url.Values {
+	return url.Values{"token": {token}, "password": {password}, "confirmation": {password}}
+}
+
+func TestResetPasswordHandlers(t *testing.T) {
+	chdirRoot(t)
+	db := newMemoryDocDb()
+	alice := addTestUser(t, db, "alice")
+	invalid := T(siteLocale(), "password.reset.invalid")
+
+	passwordIs := func(password string) bool {
+		u, _ := db.Users.Get(alice.Id)
+		return bcrypt.CompareHashAndPassword(u.Password, []byte(password)) == nil
+	}
+
+	expired, err := createPasswordReset(db, alice, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := serve(db, nil, resetPasswordPageGetHandler, nil, "GET", "/password/reset?token="+url.QueryEscape(expired), "")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), invalid) {
+		t.Error("expired token should be refused:", w.Code)
+	}
+	if w := serveForm(db, nil, resetPasswordPostHandler, "/password/reset", resetForm(expired, "expired-secret")); w.Code != http.StatusBadRequest || passwordIs("expired-secret") {
+		t.Error("expired token should not reset the password:", w.Code)
+	}
+
+	token, _ := createPasswordReset(db, alice, PASSWORD_RESET_EXPIRE)
+	other, _ := createPasswordReset(db, alice, PASSWORD_RESET_EXPIRE)
+	if w := serve(db, nil, resetPasswordPageGetHandler, nil, "GET", "/password/reset?token="+url.QueryEscape(token), ""); w.Code != http.StatusOK {
+		t.Error("valid token should be accepted:", w.Code)
+	}
+	if w := serveForm(db, nil, resetPasswordPostHandler, "/password/reset", resetForm(token, "first-secret")); w.Code != http.StatusOK || !passwordIs("first-secret") {
+		t.Fatal("reset failed:", w.Code)
+	}
+
+	// the reset consumes every token of the user
+	for _, used := range []string{token, other} {
+		w := serveForm(db, nil, resetPasswordPostHandler, "/password/reset", resetForm(used, "second-secret"))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), invalid) || passwordIs("second-secret") {
+			t.Error("token should be used once:", w.Code)
+		}
+	}
+
+	token, _ = createPasswordReset(db, alice, PASSWORD_RESET_EXPIRE)
+	if err := db.Users.SetDisabled(alice.Id, true); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveForm(db, nil, resetPasswordPostHandler, "/password/reset", resetForm(token, "disabled-secret")); w.Code != http.StatusBadRequest || passwordIs("disabled-secret") {
+		t.Error("disabled users should not reset their password:", w.Code)
+	}
+}
+
+func TestForgotPasswordPostHandler(t *testing.T) {
+	chdirRoot(t)
+	db := newMemoryDocDb()
+	alice := addTestUser(t, db, "alice")
+
+	known := serveForm(db, nil, forgotPasswordPostHandler, "/password/forgot", url.Values{"email": {alice.EMail}})
+	unknown := serveForm(db, nil, forgotPasswordPostHandler, "/password/forgot", url.Values{"email": {"nobody@example.com"}})
+	if known.Code != unknown.Code || known.Body.String() != unknown.Body.String() {
+		t.Error("unknown addresses should get the same response:", known.Code, unknown.Code)
+	}
+	if !strings.Contains(known.Body.String(), T(siteLocale(), "password.forgot.sent")) {
+		t.Error("response unexpected:", known.Body.String())
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+	"unicode/utf8"
+
+	"github.com/flosch/pongo2"
+	"github.com/zenazn/goji/web"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	EMAIL_VERIFICATION_EXPIRE = 24 * time.Hour
+	BIO_MAX_LENGTH            = 500
+)
+
+var supportedLanguages = []string{"en", "ja"}
+
+func supportedLanguage(lang string) bool {
+	for _, l := range supportedLanguages {
+		if l == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// emailVerification confirms a new address before it replaces user.EMail.
+type emailVerification struct {
+	Id        primitive.ObjectID `bson:"_id,omitempty"`
+	UserId    primitive.ObjectID `bson:"userid"`
+	Email     string             `bson:"email"`
+	Hash      string             `bson:"hash"`
+	ExpiresAt time.Time          `bson:"expiresat"`
+}
+
+// profileFields is what a user may change of oneself.
+type profileFields struct {
+	Name     *string `json:"name"`
+	Email    *string `json:"email"`
+	Timezone *string `json:"timezone"`
+	Language *string `json:"language"`
+	Bio      *string `json:"bio"`
+}
+
+// userProfile are the fields of a user saved by the profile form.
+type userProfile struct {
+	Name     string
+	Timezone string
+	Language string
+	Bio      string
+}
+
+type profileSummary struct {
+	Name     string `bson:"name,omitempty" json:"name,omitempty"`
+	Email    string `bson:"email,omitempty" json:"email,omitempty"`
+	Timezone string `bson:"timezone,omitempty" json:"timezone,omitempty"`
+	Language string `bson:"language,omitempty" json:"language,omitempty"`
+	Bio      string `bson:"bio,omitempty" json:"bio,omitempty"`
+}
+
+func summarizeProfile(u *user) profileSummary {
+	return profileSummary{Name: u.Name, Email: u.EMail, Timezone: u.Timezone, Language: u.Language, Bio: u.Bio}
+}
+
+func sendEmailVerification(db *docdb, u *user, email string) error {
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	// only the latest requested address can be verified
+	if err := db.EmailVerifications.RemoveUser(u.Id); err != nil {
+		return err
+	}
+
+	ev := emailVerification{
+		Id:        primitive.NewObjectID(),
+		UserId:    u.Id,
+		Email:     email,
+		Hash:      hashToken(token),
+		ExpiresAt: time.Now().Add(EMAIL_VERIFICATION_EXPIRE),
+	}
+	if err := db.EmailVerifications.Insert(&ev); err != nil {
+		return err
+	}
+
+	link := siteURL("/profile/email/verify?token=" + url.QueryEscape(token))
+	body := fmt.Sprintf("Hello %s,\n\nOpen the link below within %d hours to use this address for your irori account.\n\n%s\n",
+		u.Name, int(EMAIL_VERIFICATION_EXPIRE/time.Hour), link)
+
+	return sendMail(email, "[irori] Verify your email address", body)
+}
+
+func apiOwnUserPutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(c)
+
+	defer r.Body.Close()
+	var pf profileFields
+	if err := json.NewDecoder(r.Body).Decode(&pf); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	docdb := getDocDb(c)
+	u := *me
+	var errs []validationError
+	newEmail := ""
+
+	if pf.Name != nil && *pf.Name != me.Name {
+		if len(*pf.Name) < 4 {
+			errs = append(errs, validationError{Field: "name", Code: "too_short", Message: "name must be at least 4 characters"})
+		} else if ve, err := userConflict(docdb, me.Id, "name", *pf.Name); err != nil {
+			log.Println("apiOwnUserPutHandler: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if ve != nil {
+			errs = append(errs, *ve)
+		}
+		u.Name = *pf.Name
+	}
+
+	if pf.Email != nil && *pf.Email != me.EMail {
+		if *pf.Email == "" {
+			errs = append(errs, validationError{Field: "email", Code: "required", Message: "email is required"})
+		} else if ve, err := userConflict(docdb, me.Id, "email", *pf.Email); err != nil {
+			log.Println("apiOwnUserPutHandler: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if ve != nil {
+			errs = append(errs, *ve)
+		}
+		newEmail = *pf.Email
+	}
+
+	if pf.Timezone != nil {
+		if _, err := time.LoadLocation(*pf.Timezone); err != nil || *pf.Timezone == "Local" {
+			errs = append(errs, validationError{Field: "timezone", Code: "invalid", Message: "unknown timezone"})
+		}
+		u.Timezone = *pf.Timezone
+	}
+
+	if pf.Language != nil {
+		if *pf.Language != "" && !supportedLanguage(*pf.Language) {
+			errs = append(errs, validationError{Field: "language", Code: "invalid", Message: "unsupported language"})
+		}
+		u.Language = *pf.Language
+	}
+
+	if pf.Bio != nil {
+		if utf8.RuneCountInString(*pf.Bio) > BIO_MAX_LENGTH {
+			errs = append(errs, validationError{Field: "bio", Code: "too_long", Message: fmt.Sprintf("bio must be at most %d characters", BIO_MAX_LENGTH)})
+		}
+		u.Bio = *pf.Bio
+	}
+
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	if newEmail != "" {
+		if err := sendEmailVerification(docdb, me, newEmail); err != nil {
+			log.Println("apiOwnUserPutHandler: ", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		u.PendingEmail = newEmail
+	}
+
+	err := docdb.Users.SetProfile(u.Id, userProfile{Name: u.Name, Timezone: u.Timezone, Language: u.Language, Bio: u.Bio})
+	if err == nil && newEmail != "" {
+		err = docdb.Users.SetPendingEmail(u.Id, newEmail)
+	}
+	if err != nil {
+		log.Println("apiOwnUserPutHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(docdb, r, me, "user.profile.update", "user:"+me.Id.Hex(), summarizeProfile(me), summarizeProfile(&u))
+
+	js, _ := json.Marshal(u)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func verifyEmailGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(c)
+	docdb := getDocDb(c)
+	token := r.FormValue("token")
+
+	ev, err := docdb.EmailVerifications.Find(me.Id, hashToken(token))
+	if err != nil && err != ErrNotFound {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	locale := negotiateLocale(me, r)
+	msg := ""
+	if err == ErrNotFound || time.Now().After(ev.ExpiresAt) {
+		msg = T(locale, "profile.email.invalid")
+	} else if ve, err := userConflict(docdb, me.Id, "email", ev.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if ve != nil {
+		msg = T(locale, "profile.email.taken")
+	}
+
+	if msg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		executeWriterFromFile(w, "view/profile.html", &pongo2.Context{"loginuser": me, "locale": locale, "error": msg})
+		return
+	}
+
+	if err := docdb.Users.SetEmail(me.Id, ev.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	docdb.EmailVerifications.RemoveUser(me.Id)
+
+	recordAudit(docdb, r, me, "user.email.verify", "user:"+me.Id.Hex(),
+		profileSummary{Email: me.EMail}, profileSummary{Email: ev.Email})
+
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var verifyLink = regexp.MustCompile(`/profile/email/verify\?token=(\S+)`)
+
+// verificationToken returns the token of the verification mail.
+func verificationToken(t *testing.T, mails <-chan string) string {
+	select {
+	case mail := <-mails:
+		m := verifyLink.FindStringSubmatch(mail)
+		if m == nil {
+			t.Fatal("no verification link:", mail)
+		}
+		token, err := url.QueryUnescape(m[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	case <-time.After(5 * time.Second):
+		t.Fatal("no verification mail")
+	}
+	return ""
+}
+
+func TestEmailVerification(t *testing.T) {
+	chdirRoot(t)
+	mails := fakeSMTP(t)
+	db := newMemoryDocDb()
+	alice := addTestUser(t, db, "alice")
+	bob := addTestUser(t, db, "bob")
+
+	w := serve(db, alice, apiOwnUserPutHandler, nil, "PUT", "/api/users/own", `{"email":"alice@example.org"}`)
+	if w.Code != http.StatusOK {
+		t.Fatal("email change failed:", w.Code, w.Body.String())
+	}
+	token := verificationToken(t, mails)
+	if u, _ := db.Users.Get(alice.Id); u.EMail != "alice@example.com" || u.PendingEmail != "alice@example.org" {
+		t.Error("email should change only once verified:", u.EMail, u.PendingEmail)
+	}
+
+	verify := func(token string) int {
+		u, _ := db.Users.Get(alice.Id)
+		return serve(db, u, verifyEmailGetHandler, nil, "GET", "/profile/email/verify?token="+url.QueryEscape(token), "").Code
+	}
+	if code := verify("irori_wrong"); code != http.StatusBadRequest {
+		t.Error("wrong token should be refused:", code)
+	}
+	if code := verify(token); code != http.StatusSeeOther {
+		t.Fatal("verification failed:", code)
+	}
+	if u, _ := db.Users.Get(alice.Id); u.EMail != "alice@example.org" || u.PendingEmail != "" {
+		t.Error("email should be verified:", u.EMail, u.PendingEmail)
+	}
+	if code := verify(token); code != http.StatusBadRequest {
+		t.Error("token should be used once:", code)
+	}
+
+	// an address taken by another user
+	w = serve(db, alice, apiOwnUserPutHandler, nil, "PUT", "/api/users/own", `{"email":"bob@example.com"}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"taken"`) {
+		t.Error("email of another user should be refused:", w.Code, w.Body.String())
+	}
+
+	// an address taken between the request and the verification
+	if w := serve(db, alice, apiOwnUserPutHandler, nil, "PUT", "/api/users/own", `{"email":"shared@example.com"}`); w.Code != http.StatusOK {
+		t.Fatal("email change failed:", w.Code)
+	}
+	token = verificationToken(t, mails)
+	if err := db.Users.SetEmail(bob.Id, "shared@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if code := verify(token); code != http.StatusBadRequest {
+		t.Error("email taken meanwhile should be refused:", code)
+	}
+	if u, _ := db.Users.Get(alice.Id); u.EMail != "alice@example.org" {
+		t.Error("email should be kept:", u.EMail)
+	}
+}
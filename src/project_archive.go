@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// confirmProject checks that the request repeats the name of the project in
+// the "confirm" parameter, as destructive operations must be confirmed.
+func confirmProject(w http.ResponseWriter, r *http.Request, p *project) bool {
+	if r.FormValue("confirm") != p.Name {
+		writeValidationErrors(w, []validationError{{Field: "confirm", Code: "mismatch",
+			Message: "type the project name to confirm"}})
+		return false
+	}
+	return true
+}
+
+// archivedProjectIds returns the archived projects among ids.
+func archivedProjectIds(db *docdb, ids []primitive.ObjectID) ([]primitive.ObjectID, error) {
+	var archived []primitive.ObjectID
+	for _, id := range uniqueIds(ids) {
+		p, err := db.Projects.Get(id)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if p.Archived {
+			archived = append(archived, p.Id)
+		}
+	}
+	return archived, nil
+}
+
+// validatePageProjects refuses to add a page to an archived project. Pages
+// already in the project keep it.
+func validatePageProjects(db *docdb, p *page, old *page) ([]validationError, error) {
+	archived, err := archivedProjectIds(db, p.Projects)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range archived {
+		if old == nil || !containsId(old.Projects, id) {
+			return []validationError{{Field: "projects", Code: "archived",
+				Message: "pages can't be added to an archived project"}}, nil
+		}
+	}
+	return nil, nil
+}
+
+func setProjectArchived(c web.C, w http.ResponseWriter, r *http.Request, archived bool) {
+	docdb := getDocDb(c)
+	p := getEnvProject(c)
+
+	if !confirmProject(w, r, p) {
+		return
+	}
+
+	action := "project.unarchive"
+	if archived {
+		action = "project.archive"
+	}
+
+	if err := docdb.Projects.SetArchived(p.Id, archived, time.Now()); err != nil {
+		log.Println("setProjectArchived: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(docdb, r, getSessionUser(c), action, "project:"+p.Id.Hex(),
+		bson.M{"archived": p.Archived}, bson.M{"archived": archived})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiProjectArchivePostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	setProjectArchived(c, w, r, true)
+}
+
+func apiProjectArchiveDeleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	setProjectArchived(c, w, r, false)
+}
+
+// apiProjectDeleteHandler removes a project and detaches it from the pages
+// and the project scoped role bindings.
+func apiProjectDeleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	docdb := getDocDb(c)
+	p := getEnvProject(c)
+
+	if !confirmProject(w, r, p) {
+		return
+	}
+
+	if err := docdb.Projects.Remove(p.Id); err != nil {
+		log.Println("apiProjectDeleteHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	detached, err := docdb.Pages.PullProject(p.Id)
+	if err != nil {
+		log.Println("apiProjectDeleteHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for _, unbind := range []func(primitive.ObjectID) error{docdb.Users.UnbindProject, docdb.Groups.UnbindProject} {
+		if err := unbind(p.Id); err != nil {
+			log.Println("apiProjectDeleteHandler: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	recordAudit(docdb, r, getSessionUser(c), "project.delete", "project:"+p.Id.Hex(),
+		p, bson.M{"detachedPages": detached})
+
+	w.WriteHeader(http.StatusNoContent)
+}
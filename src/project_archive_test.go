@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConfirmProject(t *testing.T) {
+	p := &project{Name: "irori"}
+
+	r, _ := http.NewRequest("DELETE", "/api/projects/x?confirm=irori", nil)
+	if w := httptest.NewRecorder(); !confirmProject(w, r, p) {
+		t.Error("matching name should confirm")
+	}
+
+	r, _ = http.NewRequest("DELETE", "/api/projects/x?confirm=other", nil)
+	w := httptest.NewRecorder()
+	if confirmProject(w, r, p) || w.Code != http.StatusBadRequest {
+		t.Error("other name should be refused with 400, got", w.Code)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	DASHBOARD_DEFAULT_DAYS = 30
+	DASHBOARD_MAX_DAYS     = 365
+	DASHBOARD_LIMIT        = 10
+	DASHBOARD_ACTIVITIES   = 20
+)
+
+type pageActivity struct {
+	PageId   primitive.ObjectID `bson:"_id" json:"pageId"`
+	Title    string             `bson:"title" json:"title"`
+	UserId   primitive.ObjectID `bson:"userid" json:"userId"`
+	UserName string             `bson:"-" json:"userName"`
+	Date     time.Time          `bson:"date" json:"date"`
+	Created  bool               `bson:"created" json:"created"`
+}
+
+type projectContributor struct {
+	UserId primitive.ObjectID `bson:"_id" json:"userId"`
+	Name   string             `bson:"-" json:"name"`
+	Edits  int                `bson:"edits" json:"edits"`
+	Pages  int                `bson:"pages" json:"pages"`
+}
+
+type monthlyPageCount struct {
+	Month   string `json:"month"`
+	Created int    `json:"created"`
+	Total   int    `json:"total"`
+}
+
+type viewedPage struct {
+	Id      primitive.ObjectID `bson:"_id" json:"pageId"`
+	Article struct {
+		Title string `bson:"title" json:"title"`
+	} `bson:"article" json:"article"`
+	Views int `bson:"views" json:"views"`
+}
+
+type projectDashboard struct {
+	Project      *project             `json:"project"`
+	Days         int                  `json:"days"`
+	PageCount    int                  `json:"pageCount"`
+	Activity     []pageActivity       `json:"activity"`
+	Contributors []projectContributor `json:"contributors"`
+	PageCounts   []monthlyPageCount   `json:"pageCounts"`
+	MostViewed   []viewedPage         `json:"mostViewed"`
+}
+
+// pageEdit is a version of a page, a revision or the current article.
+type pageEdit struct {
+	UserId primitive.ObjectID `bson:"userid"`
+	Date   time.Time          `bson:"date"`
+}
+
+// pageEdits is a page of a project with the editor and the date of each of
+// its versions.
+type pageEdits struct {
+	Id      primitive.ObjectID `bson:"_id"`
+	Title   string             `bson:"title"`
+	Views   int                `bson:"views"`
+	Created time.Time          `bson:"created,omitempty"`
+	Edits   []pageEdit         `bson:"edits"`
+}
+
+// first returns the date of the first version.
+func (p *pageEdits) first() time.Time {
+	var first time.Time
+	for _, e := range p.Edits {
+		if first.IsZero() || e.Date.Before(first) {
+			first = e.Date
+		}
+	}
+	return first
+}
+
+// created returns the creation date of the page. The oldest revisions being
+// pruned, the first version kept is only used for the pages stored before
+// the creation date was recorded.
+func (p *pageEdits) created() time.Time {
+	if !p.Created.IsZero() {
+		return p.Created
+	}
+	return p.first()
+}
+
+func recentActivity(pages []pageEdits, since time.Time) []pageActivity {
+	activity := []pageActivity{}
+	for _, p := range pages {
+		created := p.created()
+		for _, e := range p.Edits {
+			if !e.Date.Before(since) {
+				activity = append(activity, pageActivity{
+					PageId: p.Id, Title: p.Title, UserId: e.UserId, Date: e.Date, Created: e.Date.Equal(created)})
+			}
+		}
+	}
+
+	sort.SliceStable(activity, func(i, j int) bool { return activity[i].Date.After(activity[j].Date) })
+	if len(activity) > DASHBOARD_ACTIVITIES {
+		activity = activity[:DASHBOARD_ACTIVITIES]
+	}
+	return activity
+}
+
+func topContributors(pages []pageEdits, since time.Time) []projectContributor {
+	byUser := map[primitive.ObjectID]*projectContributor{}
+	contributors := []projectContributor{}
+	for _, p := range pages {
+		edited := map[primitive.ObjectID]bool{}
+		for _, e := range p.Edits {
+			if e.Date.Before(since) {
+				continue
+			}
+			c, ok := byUser[e.UserId]
+			if !ok {
+				c = &projectContributor{UserId: e.UserId}
+				byUser[e.UserId] = c
+			}
+			c.Edits++
+			if !edited[e.UserId] {
+				edited[e.UserId] = true
+				c.Pages++
+			}
+		}
+	}
+	for _, c := range byUser {
+		contributors = append(contributors, *c)
+	}
+
+	sort.Slice(contributors, func(i, j int) bool {
+		a, b := contributors[i], contributors[j]
+		if a.Edits != b.Edits {
+			return a.Edits > b.Edits
+		}
+		if a.Pages != b.Pages {
+			return a.Pages > b.Pages
+		}
+		return a.UserId.Hex() < b.UserId.Hex()
+	})
+	if len(contributors) > DASHBOARD_LIMIT {
+		contributors = contributors[:DASHBOARD_LIMIT]
+	}
+	return contributors
+}
+
+type monthCount struct {
+	Id struct {
+		Year  int
+		Month int
+	}
+	Count int
+}
+
+// pageCountsByMonth counts the pages created in each month, in UTC.
+func pageCountsByMonth(pages []pageEdits) []monthCount {
+	byMonth := map[[2]int]int{}
+	for _, p := range pages {
+		created := p.created().UTC()
+		byMonth[[2]int{created.Year(), int(created.Month())}]++
+	}
+
+	counts := []monthCount{}
+	for m, n := range byMonth {
+		c := monthCount{Count: n}
+		c.Id.Year, c.Id.Month = m[0], m[1]
+		counts = append(counts, c)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Id.Year != counts[j].Id.Year {
+			return counts[i].Id.Year < counts[j].Id.Year
+		}
+		return counts[i].Id.Month < counts[j].Id.Month
+	})
+	return counts
+}
+
+func mostViewed(pages []pageEdits) []viewedPage {
+	viewed := []viewedPage{}
+	for _, p := range pages {
+		if p.Views > 0 {
+			v := viewedPage{Id: p.Id, Views: p.Views}
+			v.Article.Title = p.Title
+			viewed = append(viewed, v)
+		}
+	}
+
+	sort.SliceStable(viewed, func(i, j int) bool { return viewed[i].Views > viewed[j].Views })
+	if len(viewed) > DASHBOARD_LIMIT {
+		viewed = viewed[:DASHBOARD_LIMIT]
+	}
+	return viewed
+}
+
+// accumulatePageCounts turns the sorted monthly creations into a series
+// with the running total, filling the months without new pages.
+func accumulatePageCounts(counts []monthCount) []monthlyPageCount {
+	series := []monthlyPageCount{}
+	if len(counts) == 0 {
+		return series
+	}
+
+	total := 0
+	year, month := counts[0].Id.Year, counts[0].Id.Month
+	for _, c := range counts {
+		for year < c.Id.Year || (year == c.Id.Year && month < c.Id.Month) {
+			series = append(series, monthlyPageCount{Month: fmt.Sprintf("%04d-%02d", year, month), Total: total})
+			if month++; month > 12 {
+				year, month = year+1, 1
+			}
+		}
+
+		total += c.Count
+		series = append(series, monthlyPageCount{Month: fmt.Sprintf("%04d-%02d", year, month), Created: c.Count, Total: total})
+		if month++; month > 12 {
+			year, month = year+1, 1
+		}
+	}
+	return series
+}
+
+// userNames returns the names of the users of ids.
+func userNames(db *docdb, ids []primitive.ObjectID) (map[primitive.ObjectID]string, error) {
+	names := map[primitive.ObjectID]string{}
+	for _, id := range uniqueIds(ids) {
+		u, err := db.Users.Get(id)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		names[u.Id] = u.Name
+	}
+	return names, nil
+}
+
+func buildProjectDashboard(u *user, db *docdb, p *project, days int) (*projectDashboard, error) {
+	v, err := pageVisibilityOf(u, db)
+	if err != nil {
+		return nil, err
+	}
+	pages, err := db.Pages.ProjectEdits(v, p.Id)
+	if err != nil {
+		return nil, err
+	}
+	since := time.Now().AddDate(0, 0, -days)
+
+	d := &projectDashboard{
+		Project:      p,
+		Days:         days,
+		PageCount:    len(pages),
+		Activity:     recentActivity(pages, since),
+		Contributors: topContributors(pages, since),
+		PageCounts:   accumulatePageCounts(pageCountsByMonth(pages)),
+		MostViewed:   mostViewed(pages),
+	}
+
+	var ids []primitive.ObjectID
+	for _, a := range d.Activity {
+		ids = append(ids, a.UserId)
+	}
+	for _, c := range d.Contributors {
+		ids = append(ids, c.UserId)
+	}
+	names, err := userNames(db, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range d.Activity {
+		d.Activity[i].UserName = names[d.Activity[i].UserId]
+		d.Activity[i].Date = u.localTime(d.Activity[i].Date)
+	}
+	for i := range d.Contributors {
+		d.Contributors[i].Name = names[d.Contributors[i].UserId]
+	}
+
+	return d, nil
+}
+
+func apiProjectDashboardGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	user := getSessionUser(c)
+	docdb := getDocDb(c)
+
+	p, err := getVisibleProject(docdb, user, c.URLParams["projectId"])
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("apiProjectDashboardGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	days := DASHBOARD_DEFAULT_DAYS
+	if s := r.FormValue("days"); s != "" {
+		days, err = strconv.Atoi(s)
+		if err != nil || days <= 0 || days > DASHBOARD_MAX_DAYS {
+			writeValidationErrors(w, []validationError{{Field: "days", Code: "invalid",
+				Message: fmt.Sprintf("days must be between 1 and %d", DASHBOARD_MAX_DAYS)}})
+			return
+		}
+	}
+
+	d, err := buildProjectDashboard(user, docdb, p, days)
+	if err != nil {
+		log.Println("apiProjectDashboardGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(d)
+	if err != nil {
+		log.Println("apiProjectDashboardGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
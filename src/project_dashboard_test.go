@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestAccumulatePageCounts(t *testing.T) {
+	count := func(year, month, n int) monthCount {
+		var c monthCount
+		c.Id.Year, c.Id.Month, c.Count = year, month, n
+		return c
+	}
+
+	got := accumulatePageCounts([]monthCount{count(2015, 11, 2), count(2016, 2, 3)})
+	want := []monthlyPageCount{
+		{Month: "2015-11", Created: 2, Total: 2},
+		{Month: "2015-12", Total: 2},
+		{Month: "2016-01", Total: 2},
+		{Month: "2016-02", Created: 3, Total: 5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("accumulatePageCounts = %v, want %v", got, want)
+	}
+
+	if got := accumulatePageCounts(nil); len(got) != 0 {
+		t.Errorf("no pages should give an empty series: %v", got)
+	}
+}
+
+func TestBuildProjectDashboard(t *testing.T) {
+	db := newMemoryDocDb()
+	alice := addTestUser(t, db, "alice")
+	bob := addTestUser(t, db, "bob")
+	handbook := &project{Name: "handbook"}
+	if err := db.Projects.Insert(handbook); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	guide := &page{Id: primitive.NewObjectID(), Author: alice.Id, Access: PUBLIC, Views: 3,
+		Projects: []primitive.ObjectID{handbook.Id},
+		Article:  article{Title: "Guide", UserId: bob.Id, Date: now.Add(-time.Hour)}}
+	notes := &page{Id: primitive.NewObjectID(), Author: bob.Id, Access: PRIVATE,
+		Projects: []primitive.ObjectID{handbook.Id},
+		Article:  article{Title: "Notes", UserId: bob.Id, Date: now}}
+	other := &page{Id: primitive.NewObjectID(), Author: alice.Id, Access: PUBLIC,
+		Article: article{Title: "Other", UserId: alice.Id, Date: now}}
+	for _, p := range []*page{guide, notes, other} {
+		if err := db.Pages.Insert(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first version of the guide, by alice, is older than the period
+	first := revision{Id: primitive.NewObjectID(), PageId: guide.Id, UserId: alice.Id, Date: now.AddDate(0, 0, -40)}
+	if err := db.Revisions.Insert(&first); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := buildProjectDashboard(alice, db, handbook, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.PageCount != 1 {
+		t.Error("only the readable pages of the project should be counted:", d.PageCount)
+	}
+	if len(d.Activity) != 1 || d.Activity[0].UserName != "bob" || d.Activity[0].Created {
+		t.Error("activity should be the edit of bob:", d.Activity)
+	}
+	if len(d.Contributors) != 1 || d.Contributors[0].Name != "bob" || d.Contributors[0].Edits != 1 {
+		t.Error("contributors should count the edits of the period:", d.Contributors)
+	}
+	if len(d.MostViewed) != 1 || d.MostViewed[0].Article.Title != "Guide" || d.MostViewed[0].Views != 3 {
+		t.Error("most viewed unexpected:", d.MostViewed)
+	}
+	if n := len(d.PageCounts); n == 0 || d.PageCounts[n-1].Total != 1 || d.PageCounts[0].Created != 1 {
+		t.Error("pages should be counted in the month of their first version:", d.PageCounts)
+	}
+}
+
+func TestRecentActivityCreated(t *testing.T) {
+	now := time.Now()
+	edit := func(days int) pageEdit {
+		return pageEdit{UserId: primitive.NewObjectID(), Date: now.AddDate(0, 0, -days)}
+	}
+
+	// the revisions of the first page were pruned: its oldest version kept
+	// is an edit
+	fresh := edit(5)
+	pages := []pageEdits{
+		{Id: primitive.NewObjectID(), Created: now.AddDate(-1, 0, 0), Edits: []pageEdit{edit(3), edit(1)}},
+		{Id: primitive.NewObjectID(), Edits: []pageEdit{edit(2), edit(0)}},
+		{Id: primitive.NewObjectID(), Created: fresh.Date, Edits: []pageEdit{fresh}},
+	}
+
+	created := map[primitive.ObjectID]int{}
+	for _, a := range recentActivity(pages, now.AddDate(0, 0, -30)) {
+		if a.Created {
+			created[a.PageId]++
+		}
+	}
+	if created[pages[0].Id] != 0 || created[pages[1].Id] != 1 || created[pages[2].Id] != 1 {
+		t.Error("only the creations should be marked created:", created)
+	}
+}
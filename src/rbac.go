@@ -0,0 +1,566 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Fine-grained permissions. ADMIN is the site administrator permission and
+// implies every other one.
+const (
+	PAGE_CREATE    permission = "page.create"
+	PAGE_EDIT_ANY  permission = "page.edit.any"
+	PAGE_DELETE    permission = "page.delete"
+	PROJECT_MANAGE permission = "project.manage"
+	GROUP_MANAGE   permission = "group.manage"
+	USER_MANAGE    permission = "user.manage"
+)
+
+var allPermissions = []permission{
+	ADMIN, PAGE_CREATE, PAGE_EDIT_ANY, PAGE_DELETE, PROJECT_MANAGE, GROUP_MANAGE, USER_MANAGE,
+}
+
+// managing permissions are the ones that open the admin pages, and that a
+// token needs the admin scope to use.
+var managePermissions = []permission{ADMIN, PROJECT_MANAGE, GROUP_MANAGE, USER_MANAGE}
+
+func (p permission) valid() bool {
+	for _, a := range allPermissions {
+		if p == a {
+			return true
+		}
+	}
+	return false
+}
+
+func (p permission) administrative() bool {
+	for _, a := range managePermissions {
+		if p == a {
+			return true
+		}
+	}
+	return false
+}
+
+// role is a named set of permissions.
+type role struct {
+	Id          primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Name        string             `json:"name"`
+	Permissions []permission       `json:"permissions"`
+	Builtin     bool               `bson:"-" json:"builtin"`
+}
+
+// roleBinding assigns a role to a user or a group. With Project set the role
+// is effective only for pages of that project.
+type roleBinding struct {
+	Role    string             `json:"role"`
+	Project primitive.ObjectID `bson:"project,omitempty" json:"project,omitempty"`
+}
+
+// Built-in roles keep the names of the former ADMIN and EDITOR permissions so
+// user.Permissions stored before roles existed are read as role bindings.
+var builtinRoles = []role{
+	{Name: string(ADMIN), Permissions: allPermissions, Builtin: true},
+	{Name: string(EDITOR), Permissions: []permission{PAGE_CREATE}, Builtin: true},
+}
+
+func findBuiltinRole(name string) *role {
+	for i := range builtinRoles {
+		if builtinRoles[i].Name == name {
+			return &builtinRoles[i]
+		}
+	}
+	return nil
+}
+
+type permissionSet map[permission]bool
+
+func (ps permissionSet) add(perms []permission) {
+	for _, p := range perms {
+		ps[p] = true
+	}
+}
+
+func (ps permissionSet) has(p permission) bool {
+	return ps[ADMIN] || ps[p]
+}
+
+// userPermissions is the resolved permissions of a user.
+type userPermissions struct {
+	global   permissionSet
+	projects map[primitive.ObjectID]permissionSet
+}
+
+func (up *userPermissions) bind(r *role, project primitive.ObjectID) {
+	if project.IsZero() {
+		up.global.add(r.Permissions)
+		return
+	}
+
+	ps, ok := up.projects[project]
+	if !ok {
+		ps = permissionSet{}
+		up.projects[project] = ps
+	}
+	ps.add(r.Permissions)
+}
+
+func (u *user) bindings() []roleBinding {
+	bs := append([]roleBinding{}, u.Roles...)
+	for p, ok := range u.Permissions {
+		if ok {
+			bs = append(bs, roleBinding{Role: string(p)})
+		}
+	}
+	return bs
+}
+
+// legacyPermissions resolves only the built-in roles of the user, used when
+// the permissions were not loaded from the database.
+func (u *user) legacyPermissions() *userPermissions {
+	up := &userPermissions{global: permissionSet{}, projects: map[primitive.ObjectID]permissionSet{}}
+	for _, b := range u.bindings() {
+		if r := findBuiltinRole(b.Role); r != nil {
+			up.bind(r, b.Project)
+		}
+	}
+	return up
+}
+
+// resolvePermissions loads the roles bound to the user directly and through
+// the groups the user belongs to.
+func resolvePermissions(db *docdb, u *user) error {
+	bs := u.bindings()
+
+	groups, err := db.Groups.List(groupQuery{Member: u.Id})
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		// group admins don't get the roles of the group
+		if containsId(g.Users, u.Id) {
+			bs = append(bs, g.Roles...)
+		}
+	}
+
+	roles, err := findRoles(db, bs)
+	if err != nil {
+		return err
+	}
+
+	up := &userPermissions{global: permissionSet{}, projects: map[primitive.ObjectID]permissionSet{}}
+	for _, b := range bs {
+		r := roles[b.Role]
+		if r == nil {
+			log.Println("resolvePermissions: unknown role: ", b.Role)
+			continue
+		}
+		up.bind(r, b.Project)
+	}
+
+	u.perms = up
+	return nil
+}
+
+// findRoles returns the roles bound by bs by name, the unknown ones left out.
+func findRoles(db *docdb, bs []roleBinding) (map[string]*role, error) {
+	roles := map[string]*role{}
+	var names []string
+	for _, b := range bs {
+		if r := findBuiltinRole(b.Role); r != nil {
+			roles[r.Name] = r
+		} else {
+			names = append(names, b.Role)
+		}
+	}
+
+	if len(names) > 0 {
+		custom, err := db.Roles.Find(names)
+		if err != nil {
+			return nil, err
+		}
+		for i := range custom {
+			roles[custom[i].Name] = &custom[i]
+		}
+	}
+	return roles, nil
+}
+
+// administrativeBindings reports whether one of the roles of bs grants a
+// managing permission.
+func administrativeBindings(db *docdb, bs []roleBinding) (bool, error) {
+	roles, err := findRoles(db, bs)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range roles {
+		for _, p := range r.Permissions {
+			if p.administrative() {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// canManageAccount reports whether me may change the account of u: the
+// accounts with managing permissions are left to the site admin, else a
+// user manager could take them over.
+func canManageAccount(db *docdb, me *user, u *user) (bool, error) {
+	if me.HasPermission(ADMIN) {
+		return true, nil
+	}
+	if err := resolvePermissions(db, u); err != nil {
+		return false, err
+	}
+	return !u.isManager(), nil
+}
+
+// canChangeGroupMembers reports whether me may add or remove members of g.
+// Members get the roles of the group, so changing them is granting the
+// roles: that needs GROUP_MANAGE, and ADMIN for managing roles.
+func canChangeGroupMembers(db *docdb, me *user, g *group) (bool, error) {
+	if len(g.Roles) == 0 {
+		return true, nil
+	}
+	if !me.HasPermission(GROUP_MANAGE) {
+		return false, nil
+	}
+	admin, err := administrativeBindings(db, g.Roles)
+	if err != nil {
+		return false, err
+	}
+	return !admin || me.HasPermission(ADMIN), nil
+}
+
+func (u *user) permissions() *userPermissions {
+	if u.perms == nil {
+		u.perms = u.legacyPermissions()
+	}
+	return u.perms
+}
+
+// HasPermission reports whether the user has perm site-wide.
+func (u *user) HasPermission(perm permission) bool {
+	return u.permissions().global.has(perm)
+}
+
+// HasProjectPermission reports whether the user has perm site-wide or in
+// the project.
+func (u *user) HasProjectPermission(perm permission, project primitive.ObjectID) bool {
+	up := u.permissions()
+	if up.global.has(perm) {
+		return true
+	}
+	ps, ok := up.projects[project]
+	return ok && ps.has(perm)
+}
+
+// hasPagePermission reports whether the user has perm site-wide or in one of
+// the projects.
+func (u *user) hasPagePermission(perm permission, projects []primitive.ObjectID) bool {
+	if u.HasPermission(perm) {
+		return true
+	}
+	for _, p := range projects {
+		if u.HasProjectPermission(perm, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// canCreatePage needs the create permission site-wide, or in every one of
+// the projects when it is granted per project.
+func (u *user) canCreatePage(projects []primitive.ObjectID) bool {
+	if u.HasPermission(PAGE_CREATE) {
+		return true
+	}
+	for _, p := range projects {
+		if !u.HasProjectPermission(PAGE_CREATE, p) {
+			return false
+		}
+	}
+	return len(projects) > 0
+}
+
+// canEditPage allows the author with create permission and users who may
+// edit any page of the page's projects.
+func (u *user) canEditPage(p *page) bool {
+	if p.Author == u.Id && u.canCreatePage(p.Projects) {
+		return true
+	}
+	return u.hasPagePermission(PAGE_EDIT_ANY, p.Projects)
+}
+
+func (u *user) canDeletePage(p *page) bool {
+	return u.hasPagePermission(PAGE_DELETE, p.Projects)
+}
+
+// mayCreatePages reports whether the user can create a page in any project.
+func (u *user) mayCreatePages() bool {
+	up := u.permissions()
+	if up.global.has(PAGE_CREATE) {
+		return true
+	}
+	for _, ps := range up.projects {
+		if ps.has(PAGE_CREATE) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *user) isManager() bool {
+	for _, p := range managePermissions {
+		if u.HasPermission(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func validRoleName(name string) bool {
+	return len(name) > 0 && !strings.ContainsAny(name, " \t\r\n")
+}
+
+func verifyBindings(db *docdb, bs []roleBinding) bool {
+	for _, b := range bs {
+		if findBuiltinRole(b.Role) != nil {
+			continue
+		}
+		roles, err := db.Roles.Find([]string{b.Role})
+		if err != nil || len(roles) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func apiRoleListGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	docdb := getDocDb(c)
+
+	roles, err := docdb.Roles.List()
+	if err != nil {
+		log.Println("apiRoleListGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(append(append([]role{}, builtinRoles...), roles...))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func decodeRole(w http.ResponseWriter, r *http.Request) (*role, bool) {
+	defer r.Body.Close()
+	var ro role
+	if err := json.NewDecoder(r.Body).Decode(&ro); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+
+	if !validRoleName(ro.Name) || findBuiltinRole(ro.Name) != nil {
+		log.Println("invalid role name: ", ro.Name)
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+
+	for _, p := range ro.Permissions {
+		if !p.valid() {
+			log.Println("invalid permission: ", p)
+			w.WriteHeader(http.StatusBadRequest)
+			return nil, false
+		}
+	}
+
+	ro.Builtin = false
+	return &ro, true
+}
+
+func apiRolePostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	ro, ok := decodeRole(w, r)
+	if !ok {
+		return
+	}
+
+	docdb := getDocDb(c)
+	err := docdb.Roles.Insert(ro)
+	if err == ErrDuplicate {
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println("apiRolePostHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(docdb, r, getSessionUser(c), "role.create", "role:"+ro.Name, nil, ro)
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func apiRolePutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	roleId := c.URLParams["roleId"]
+	if !isObjectIdHex(roleId) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ro, ok := decodeRole(w, r)
+	if !ok {
+		return
+	}
+
+	docdb := getDocDb(c)
+	id := objectIdHex(roleId)
+
+	old, err := docdb.Roles.Get(id)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("apiRolePutHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the name is the key of bindings, renaming would orphan them
+	if old.Name != ro.Name {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ro.Id = id
+	if err := docdb.Roles.Update(ro); err != nil {
+		log.Println("apiRolePutHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(docdb, r, getSessionUser(c), "role.update", "role:"+ro.Name, old, ro)
+
+	js, _ := json.Marshal(ro)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func apiRoleDeleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	roleId := c.URLParams["roleId"]
+	if !isObjectIdHex(roleId) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	docdb := getDocDb(c)
+	id := objectIdHex(roleId)
+
+	ro, err := docdb.Roles.Get(id)
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("apiRoleDeleteHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := docdb.Roles.Remove(id); err != nil {
+		log.Println("apiRoleDeleteHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// drop bindings of the removed role
+	if err := docdb.Users.UnbindRole(ro.Name); err != nil {
+		log.Println("apiRoleDeleteHandler: ", err)
+	}
+	if err := docdb.Groups.UnbindRole(ro.Name); err != nil {
+		log.Println("apiRoleDeleteHandler: ", err)
+	}
+
+	recordAudit(docdb, r, getSessionUser(c), "role.delete", "role:"+ro.Name, ro, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeBindings(c web.C, w http.ResponseWriter, r *http.Request) ([]roleBinding, bool) {
+	defer r.Body.Close()
+	bs := []roleBinding{}
+	if err := json.NewDecoder(r.Body).Decode(&bs); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+
+	if !verifyBindings(getDocDb(c), bs) {
+		log.Println("unknown role in bindings: ", bs)
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+
+	return bs, true
+}
+
+// updateRoleBindings replaces the roles of a user or a group, read by get
+// and saved by set, and records it as action in the audit log.
+func updateRoleBindings(c web.C, w http.ResponseWriter, r *http.Request, kind string, idHex string,
+	get func(id primitive.ObjectID) ([]roleBinding, error), set func(id primitive.ObjectID, bs []roleBinding) error,
+	action string, bindings []roleBinding) {
+	if !isObjectIdHex(idHex) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	id := objectIdHex(idHex)
+
+	docdb := getDocDb(c)
+	old, err := get(id)
+	if err == nil {
+		err = set(id, bindings)
+	}
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("updateRoleBindings: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(docdb, r, getSessionUser(c), action, kind+":"+idHex, bson.M{"roles": old}, bson.M{"roles": bindings})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiUserRolesPutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	if bs, ok := decodeBindings(c, w, r); ok {
+		docdb := getDocDb(c)
+		get := func(id primitive.ObjectID) ([]roleBinding, error) {
+			u, err := docdb.Users.Get(id)
+			if err != nil {
+				return nil, err
+			}
+			return u.Roles, nil
+		}
+		updateRoleBindings(c, w, r, "user", c.URLParams["userId"], get, docdb.Users.SetRoles, "user.roles", bs)
+	}
+}
+
+func apiGroupRolesPutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	if bs, ok := decodeBindings(c, w, r); ok {
+		docdb := getDocDb(c)
+		get := func(id primitive.ObjectID) ([]roleBinding, error) {
+			g, err := docdb.Groups.Get(id)
+			if err != nil {
+				return nil, err
+			}
+			return g.Roles, nil
+		}
+		updateRoleBindings(c, w, r, "group", c.URLParams["groupId"], get, docdb.Groups.SetRoles, "group.roles", bs)
+	}
+}
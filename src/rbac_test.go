@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLegacyPermissions(t *testing.T) {
+	admin := &user{Permissions: map[permission]bool{ADMIN: true, EDITOR: true}}
+	for _, p := range allPermissions {
+		if !admin.HasPermission(p) {
+			t.Error("admin should have", p)
+		}
+	}
+
+	editor := &user{Permissions: map[permission]bool{EDITOR: true}}
+	if !editor.HasPermission(PAGE_CREATE) || editor.HasPermission(PAGE_DELETE) || editor.isManager() {
+		t.Error("editor permissions unexpected")
+	}
+
+	guest := &user{}
+	if guest.mayCreatePages() || guest.isManager() {
+		t.Error("guest permissions unexpected")
+	}
+}
+
+func TestProjectPermissions(t *testing.T) {
+	px := primitive.NewObjectID()
+	py := primitive.NewObjectID()
+
+	u := &user{Id: primitive.NewObjectID()}
+	u.perms = &userPermissions{global: permissionSet{}, projects: map[primitive.ObjectID]permissionSet{}}
+	u.perms.bind(&role{Permissions: []permission{PAGE_CREATE, PAGE_EDIT_ANY}}, px)
+
+	if u.HasPermission(PAGE_CREATE) || !u.HasProjectPermission(PAGE_CREATE, px) {
+		t.Error("project scoped permission unexpected")
+	}
+
+	if !u.mayCreatePages() || u.canCreatePage(nil) || u.canCreatePage([]primitive.ObjectID{px, py}) ||
+		!u.canCreatePage([]primitive.ObjectID{px}) {
+		t.Error("canCreatePage unexpected")
+	}
+
+	other := &page{Author: primitive.NewObjectID(), Projects: []primitive.ObjectID{px}}
+	if !u.canEditPage(other) {
+		t.Error("should edit any page in project")
+	}
+
+	other.Projects = []primitive.ObjectID{py}
+	if u.canEditPage(other) || u.canDeletePage(other) {
+		t.Error("should not edit page out of project")
+	}
+}
+
+func TestCanManageGroup(t *testing.T) {
+	u := &user{Id: primitive.NewObjectID()}
+	g := &group{Users: []primitive.ObjectID{u.Id}}
+
+	if u.canManageGroup(g) {
+		t.Error("member should not manage the group")
+	}
+
+	g.Admins = []primitive.ObjectID{u.Id}
+	if !u.canManageGroup(g) {
+		t.Error("group admin should manage the group")
+	}
+
+	manager := &user{Id: primitive.NewObjectID(), Roles: []roleBinding{{Role: "admin"}}}
+	if !manager.canManageGroup(&group{}) {
+		t.Error("site admin should manage every group")
+	}
+}
+
+func TestGroupMembersWithRoles(t *testing.T) {
+	db := newMemoryDocDb()
+	owner := addTestUser(t, db, "owner")
+	manager := addTestUser(t, db, "manager", GROUP_MANAGE)
+
+	plain := &group{Name: "plain", Admins: []primitive.ObjectID{owner.Id}}
+	editors := &group{Name: "editors", Admins: []primitive.ObjectID{owner.Id}, Roles: []roleBinding{{Role: string(EDITOR)}}}
+	admins := &group{Name: "admins", Admins: []primitive.ObjectID{owner.Id}, Roles: []roleBinding{{Role: string(ADMIN)}}}
+	for _, g := range []*group{plain, editors, admins} {
+		if err := db.Groups.Insert(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serveGroup := func(u *user, g *group, h func(web.C, http.ResponseWriter, *http.Request), method string, body string) int {
+		c := web.C{
+			URLParams: map[string]string{"groupId": g.Id.Hex(), "userId": u.Id.Hex()},
+			Env:       map[interface{}]interface{}{"docdb": db, "user": u, "group": g},
+		}
+		w := httptest.NewRecorder()
+		h(c, w, httptest.NewRequest(method, "/api/groups/"+g.Id.Hex(), strings.NewReader(body)))
+		return w.Code
+	}
+
+	if code := serveGroup(owner, editors, apiGroupMemberPostHandler, "POST", ""); code != http.StatusUnauthorized {
+		t.Error("group admin should not gain the roles of the group:", code)
+	}
+	if code := serveGroup(owner, editors, apiGroupPutHandler, "PUT", `{"users":["`+owner.Id.Hex()+`"]}`); code != http.StatusUnauthorized {
+		t.Error("group admin should not set the members of a group with roles:", code)
+	}
+	if g, _ := db.Groups.Get(editors.Id); len(g.Users) != 0 {
+		t.Error("members should be unchanged:", g.Users)
+	}
+	if code := serveGroup(owner, plain, apiGroupMemberPostHandler, "POST", ""); code != http.StatusNoContent {
+		t.Error("group admin should add members to a group without roles:", code)
+	}
+
+	if code := serveGroup(manager, editors, apiGroupMemberPostHandler, "POST", ""); code != http.StatusNoContent {
+		t.Error("group manager should add members to a group with roles:", code)
+	}
+	if code := serveGroup(manager, admins, apiGroupMemberPostHandler, "POST", ""); code != http.StatusUnauthorized {
+		t.Error("only the site admin should add members to a group with managing roles:", code)
+	}
+}
+
+func TestProjectMembership(t *testing.T) {
+	u := &user{Id: primitive.NewObjectID()}
+	p := &project{Members: []primitive.ObjectID{u.Id}}
+
+	if !u.isProjectMember(p) || u.canManageProject(p) {
+		t.Error("member should not manage the project")
+	}
+
+	p.Owners = []primitive.ObjectID{u.Id}
+	if !u.canManageProject(p) {
+		t.Error("owner should manage the project")
+	}
+}
+
+func TestValidatePageAccess(t *testing.T) {
+	if errs := validatePageAccess(&page{Access: PROJECT}); len(errs) != 1 {
+		t.Error("project access without project should be invalid")
+	}
+	if errs := validatePageAccess(&page{Access: PROJECT, Projects: []primitive.ObjectID{primitive.NewObjectID()}}); len(errs) != 0 {
+		t.Error("project access with a project should be valid:", errs)
+	}
+	if errs := validatePageAccess(&page{Access: "secret"}); len(errs) != 1 {
+		t.Error("unknown access level should be invalid")
+	}
+}
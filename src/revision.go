@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bkaradzic/go-lz4"
+	"github.com/zenazn/goji/web"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Revisions are stored as reverse deltas: the body of a revision is a delta
+// from the body of the next newer version, the page itself for the latest
+// revision. One revision in REVISION_SNAPSHOT_INTERVAL keeps its whole body
+// instead, bounding the deltas applied to read a revision.
+const REVISION_SNAPSHOT_INTERVAL = 16
+
+// revision is a previous version of the article of a page, its title and
+// body compressed.
+type revision struct {
+	Id     primitive.ObjectID `bson:"_id"`
+	PageId primitive.ObjectID `bson:"pageid"`
+	Title  []byte             `bson:"title"`
+	// Body is the body of a snapshot, Delta the delta from the next newer
+	// version otherwise.
+	Body   []byte             `bson:"body,omitempty"`
+	Delta  []byte             `bson:"delta,omitempty"`
+	UserId primitive.ObjectID `bson:"userid"`
+	Date   time.Time          `bson:"date"`
+}
+
+func (rev *revision) isSnapshot() bool {
+	return rev.Delta == nil
+}
+
+// member name and hcl name must be same (ignore case)
+type historyconfig struct {
+	History historysettings
+}
+
+// historysettings is the retention of the revisions, applied to a page when
+// it is saved. The zero value keeps every revision.
+type historysettings struct {
+	// Keep_Last keeps at most that many revisions of each page.
+	Keep_Last int
+	// Thin_After_Days keeps only the latest revision of each day among
+	// the revisions older than that many days.
+	Thin_After_Days int
+}
+
+var HistoryConfig historyconfig
+
+// createRevision returns the revision keeping a, replaced by newer. The
+// revision is a snapshot when snapshot is set.
+func (a *article) createRevision(pageId primitive.ObjectID, newer *article, snapshot bool) (*revision, error) {
+	rev := &revision{
+		Id:     primitive.NewObjectID(),
+		PageId: pageId,
+		UserId: a.UserId,
+		Date:   a.Date,
+	}
+
+	var err error
+	if rev.Title, err = encodeFromText(a.Title); err != nil {
+		return nil, err
+	}
+
+	if snapshot {
+		rev.Body, err = encodeFromText(a.Body)
+	} else {
+		rev.Delta, err = lz4.Encode(nil, makeDelta([]byte(newer.Body), []byte(a.Body)))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+// needsSnapshot tells whether the next revision of a page is a snapshot,
+// revs being its revisions the latest first.
+func needsSnapshot(revs []revision) bool {
+	deltas := len(revs)
+	for i := range revs {
+		if revs[i].isSnapshot() {
+			deltas = i
+			break
+		}
+	}
+	return deltas >= REVISION_SNAPSHOT_INTERVAL-1
+}
+
+// revisionBody rebuilds the body of revs[k], revs being the revisions of p
+// the latest first, from the nearest newer snapshot or from p.
+func revisionBody(db *docdb, p *page, revs []revision, k int) (string, error) {
+	start := k
+	for start >= 0 && !revs[start].isSnapshot() {
+		start--
+	}
+
+	body := []byte(p.Article.Body)
+	if start >= 0 {
+		snap, err := db.Revisions.Get(p.Id, revs[start].Id)
+		if err != nil {
+			return "", err
+		}
+		if body, err = lz4.Decode(nil, snap.Body); err != nil {
+			return "", err
+		}
+	}
+
+	for i := start + 1; i <= k; i++ {
+		delta, err := lz4.Decode(nil, revs[i].Delta)
+		if err != nil {
+			return "", err
+		}
+		if body, err = applyDelta(body, delta); err != nil {
+			return "", err
+		}
+	}
+	return string(body), nil
+}
+
+// expiredRevisions returns the revisions dropped by the retention s, revs
+// being the revisions of a page the latest first.
+func expiredRevisions(revs []revision, s historysettings, now time.Time) []primitive.ObjectID {
+	var expired []primitive.ObjectID
+	kept := 0
+	thinBefore := now.AddDate(0, 0, -s.Thin_After_Days)
+	lastDay := ""
+
+	for _, rev := range revs {
+		if s.Keep_Last > 0 && kept >= s.Keep_Last {
+			expired = append(expired, rev.Id)
+			continue
+		}
+
+		if s.Thin_After_Days > 0 && rev.Date.Before(thinBefore) {
+			day := rev.Date.In(siteLocation).Format("2006-01-02")
+			if day == lastDay {
+				expired = append(expired, rev.Id)
+				continue
+			}
+			lastDay = day
+		}
+		kept++
+	}
+	return expired
+}
+
+// pruneRevisions applies the retention of the config to the revisions of
+// the page. A revision losing the newer version its delta is from becomes a
+// snapshot first.
+func pruneRevisions(db *docdb, p *page) error {
+	s := HistoryConfig.History
+	if s.Keep_Last <= 0 && s.Thin_After_Days <= 0 {
+		return nil
+	}
+
+	revs, err := db.Revisions.List(p.Id)
+	if err != nil {
+		return err
+	}
+	expired := expiredRevisions(revs, s, time.Now())
+	if len(expired) == 0 {
+		return nil
+	}
+
+	for i := 1; i < len(revs); i++ {
+		if revs[i].isSnapshot() || !containsId(expired, revs[i-1].Id) || containsId(expired, revs[i].Id) {
+			continue
+		}
+
+		body, err := revisionBody(db, p, revs, i)
+		if err != nil {
+			return err
+		}
+		if revs[i].Body, err = encodeFromText(body); err != nil {
+			return err
+		}
+		revs[i].Delta = nil
+		if err := db.Revisions.Update(&revs[i]); err != nil {
+			return err
+		}
+	}
+	return db.Revisions.Remove(p.Id, expired)
+}
+
+// pageRevision is a revision as the history api shows it.
+type pageRevision struct {
+	Id     primitive.ObjectID `json:"id"`
+	UserId primitive.ObjectID `json:"userId"`
+	Date   time.Time          `json:"date"`
+	Title  string             `json:"title"`
+	Body   string             `json:"body,omitempty"`
+}
+
+// decode returns the revision without its body.
+func (rev *revision) decode() (*pageRevision, error) {
+	title, err := decodeFromBlob(rev.Title)
+	if err != nil {
+		return nil, err
+	}
+	return &pageRevision{Id: rev.Id, UserId: rev.UserId, Date: rev.Date, Title: title}, nil
+}
+
+// getVisiblePage returns the page pageId, or ErrNotFound when u can't read it.
+func getVisiblePage(c web.C, u *user, pageId string) (*page, error) {
+	p, err := getPageFromDb(c, pageId)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok, err := canViewPage(u, getDocDb(c), p); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrNotFound
+	}
+	return p, nil
+}
+
+func apiPageRevisionListGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	user := getSessionUser(c)
+
+	p, err := getVisiblePage(c, user, c.URLParams["pageId"])
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("apiPageRevisionListGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	revs, err := getDocDb(c).Revisions.List(p.Id)
+	if err != nil {
+		log.Println("apiPageRevisionListGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res := []pageRevision{}
+	for i := range revs {
+		pr, err := revs[i].decode()
+		if err != nil {
+			log.Println("apiPageRevisionListGetHandler: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		pr.Date = user.localTime(pr.Date)
+		res = append(res, *pr)
+	}
+
+	js, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func apiPageRevisionGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	user := getSessionUser(c)
+
+	p, err := getVisiblePage(c, user, c.URLParams["pageId"])
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("apiPageRevisionGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !isObjectIdHex(c.URLParams["revisionId"]) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id := objectIdHex(c.URLParams["revisionId"])
+
+	docdb := getDocDb(c)
+	revs, err := docdb.Revisions.List(p.Id)
+	if err != nil {
+		log.Println("apiPageRevisionGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	k := -1
+	for i := range revs {
+		if revs[i].Id == id {
+			k = i
+		}
+	}
+	if k < 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	pr, err := revs[k].decode()
+	if err == nil {
+		pr.Body, err = revisionBody(docdb, p, revs, k)
+	}
+	if err != nil {
+		log.Println("apiPageRevisionGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	pr.Date = user.localTime(pr.Date)
+
+	js, _ := json.Marshal(pr)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestExpiredRevisions(t *testing.T) {
+	now := time.Date(2024, 3, 20, 12, 0, 0, 0, siteLocation)
+	var revs []revision
+	for _, d := range []time.Duration{time.Hour, 2 * time.Hour, 40 * 24 * time.Hour, 40*24*time.Hour + time.Hour, 41 * 24 * time.Hour} {
+		revs = append(revs, revision{Id: primitive.NewObjectID(), Date: now.Add(-d)})
+	}
+
+	if expired := expiredRevisions(revs, historysettings{}, now); len(expired) != 0 {
+		t.Error("every revision should be kept:", expired)
+	}
+
+	expired := expiredRevisions(revs, historysettings{Keep_Last: 2}, now)
+	if len(expired) != 3 || expired[0] != revs[2].Id {
+		t.Error("only the last 2 revisions should be kept:", expired)
+	}
+
+	// the older revisions keep one per day, the latest of it
+	expired = expiredRevisions(revs, historysettings{Thin_After_Days: 30}, now)
+	if len(expired) != 1 || expired[0] != revs[3].Id {
+		t.Error("thinning unexpected:", expired)
+	}
+}
+
+// pageVersions returns n versions of a page of about size bytes, each one
+// editing a line of the previous one.
+func pageVersions(n int, size int) []string {
+	rnd := rand.New(rand.NewSource(1))
+	var lines []string
+	for l := 0; l*40 < size; l++ {
+		lines = append(lines, fmt.Sprintf("line %d of the page, %d\n", l, rnd.Int()))
+	}
+
+	versions := []string{strings.Join(lines, "")}
+	for i := 1; i < n; i++ {
+		l := rnd.Intn(len(lines))
+		lines[l] = fmt.Sprintf("line %d edited by version %d\n", l, i)
+		versions = append(versions, strings.Join(lines, ""))
+	}
+	return versions
+}
+
+// saveVersions saves the versions in turn as the articles of a new page,
+// keeping snapshots only as revisions when lz4 is set.
+func saveVersions(tb testing.TB, db *docdb, versions []string, lz4 bool) *page {
+	now := time.Now()
+	p := &page{Id: primitive.NewObjectID(), Access: PUBLIC, Article: article{Body: versions[0], Date: now}}
+	if err := db.Pages.Insert(p); err != nil {
+		tb.Fatal(err)
+	}
+
+	for i, body := range versions[1:] {
+		newer := article{Body: body, Date: now.Add(time.Duration(i+1) * time.Minute)}
+		revs, err := db.Revisions.List(p.Id)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		rev, err := p.Article.createRevision(p.Id, &newer, lz4 || needsSnapshot(revs))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if err := db.Revisions.Insert(rev); err != nil {
+			tb.Fatal(err)
+		}
+		p.Article = newer
+	}
+	return p
+}
+
+func TestRevisionDeltas(t *testing.T) {
+	db := newMemoryDocDb()
+	versions := pageVersions(40, 2000)
+	p := saveVersions(t, db, versions, false)
+
+	revs, _ := db.Revisions.List(p.Id)
+	snapshots := 0
+	for k := range revs {
+		if revs[k].isSnapshot() {
+			snapshots++
+		}
+		body, err := revisionBody(db, p, revs, k)
+		if err != nil || body != versions[len(versions)-2-k] {
+			t.Fatalf("revision %d rebuilt wrong: %v", k, err)
+		}
+	}
+	if snapshots != 2 {
+		t.Error("a snapshot should be kept every interval:", snapshots)
+	}
+
+	// thinning drops revisions in the middle of the chains
+	defer func(s historysettings) { HistoryConfig.History = s }(HistoryConfig.History)
+	HistoryConfig.History = historysettings{Keep_Last: 30, Thin_After_Days: 1}
+	for k := 5; k < len(revs); k++ {
+		rev, _ := db.Revisions.Get(p.Id, revs[k].Id)
+		rev.Date = time.Now().Add(-time.Duration(48+10*k) * time.Hour)
+		if err := db.Revisions.Update(rev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[primitive.ObjectID]string{}
+	for k := range revs {
+		want[revs[k].Id] = versions[len(versions)-2-k]
+	}
+
+	if err := pruneRevisions(db, p); err != nil {
+		t.Fatal(err)
+	}
+	revs, _ = db.Revisions.List(p.Id)
+	if len(revs) >= 39 {
+		t.Fatal("revisions should be pruned:", len(revs))
+	}
+	for k := range revs {
+		if body, err := revisionBody(db, p, revs, k); err != nil || body != want[revs[k].Id] {
+			t.Fatalf("revision %d rebuilt wrong after pruning: %v", k, err)
+		}
+	}
+}
+
+// revisionsSize returns the bytes the revisions of p take once encoded.
+func revisionsSize(tb testing.TB, db *docdb, p *page) int {
+	revs, _ := db.Revisions.List(p.Id)
+	size := 0
+	for _, r := range revs {
+		rev, _ := db.Revisions.Get(p.Id, r.Id)
+		data, err := bson.Marshal(rev)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		size += len(data)
+	}
+	return size
+}
+
+// benchmarkRevisions compares the revisions kept as lz4 snapshots with the
+// revisions kept as deltas, for 200 edits of a page of 50 kB.
+func benchmarkRevisions(b *testing.B, f func(b *testing.B, db *docdb, p *page, lz4 bool)) {
+	versions := pageVersions(200, 50000)
+	for _, mode := range []string{"lz4", "delta"} {
+		b.Run(mode, func(b *testing.B) {
+			db := newMemoryDocDb()
+			p := saveVersions(b, db, versions, mode == "lz4")
+			size := revisionsSize(b, db, p)
+			b.ResetTimer()
+			f(b, db, p, mode == "lz4")
+			b.ReportMetric(float64(size)/float64(len(versions)-1), "stored-B/rev")
+		})
+	}
+}
+
+func BenchmarkRevisionSave(b *testing.B) {
+	benchmarkRevisions(b, func(b *testing.B, db *docdb, p *page, lz4 bool) {
+		revs, _ := db.Revisions.List(p.Id)
+		newer := p.Article
+		newer.Body = "a new first line\n" + newer.Body
+		for i := 0; i < b.N; i++ {
+			if _, err := p.Article.createRevision(p.Id, &newer, lz4 || needsSnapshot(revs)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkRevisionRead(b *testing.B) {
+	benchmarkRevisions(b, func(b *testing.B, db *docdb, p *page, lz4 bool) {
+		revs, _ := db.Revisions.List(p.Id)
+		for i := 0; i < b.N; i++ {
+			if _, err := revisionBody(db, p, revs, i%len(revs)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestConcurrentSave(t *testing.T) {
+	db := newMemoryDocDb()
+	u := &user{Id: primitive.NewObjectID(), Name: "editor"}
+	c := web.C{Env: map[interface{}]interface{}{"docdb": db, "user": u}}
+	versions := pageVersions(9, 2000)
+	p := &page{Id: primitive.NewObjectID(), Access: PUBLIC,
+		Article: article{Id: primitive.NewObjectID(), Body: versions[0], Date: time.Now()}}
+	if err := db.Pages.Insert(p); err != nil {
+		t.Fatal(err)
+	}
+
+	// every editor saves over the same version of the page
+	errs := make(chan error, len(versions)-1)
+	var wg sync.WaitGroup
+	for _, body := range versions[1:] {
+		wg.Add(1)
+		go func(body string) {
+			defer wg.Done()
+			old := *p
+			newer := *p
+			newer.Article.Body = body
+			errs <- newer.save(c, &old)
+		}(body)
+	}
+	wg.Wait()
+	close(errs)
+
+	saved := 0
+	for err := range errs {
+		if err == nil {
+			saved++
+		} else if err != ErrConflict {
+			t.Fatal(err)
+		}
+	}
+	if saved != 1 {
+		t.Fatal("only one save should win:", saved)
+	}
+
+	stored, _ := db.Pages.Get(p.Id)
+	revs, _ := db.Revisions.List(p.Id)
+	if len(revs) != 1 {
+		t.Fatal("only the winning save should keep a revision:", len(revs))
+	}
+	if body, err := revisionBody(db, stored, revs, 0); err != nil || body != versions[0] {
+		t.Fatal("revision rebuilt wrong:", err)
+	}
+}
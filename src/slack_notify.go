@@ -6,37 +6,18 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
-
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 )
 
 type pageHookSlack struct {
-	db *mgo.Database
+	db *docdb
 }
 
 type SlackNotify struct {
 	Text string `json:"text"`
 }
 
-type slackSettings struct {
-	Id      bson.ObjectId `bson:"_id, omitempty"`
-	Url     string        `bson:"url"`
-	Project bson.ObjectId `bson:"project"`
-}
-
-func storeSlackSetting(slackurl string, p project) {
-	log.Println(slackurl, p)
-}
-
 func (hook pageHookSlack) sendNotify(msg string, p page) {
-	portstr := ""
-	if IroriConfig.Port != 0 {
-		portstr = ":" + strconv.Itoa(IroriConfig.Port)
-	}
-
-	pageurl := fmt.Sprintf("http://%s%s/docs/%s", IroriConfig.HostName, portstr, p.Id.Hex())
+	pageurl := siteURL("/docs/" + p.Id.Hex())
 
 	notify := SlackNotify{
 		Text: fmt.Sprintf("%s\n\n<%s|%s>",
@@ -44,10 +25,10 @@ func (hook pageHookSlack) sendNotify(msg string, p page) {
 
 	js, _ := json.Marshal(notify)
 
-	var projects []project
-	hook.db.C("projects").Find(bson.M{"_id": bson.M{"$in": p.Projects}}).All(&projects)
-	for _, proj := range projects {
-		if proj.SlackURL == "" {
+	for _, pid := range uniqueIds(p.Projects) {
+		proj, err := hook.db.Projects.Get(pid)
+		// archived projects are not notified
+		if err != nil || proj.Archived || proj.SlackURL == "" {
 			continue
 		}
 
@@ -66,27 +47,28 @@ func (hook pageHookSlack) sendNotify(msg string, p page) {
 }
 
 func (hook pageHookSlack) onCreate(p page) {
-	user, err := getUserById(hook.db, p.Author)
+	user, err := hook.db.Users.Get(p.Author)
 
 	if err != nil {
 		log.Println("SlackHook onCreate: ", err)
 		return
 	}
 
-	msg := fmt.Sprintf("記事が%sにより投稿されました", user.Name)
+	// the channel is shared, so notifications use the site language
+	msg := T(siteLocale(), "notify.page_created", user.Name)
 
 	hook.sendNotify(msg, p)
 }
 
 func (hook pageHookSlack) onUpdate(p page) {
-	user, err := getUserById(hook.db, p.Article.UserId)
+	user, err := hook.db.Users.Get(p.Article.UserId)
 
 	if err != nil {
 		log.Println("SlackHook onUpdate: ", err)
 		return
 	}
 
-	msg := fmt.Sprintf("記事が%sにより編集されました", user.Name)
+	msg := T(siteLocale(), "notify.page_updated", user.Name)
 
 	hook.sendNotify(msg, p)
 }
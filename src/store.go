@@ -0,0 +1,397 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	STORAGE_MONGODB = "mongodb"
+	// STORAGE_BOLT keeps every store in one BoltDB file.
+	STORAGE_BOLT = "bolt"
+
+	DEFAULT_BOLT_PATH   = "irori.db"
+	DEFAULT_MONGODB_URL = "mongodb://localhost/irori"
+
+	DEFAULT_QUERY_TIMEOUT = 10 // seconds
+)
+
+// member name and hcl name must be same (ignore case)
+type storageconfig struct {
+	Storage storagesettings
+}
+
+type storagesettings struct {
+	Backend string
+	Path    string
+
+	// MongoDB settings. Timeouts are in seconds, Query_Timeout bounding
+	// each operation on the database.
+	Url             string
+	Query_Timeout   int
+	Connect_Timeout int
+	Max_Pool_Size   int
+	Min_Pool_Size   int
+
+	// Manual_Migrations leaves the pending migrations to "irori migrate"
+	// instead of applying them on startup.
+	Manual_Migrations bool
+}
+
+var StorageConfig storageconfig
+
+// ErrNotFound is returned by the stores for missing documents. It is the
+// driver error so that the queries outside of the stores compare the same way.
+var ErrNotFound = mongo.ErrNoDocuments
+
+// ErrDuplicate is returned when storing a document whose unique key (the
+// user name or email, the group or project name) is already used.
+var ErrDuplicate = errors.New("duplicate key")
+
+// ErrConflict is returned when a document changed since it was read.
+var ErrConflict = errors.New("document changed meanwhile")
+
+// ErrUnsupported is returned by the commands working on the MongoDB
+// database itself when irori runs on the embedded storage.
+var ErrUnsupported = errors.New("not available with the embedded storage")
+
+func (db *docdb) hasMongo() bool {
+	return db.Db != nil
+}
+
+// isObjectIdHex returns whether s is the hex form of an id, as given in urls.
+func isObjectIdHex(s string) bool {
+	_, err := primitive.ObjectIDFromHex(s)
+	return err == nil
+}
+
+// objectIdHex returns the id of the hex form s, the zero id when s is
+// invalid.
+func objectIdHex(s string) primitive.ObjectID {
+	id, _ := primitive.ObjectIDFromHex(s)
+	return id
+}
+
+// PageStore keeps the pages.
+type PageStore interface {
+	Get(id primitive.ObjectID) (*page, error)
+	Insert(p *page) error
+	// Update replaces the article and the access settings of p.
+	Update(p *page) error
+	// Swap is Update when the stored article is still articleId, failing
+	// with ErrConflict otherwise.
+	Swap(p *page, articleId primitive.ObjectID) error
+	Remove(id primitive.ObjectID) error
+	IncViews(id primitive.ObjectID) error
+
+	// Find returns the pages visible with v whose title or body match
+	// every word (a regular expression), the latest edited first.
+	Find(v *pageVisibility, words []string) ([]page, error)
+	FindByAuthor(author primitive.ObjectID) ([]page, error)
+
+	// PullGroup and PullProject detach a removed group or project from
+	// the pages, returning the number of pages changed.
+	PullGroup(gid primitive.ObjectID) (int, error)
+	PullProject(pid primitive.ObjectID) (int, error)
+
+	// ProjectEdits returns the versions, the revisions and the current
+	// article, of the pages of the project visible with v.
+	ProjectEdits(v *pageVisibility, pid primitive.ObjectID) ([]pageEdits, error)
+}
+
+// RevisionStore keeps the previous versions of the pages.
+type RevisionStore interface {
+	Insert(rev *revision) error
+	Get(pageId primitive.ObjectID, id primitive.ObjectID) (*revision, error)
+	// Update replaces a revision, keeping its page.
+	Update(rev *revision) error
+	// List returns the revisions of the page the latest first, without the
+	// body of the snapshots.
+	List(pageId primitive.ObjectID) ([]revision, error)
+	Remove(pageId primitive.ObjectID, ids []primitive.ObjectID) error
+	RemovePage(pageId primitive.ObjectID) error
+}
+
+// AttachmentStore keeps the files attached to the pages.
+type AttachmentStore interface {
+	Insert(a *attachment) error
+	Get(pageId primitive.ObjectID, id primitive.ObjectID) (*attachment, error)
+	RemovePage(pageId primitive.ObjectID) error
+}
+
+// UserStore keeps the user accounts.
+type UserStore interface {
+	Get(id primitive.ObjectID) (*user, error)
+	FindByName(name string) (*user, error)
+	// List returns the users sorted by name.
+	List(includeDisabled bool) ([]user, error)
+	// Count returns how many of ids are existing users.
+	Count(ids []primitive.ObjectID) (int, error)
+	FindByEmail(email string) (*user, error)
+	// Insert adds u unless its email is already registered. Users without
+	// email are not checked.
+	Insert(u *user) error
+	// The setters only change their fields, so that requests changing other
+	// fields of the same user at the same time keep their changes. Those
+	// changing the name or the email fail with ErrDuplicate when another
+	// user has it.
+	SetProfile(id primitive.ObjectID, p userProfile) error
+	SetNameAndEmail(id primitive.ObjectID, name string, email string) error
+	// SetEmail sets the email of the user and drops its pending email.
+	SetEmail(id primitive.ObjectID, email string) error
+	SetPendingEmail(id primitive.ObjectID, email string) error
+	SetTOTP(id primitive.ObjectID, t totpSettings) error
+	SetDisabled(id primitive.ObjectID, disabled bool) error
+	SetPassword(id primitive.ObjectID, hash []byte) error
+	// PullRecoveryCode removes the recovery code hash from the user,
+	// returning whether it was there.
+	PullRecoveryCode(id primitive.ObjectID, hash string) (bool, error)
+	// UseTOTPStep records step as the last time step the user logged in
+	// with, returning false when the user used it or a later one already
+	// or is locked out at t.
+	UseTOTPStep(id primitive.ObjectID, step int64, t time.Time) (bool, error)
+	// AddTOTPFailure counts a wrong authentication code of the user at t,
+	// returning the wrong codes in a row, or ErrTOTPLocked when the user is
+	// locked out at t.
+	AddTOTPFailure(id primitive.ObjectID, t time.Time) (int, error)
+	ResetTOTPFailures(id primitive.ObjectID) error
+	// SetRoles replaces the role bindings of the user and drops the
+	// permissions of before roles.
+	SetRoles(id primitive.ObjectID, bs []roleBinding) error
+	// UnbindProject drops the role bindings scoped to a removed project.
+	UnbindProject(pid primitive.ObjectID) error
+	// UnbindRole drops the bindings of a removed role.
+	UnbindRole(name string) error
+}
+
+// GroupStore keeps the groups.
+type GroupStore interface {
+	Get(id primitive.ObjectID) (*group, error)
+	FindByName(name string) (*group, error)
+	// List returns the groups matching q sorted by name.
+	List(q groupQuery) ([]group, error)
+	// Insert adds g unless its name is already used.
+	Insert(g *group) error
+	// Update saves the name, the users and the admins of g.
+	Update(g *group) error
+	Remove(id primitive.ObjectID) error
+	AddMember(gid primitive.ObjectID, uid primitive.ObjectID) error
+	RemoveMember(gid primitive.ObjectID, uid primitive.ObjectID) error
+	SetRoles(id primitive.ObjectID, bs []roleBinding) error
+	// UnbindProject drops the role bindings scoped to a removed project.
+	UnbindProject(pid primitive.ObjectID) error
+	UnbindRole(name string) error
+}
+
+// ProjectStore keeps the projects.
+type ProjectStore interface {
+	Get(id primitive.ObjectID) (*project, error)
+	FindByName(name string) (*project, error)
+	// List returns the projects matching q sorted by name.
+	List(q projectQuery) ([]project, error)
+	// Insert adds p unless its name is already used.
+	Insert(p *project) error
+	// Update saves the name, the slack url, the members and the owners
+	// of p.
+	Update(p *project) error
+	Remove(id primitive.ObjectID) error
+	AddMember(pid primitive.ObjectID, uid primitive.ObjectID) error
+	RemoveMember(pid primitive.ObjectID, uid primitive.ObjectID) error
+	SetArchived(id primitive.ObjectID, archived bool, at time.Time) error
+}
+
+// AuditStore keeps the audit log entries.
+type AuditStore interface {
+	Insert(e *auditEntry) error
+	Count(f auditFilter) (int, error)
+	// Find returns the entries matching f the latest first, skipping the
+	// first skip ones and returning at most limit.
+	Find(f auditFilter, skip int, limit int) ([]auditEntry, error)
+}
+
+// RoleStore keeps the custom roles, the built-in ones being fixed.
+type RoleStore interface {
+	Get(id primitive.ObjectID) (*role, error)
+	// List returns the roles sorted by name.
+	List() ([]role, error)
+	// Find returns the roles of names, the unknown ones left out.
+	Find(names []string) ([]role, error)
+	// Insert adds r unless its name is already used.
+	Insert(r *role) error
+	// Update saves the permissions of r.
+	Update(r *role) error
+	Remove(id primitive.ObjectID) error
+}
+
+// TokenStore keeps the personal access tokens.
+type TokenStore interface {
+	Insert(t *apiToken) error
+	FindByHash(hash string) (*apiToken, error)
+	// List returns the tokens of the user the latest created first.
+	List(userId primitive.ObjectID) ([]apiToken, error)
+	// Remove deletes the token id of the user.
+	Remove(userId primitive.ObjectID, id primitive.ObjectID) error
+	SetLastUsed(id primitive.ObjectID, at time.Time) error
+}
+
+// PasswordResetStore keeps the password reset tokens.
+type PasswordResetStore interface {
+	Insert(pr *passwordReset) error
+	FindByHash(hash string) (*passwordReset, error)
+	// RemoveUser deletes every reset of the user.
+	RemoveUser(userId primitive.ObjectID) error
+}
+
+// EmailVerificationStore keeps the addresses waiting for verification.
+type EmailVerificationStore interface {
+	Insert(ev *emailVerification) error
+	// Find returns the verification of the token hash for the user.
+	Find(userId primitive.ObjectID, hash string) (*emailVerification, error)
+	RemoveUser(userId primitive.ObjectID) error
+}
+
+// SettingsStore keeps the site settings.
+type SettingsStore interface {
+	// Get returns the settings, the zero value when never saved.
+	Get() (*siteSettings, error)
+	Put(s *siteSettings) error
+}
+
+// groupQuery selects groups by member or admin. The zero value selects
+// every group.
+type groupQuery struct {
+	Member primitive.ObjectID
+}
+
+func (q groupQuery) matches(g *group) bool {
+	return q.Member.IsZero() || containsId(g.Users, q.Member) || containsId(g.Admins, q.Member)
+}
+
+// projectQuery selects projects by member or owner. The zero value selects
+// every project but the archived ones.
+type projectQuery struct {
+	Member primitive.ObjectID
+	// IncludeOpen adds the projects without members, open to everyone.
+	IncludeOpen     bool
+	IncludeArchived bool
+}
+
+func (q projectQuery) matches(p *project) bool {
+	if p.Archived && !q.IncludeArchived {
+		return false
+	}
+	return q.Member.IsZero() || containsId(p.Members, q.Member) || containsId(p.Owners, q.Member) ||
+		(q.IncludeOpen && len(p.Members) == 0)
+}
+
+// pageVisibility describes the pages a user may read: their own pages, the
+// public ones, the pages shared with their groups and the project pages of
+// their projects.
+type pageVisibility struct {
+	User     primitive.ObjectID
+	Groups   []primitive.ObjectID
+	Projects []primitive.ObjectID
+}
+
+func (v *pageVisibility) allows(p *page) bool {
+	if p.Author == v.User || p.Access == PUBLIC {
+		return true
+	}
+	for _, g := range p.Groups {
+		if containsId(v.Groups, g) {
+			return true
+		}
+	}
+	if p.Access == PROJECT {
+		for _, id := range p.Projects {
+			if containsId(v.Projects, id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pageMatcher returns whether a page is visible with v and its title or body
+// match every word, for the stores searching the pages themselves.
+func pageMatcher(v *pageVisibility, words []string) (func(p *page) bool, error) {
+	var res []*regexp.Regexp
+	for _, w := range words {
+		re, err := regexp.Compile(w)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+
+	return func(p *page) bool {
+		if !v.allows(p) {
+			return false
+		}
+		for _, re := range res {
+			if !re.MatchString(p.Article.Title) && !re.MatchString(p.Article.Body) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// sortPagesByDate orders the pages the latest edited first.
+func sortPagesByDate(pages []page) {
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Article.Date.After(pages[j].Article.Date) })
+}
+
+// sortRevisionsByDate orders the revisions the latest first.
+func sortRevisionsByDate(revs []revision) {
+	sort.Slice(revs, func(i, j int) bool { return revs[i].Date.After(revs[j].Date) })
+}
+
+// sortAuditByDate orders the audit entries the latest first.
+func sortAuditByDate(entries []auditEntry) {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Date.After(entries[j].Date) })
+}
+
+// pageAuditEntries returns at most limit entries after the first skip ones.
+func pageAuditEntries(entries []auditEntry, skip int, limit int) []auditEntry {
+	if skip >= len(entries) {
+		return []auditEntry{}
+	}
+	entries = entries[skip:]
+	if limit < len(entries) {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+// sortTokensByCreation orders the tokens the latest created first.
+func sortTokensByCreation(tokens []apiToken) {
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.After(tokens[j].CreatedAt) })
+}
+
+// withoutRole returns the bindings of other roles than name.
+func withoutRole(bs []roleBinding, name string) []roleBinding {
+	var rest []roleBinding
+	for _, b := range bs {
+		if b.Role != name {
+			rest = append(rest, b)
+		}
+	}
+	return rest
+}
+
+// withoutProjectRoles returns the bindings not scoped to pid.
+func withoutProjectRoles(bs []roleBinding, pid primitive.ObjectID) []roleBinding {
+	var rest []roleBinding
+	for _, b := range bs {
+		if b.Project != pid {
+			rest = append(rest, b)
+		}
+	}
+	return rest
+}
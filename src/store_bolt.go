@@ -0,0 +1,1195 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The embedded storage keeps every collection in a bucket of a BoltDB file,
+// the documents encoded in BSON under their id. Queries scan the bucket,
+// which suits the size of a team wiki.
+var (
+	boltPages    = []byte("pages")
+	boltUsers    = []byte("users")
+	boltGroups   = []byte("groups")
+	boltProjects = []byte("projects")
+	boltAudit    = []byte("audit")
+	// boltRevisions and boltAttachments hold a bucket per page id.
+	boltRevisions   = []byte("revisions")
+	boltAttachments = []byte("attachments")
+
+	boltRoles              = []byte("roles")
+	boltTokens             = []byte("tokens")
+	boltPasswordResets     = []byte("passwordresets")
+	boltEmailVerifications = []byte("emailverifications")
+	// boltSettings holds the site settings under SITE_SETTINGS_ID.
+	boltSettings = []byte("settings")
+)
+
+// newBoltDocDb returns the stores kept in the BoltDB file db. Db is nil:
+// the commands working on MongoDB itself are unavailable.
+func newBoltDocDb(db *bolt.DB) (*docdb, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltPages, boltUsers, boltGroups, boltProjects, boltAudit, boltRevisions, boltAttachments,
+			boltRoles, boltTokens, boltPasswordResets, boltEmailVerifications, boltSettings} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return moveBoltHistory(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &docdb{
+		Pages:       boltPageStore{boltBucket{db, boltPages}},
+		Users:       boltUserStore{boltBucket{db, boltUsers}},
+		Groups:      boltGroupStore{boltBucket{db, boltGroups}},
+		Projects:    boltProjectStore{boltBucket{db, boltProjects}},
+		Audit:       boltAuditStore{boltBucket{db, boltAudit}},
+		Revisions:   boltRevisionStore{db},
+		Attachments: boltAttachmentStore{db},
+
+		Roles:              boltRoleStore{boltBucket{db, boltRoles}},
+		Tokens:             boltTokenStore{boltBucket{db, boltTokens}},
+		PasswordResets:     boltPasswordResetStore{boltBucket{db, boltPasswordResets}},
+		EmailVerifications: boltEmailVerificationStore{boltBucket{db, boltEmailVerifications}},
+		Settings:           boltSettingsStore{db},
+	}, nil
+}
+
+// moveBoltHistory moves the history kept in the pages before the revisions
+// had their own bucket.
+func moveBoltHistory(tx *bolt.Tx) error {
+	pages := boltBucket{name: boltPages}
+	var legacy []primitive.ObjectID
+	err := pages.eachTx(tx, func(data []byte) error {
+		var d struct {
+			Id      primitive.ObjectID `bson:"_id"`
+			History []revision         `bson:"history"`
+		}
+		if err := bson.Unmarshal(data, &d); err != nil {
+			return err
+		}
+		if d.History == nil {
+			return nil
+		}
+
+		legacy = append(legacy, d.Id)
+		for i := range d.History {
+			rev := d.History[i]
+			rev.Id = primitive.NewObjectID()
+			rev.PageId = d.Id
+			if err := (boltRevisionStore{}).insertTx(tx, &rev); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// storing the pages back drops their history
+	for _, id := range legacy {
+		var p page
+		if err := pages.getTx(tx, id, &p); err != nil {
+			return err
+		}
+		if err := pages.putTx(tx, id, &p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type boltBucket struct {
+	db   *bolt.DB
+	name []byte
+}
+
+func (b boltBucket) getTx(tx *bolt.Tx, id primitive.ObjectID, v interface{}) error {
+	data := tx.Bucket(b.name).Get(id[:])
+	if data == nil {
+		return ErrNotFound
+	}
+	return bson.Unmarshal(data, v)
+}
+
+func (b boltBucket) putTx(tx *bolt.Tx, id primitive.ObjectID, v interface{}) error {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(b.name).Put(id[:], data)
+}
+
+// eachTx calls f with every document of the bucket.
+func (b boltBucket) eachTx(tx *bolt.Tx, f func(data []byte) error) error {
+	return tx.Bucket(b.name).ForEach(func(k, data []byte) error { return f(data) })
+}
+
+func (b boltBucket) get(id primitive.ObjectID, v interface{}) error {
+	return b.db.View(func(tx *bolt.Tx) error { return b.getTx(tx, id, v) })
+}
+
+func (b boltBucket) each(f func(data []byte) error) error {
+	return b.db.View(func(tx *bolt.Tx) error { return b.eachTx(tx, f) })
+}
+
+// modify loads the document id into v, applies f to it and stores it back.
+func (b boltBucket) modify(id primitive.ObjectID, v interface{}, f func()) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := b.getTx(tx, id, v); err != nil {
+			return err
+		}
+		f()
+		return b.putTx(tx, id, v)
+	})
+}
+
+func (b boltBucket) remove(id primitive.ObjectID) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(b.name)
+		if bk.Get(id[:]) == nil {
+			return ErrNotFound
+		}
+		return bk.Delete(id[:])
+	})
+}
+
+// insertUnique stores v under id unless taken reports that another document
+// already holds its unique key.
+func (b boltBucket) insertUnique(id primitive.ObjectID, v interface{}, taken func(data []byte) (bool, error)) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		err := b.eachTx(tx, func(data []byte) error {
+			t, err := taken(data)
+			if err == nil && t {
+				return ErrDuplicate
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return b.putTx(tx, id, v)
+	})
+}
+
+// namedDoc decodes only the unique keys of users, groups and projects.
+type namedDoc struct {
+	Id    primitive.ObjectID `bson:"_id"`
+	Name  string             `bson:"name"`
+	EMail string             `bson:"email"`
+}
+
+func (b boltBucket) idByName(name string) (primitive.ObjectID, error) {
+	var id primitive.ObjectID
+	err := b.each(func(data []byte) error {
+		var d namedDoc
+		if err := bson.Unmarshal(data, &d); err != nil {
+			return err
+		}
+		if id.IsZero() && d.Name == name {
+			id = d.Id
+		}
+		return nil
+	})
+	if err == nil && id.IsZero() {
+		err = ErrNotFound
+	}
+	return id, err
+}
+
+func nameTaken(name string) func(data []byte) (bool, error) {
+	return func(data []byte) (bool, error) {
+		var d namedDoc
+		err := bson.Unmarshal(data, &d)
+		return d.Name == name, err
+	}
+}
+
+type boltPageStore struct {
+	b boltBucket
+}
+
+func (s boltPageStore) Get(id primitive.ObjectID) (*page, error) {
+	var p page
+	if err := s.b.get(id, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s boltPageStore) Insert(p *page) error {
+	return s.b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(s.b.name).Get(p.Id[:]) != nil {
+			return ErrDuplicate
+		}
+		return s.b.putTx(tx, p.Id, p)
+	})
+}
+
+func (s boltPageStore) Update(p *page) error {
+	var old page
+	return s.b.modify(p.Id, &old, func() {
+		old.Article = p.Article
+		old.Projects = p.Projects
+		old.Access = p.Access
+		old.Groups = p.Groups
+	})
+}
+
+func (s boltPageStore) Swap(p *page, articleId primitive.ObjectID) error {
+	var old page
+	return s.b.db.Update(func(tx *bolt.Tx) error {
+		if err := s.b.getTx(tx, p.Id, &old); err != nil {
+			return err
+		}
+		if old.Article.Id != articleId {
+			return ErrConflict
+		}
+		old.Article = p.Article
+		old.Projects = p.Projects
+		old.Access = p.Access
+		old.Groups = p.Groups
+		return s.b.putTx(tx, p.Id, &old)
+	})
+}
+
+func (s boltPageStore) Remove(id primitive.ObjectID) error {
+	return s.b.remove(id)
+}
+
+func (s boltPageStore) IncViews(id primitive.ObjectID) error {
+	var p page
+	return s.b.modify(id, &p, func() { p.Views++ })
+}
+
+// filter returns the pages matching ok.
+func (s boltPageStore) filter(ok func(p *page) bool) ([]page, error) {
+	var pages []page
+	err := s.b.each(func(data []byte) error {
+		var p page
+		if err := bson.Unmarshal(data, &p); err != nil {
+			return err
+		}
+		if ok(&p) {
+			pages = append(pages, p)
+		}
+		return nil
+	})
+	return pages, err
+}
+
+func (s boltPageStore) Find(v *pageVisibility, words []string) ([]page, error) {
+	match, err := pageMatcher(v, words)
+	if err != nil {
+		return nil, err
+	}
+
+	pages, err := s.filter(match)
+	sortPagesByDate(pages)
+	return pages, err
+}
+
+func (s boltPageStore) FindByAuthor(author primitive.ObjectID) ([]page, error) {
+	return s.filter(func(p *page) bool { return p.Author == author })
+}
+
+// pull removes id from the ids returned by field in every page.
+func (s boltPageStore) pull(id primitive.ObjectID, field func(p *page) *[]primitive.ObjectID) (int, error) {
+	n := 0
+	err := s.b.db.Update(func(tx *bolt.Tx) error {
+		var changed []page
+		err := s.b.eachTx(tx, func(data []byte) error {
+			var p page
+			if err := bson.Unmarshal(data, &p); err != nil {
+				return err
+			}
+			if ids := field(&p); containsId(*ids, id) {
+				*ids = withoutId(*ids, id)
+				changed = append(changed, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// the bucket can't be changed while iterating
+		for i := range changed {
+			if err := s.b.putTx(tx, changed[i].Id, &changed[i]); err != nil {
+				return err
+			}
+		}
+		n = len(changed)
+		return nil
+	})
+	return n, err
+}
+
+func (s boltPageStore) PullGroup(gid primitive.ObjectID) (int, error) {
+	return s.pull(gid, func(p *page) *[]primitive.ObjectID { return &p.Groups })
+}
+
+func (s boltPageStore) PullProject(pid primitive.ObjectID) (int, error) {
+	return s.pull(pid, func(p *page) *[]primitive.ObjectID { return &p.Projects })
+}
+
+func (s boltPageStore) ProjectEdits(v *pageVisibility, pid primitive.ObjectID) ([]pageEdits, error) {
+	pages, err := s.filter(func(p *page) bool { return containsId(p.Projects, pid) && v.allows(p) })
+	if err != nil {
+		return nil, err
+	}
+
+	edits := []pageEdits{}
+	err = s.b.db.View(func(tx *bolt.Tx) error {
+		for _, p := range pages {
+			e := pageEdits{Id: p.Id, Title: p.Article.Title, Views: p.Views, Created: p.Created}
+			if bk := tx.Bucket(boltRevisions).Bucket(p.Id[:]); bk != nil {
+				err := bk.ForEach(func(k, data []byte) error {
+					var rev revision
+					if err := bson.Unmarshal(data, &rev); err != nil {
+						return err
+					}
+					e.Edits = append(e.Edits, pageEdit{UserId: rev.UserId, Date: rev.Date})
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			e.Edits = append(e.Edits, pageEdit{UserId: p.Article.UserId, Date: p.Article.Date})
+			edits = append(edits, e)
+		}
+		return nil
+	})
+	return edits, err
+}
+
+type boltRevisionStore struct {
+	db *bolt.DB
+}
+
+func (s boltRevisionStore) insertTx(tx *bolt.Tx, rev *revision) error {
+	bk, err := tx.Bucket(boltRevisions).CreateBucketIfNotExists(rev.PageId[:])
+	if err != nil {
+		return err
+	}
+
+	data, err := bson.Marshal(rev)
+	if err != nil {
+		return err
+	}
+	return bk.Put(rev.Id[:], data)
+}
+
+func (s boltRevisionStore) Insert(rev *revision) error {
+	return s.db.Update(func(tx *bolt.Tx) error { return s.insertTx(tx, rev) })
+}
+
+func (s boltRevisionStore) Get(pageId primitive.ObjectID, id primitive.ObjectID) (*revision, error) {
+	var rev revision
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(boltRevisions).Bucket(pageId[:])
+		if bk == nil {
+			return ErrNotFound
+		}
+		data := bk.Get(id[:])
+		if data == nil {
+			return ErrNotFound
+		}
+		return bson.Unmarshal(data, &rev)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+func (s boltRevisionStore) Update(rev *revision) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(boltRevisions).Bucket(rev.PageId[:])
+		if bk == nil || bk.Get(rev.Id[:]) == nil {
+			return ErrNotFound
+		}
+		return s.insertTx(tx, rev)
+	})
+}
+
+func (s boltRevisionStore) List(pageId primitive.ObjectID) ([]revision, error) {
+	var revs []revision
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(boltRevisions).Bucket(pageId[:])
+		if bk == nil {
+			return nil
+		}
+		return bk.ForEach(func(k, data []byte) error {
+			var rev revision
+			if err := bson.Unmarshal(data, &rev); err != nil {
+				return err
+			}
+			rev.Body = nil
+			revs = append(revs, rev)
+			return nil
+		})
+	})
+	sortRevisionsByDate(revs)
+	return revs, err
+}
+
+func (s boltRevisionStore) Remove(pageId primitive.ObjectID, ids []primitive.ObjectID) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(boltRevisions).Bucket(pageId[:])
+		if bk == nil {
+			return nil
+		}
+		for _, id := range ids {
+			if err := bk.Delete(id[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s boltRevisionStore) RemovePage(pageId primitive.ObjectID) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltRevisions).DeleteBucket(pageId[:])
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+type boltAttachmentStore struct {
+	db *bolt.DB
+}
+
+func (s boltAttachmentStore) Insert(a *attachment) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.Bucket(boltAttachments).CreateBucketIfNotExists(a.PageId[:])
+		if err != nil {
+			return err
+		}
+
+		data, err := bson.Marshal(a)
+		if err != nil {
+			return err
+		}
+		return bk.Put(a.Id[:], data)
+	})
+}
+
+func (s boltAttachmentStore) Get(pageId primitive.ObjectID, id primitive.ObjectID) (*attachment, error) {
+	var a attachment
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(boltAttachments).Bucket(pageId[:])
+		if bk == nil {
+			return ErrNotFound
+		}
+		data := bk.Get(id[:])
+		if data == nil {
+			return ErrNotFound
+		}
+		return bson.Unmarshal(data, &a)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (s boltAttachmentStore) RemovePage(pageId primitive.ObjectID) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltAttachments).DeleteBucket(pageId[:])
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+type boltUserStore struct {
+	b boltBucket
+}
+
+func (s boltUserStore) Get(id primitive.ObjectID) (*user, error) {
+	var u user
+	if err := s.b.get(id, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s boltUserStore) FindByName(name string) (*user, error) {
+	id, err := s.b.idByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(id)
+}
+
+func (s boltUserStore) List(includeDisabled bool) ([]user, error) {
+	users := []user{}
+	err := s.b.each(func(data []byte) error {
+		var u user
+		if err := bson.Unmarshal(data, &u); err != nil {
+			return err
+		}
+		if includeDisabled || !u.Disabled {
+			users = append(users, u)
+		}
+		return nil
+	})
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users, err
+}
+
+func (s boltUserStore) Count(ids []primitive.ObjectID) (int, error) {
+	n := 0
+	err := s.b.db.View(func(tx *bolt.Tx) error {
+		for _, id := range uniqueIds(ids) {
+			if tx.Bucket(s.b.name).Get(id[:]) != nil {
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (s boltUserStore) Insert(u *user) error {
+	if u.Id.IsZero() {
+		u.Id = primitive.NewObjectID()
+	}
+
+	return s.b.insertUnique(u.Id, u, func(data []byte) (bool, error) {
+		var d namedDoc
+		err := bson.Unmarshal(data, &d)
+		return d.Name == u.Name || (u.EMail != "" && d.EMail == u.EMail), err
+	})
+}
+
+func (s boltUserStore) FindByEmail(email string) (*user, error) {
+	var found *user
+	err := s.b.each(func(data []byte) error {
+		var u user
+		if err := bson.Unmarshal(data, &u); err != nil {
+			return err
+		}
+		if found == nil && u.EMail == email {
+			found = &u
+		}
+		return nil
+	})
+	if err == nil && found == nil {
+		err = ErrNotFound
+	}
+	return found, err
+}
+
+// modifyUnique calls f with the user id, then saves it unless another user
+// has its name or email.
+func (s boltUserStore) modifyUnique(id primitive.ObjectID, f func(u *user)) error {
+	return s.b.db.Update(func(tx *bolt.Tx) error {
+		var u user
+		if err := s.b.getTx(tx, id, &u); err != nil {
+			return err
+		}
+		f(&u)
+		err := s.b.eachTx(tx, func(data []byte) error {
+			var d namedDoc
+			if err := bson.Unmarshal(data, &d); err != nil {
+				return err
+			}
+			if d.Id != u.Id && (d.Name == u.Name || (u.EMail != "" && d.EMail == u.EMail)) {
+				return ErrDuplicate
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return s.b.putTx(tx, id, &u)
+	})
+}
+
+func (s boltUserStore) SetProfile(id primitive.ObjectID, p userProfile) error {
+	return s.modifyUnique(id, func(u *user) { u.Name, u.Timezone, u.Language, u.Bio = p.Name, p.Timezone, p.Language, p.Bio })
+}
+
+func (s boltUserStore) SetNameAndEmail(id primitive.ObjectID, name string, email string) error {
+	return s.modifyUnique(id, func(u *user) { u.Name, u.EMail = name, email })
+}
+
+func (s boltUserStore) SetEmail(id primitive.ObjectID, email string) error {
+	return s.modifyUnique(id, func(u *user) { u.EMail, u.PendingEmail = email, "" })
+}
+
+func (s boltUserStore) SetPendingEmail(id primitive.ObjectID, email string) error {
+	var u user
+	return s.b.modify(id, &u, func() { u.PendingEmail = email })
+}
+
+func (s boltUserStore) SetTOTP(id primitive.ObjectID, t totpSettings) error {
+	var u user
+	return s.b.modify(id, &u, func() { u.setTOTP(t) })
+}
+
+func (s boltUserStore) UseTOTPStep(id primitive.ObjectID, step int64, t time.Time) (bool, error) {
+	var u user
+	used := false
+	err := s.b.modify(id, &u, func() { used = u.useTOTPStep(step, t) })
+	return used && err == nil, err
+}
+
+func (s boltUserStore) SetDisabled(id primitive.ObjectID, disabled bool) error {
+	var u user
+	return s.b.modify(id, &u, func() { u.Disabled = disabled })
+}
+
+func (s boltUserStore) SetPassword(id primitive.ObjectID, hash []byte) error {
+	var u user
+	return s.b.modify(id, &u, func() { u.Password = hash })
+}
+
+func (s boltUserStore) AddTOTPFailure(id primitive.ObjectID, t time.Time) (int, error) {
+	var u user
+	counted := false
+	err := s.b.modify(id, &u, func() { counted = u.addTOTPFailure(t) })
+	if err == nil && !counted {
+		err = ErrTOTPLocked
+	}
+	return u.TOTPFailures, err
+}
+
+func (s boltUserStore) ResetTOTPFailures(id primitive.ObjectID) error {
+	var u user
+	return s.b.modify(id, &u, func() { u.TOTPFailures, u.TOTPFailedAt = 0, time.Time{} })
+}
+
+func (s boltUserStore) PullRecoveryCode(id primitive.ObjectID, hash string) (bool, error) {
+	var u user
+	found := false
+	err := s.b.modify(id, &u, func() {
+		for i, rc := range u.RecoveryCodes {
+			if rc == hash {
+				u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+				found = true
+				return
+			}
+		}
+	})
+	return found, err
+}
+
+func (s boltUserStore) SetRoles(id primitive.ObjectID, bs []roleBinding) error {
+	var u user
+	return s.b.modify(id, &u, func() { u.Roles, u.Permissions = bs, nil })
+}
+
+func (s boltUserStore) UnbindRole(name string) error {
+	users, err := s.List(true)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		if len(withoutRole(u.Roles, name)) == len(u.Roles) {
+			continue
+		}
+		var stored user
+		if err := s.b.modify(u.Id, &stored, func() { stored.Roles = withoutRole(stored.Roles, name) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s boltUserStore) UnbindProject(pid primitive.ObjectID) error {
+	users, err := s.List(true)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		if len(withoutProjectRoles(u.Roles, pid)) == len(u.Roles) {
+			continue
+		}
+		var stored user
+		if err := s.b.modify(u.Id, &stored, func() { stored.Roles = withoutProjectRoles(stored.Roles, pid) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type boltGroupStore struct {
+	b boltBucket
+}
+
+func (s boltGroupStore) Get(id primitive.ObjectID) (*group, error) {
+	var g group
+	if err := s.b.get(id, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (s boltGroupStore) FindByName(name string) (*group, error) {
+	id, err := s.b.idByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(id)
+}
+
+func (s boltGroupStore) List(q groupQuery) ([]group, error) {
+	groups := []group{}
+	err := s.b.each(func(data []byte) error {
+		var g group
+		if err := bson.Unmarshal(data, &g); err != nil {
+			return err
+		}
+		if q.matches(&g) {
+			groups = append(groups, g)
+		}
+		return nil
+	})
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups, err
+}
+
+func (s boltGroupStore) Insert(g *group) error {
+	if g.Id.IsZero() {
+		g.Id = primitive.NewObjectID()
+	}
+	return s.b.insertUnique(g.Id, g, nameTaken(g.Name))
+}
+
+func (s boltGroupStore) Update(g *group) error {
+	var old group
+	return s.b.modify(g.Id, &old, func() {
+		old.Name, old.Users, old.Admins = g.Name, g.Users, g.Admins
+	})
+}
+
+func (s boltGroupStore) Remove(id primitive.ObjectID) error {
+	return s.b.remove(id)
+}
+
+func (s boltGroupStore) AddMember(gid primitive.ObjectID, uid primitive.ObjectID) error {
+	var g group
+	return s.b.modify(gid, &g, func() { g.Users = withId(g.Users, uid) })
+}
+
+func (s boltGroupStore) RemoveMember(gid primitive.ObjectID, uid primitive.ObjectID) error {
+	var g group
+	return s.b.modify(gid, &g, func() { g.Users = withoutId(g.Users, uid) })
+}
+
+func (s boltGroupStore) SetRoles(id primitive.ObjectID, bs []roleBinding) error {
+	var g group
+	return s.b.modify(id, &g, func() { g.Roles = bs })
+}
+
+func (s boltGroupStore) UnbindRole(name string) error {
+	groups, err := s.List(groupQuery{})
+	if err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		if len(withoutRole(g.Roles, name)) == len(g.Roles) {
+			continue
+		}
+		var stored group
+		if err := s.b.modify(g.Id, &stored, func() { stored.Roles = withoutRole(stored.Roles, name) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s boltGroupStore) UnbindProject(pid primitive.ObjectID) error {
+	groups, err := s.List(groupQuery{})
+	if err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		if len(withoutProjectRoles(g.Roles, pid)) == len(g.Roles) {
+			continue
+		}
+		var stored group
+		if err := s.b.modify(g.Id, &stored, func() { stored.Roles = withoutProjectRoles(stored.Roles, pid) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type boltProjectStore struct {
+	b boltBucket
+}
+
+func (s boltProjectStore) Get(id primitive.ObjectID) (*project, error) {
+	var p project
+	if err := s.b.get(id, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s boltProjectStore) FindByName(name string) (*project, error) {
+	id, err := s.b.idByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(id)
+}
+
+func (s boltProjectStore) List(q projectQuery) ([]project, error) {
+	projects := []project{}
+	err := s.b.each(func(data []byte) error {
+		var p project
+		if err := bson.Unmarshal(data, &p); err != nil {
+			return err
+		}
+		if q.matches(&p) {
+			projects = append(projects, p)
+		}
+		return nil
+	})
+	sort.Slice(projects, func(i, j int) bool { return projects[i].Name < projects[j].Name })
+	return projects, err
+}
+
+func (s boltProjectStore) Insert(p *project) error {
+	if p.Id.IsZero() {
+		p.Id = primitive.NewObjectID()
+	}
+	return s.b.insertUnique(p.Id, p, nameTaken(p.Name))
+}
+
+func (s boltProjectStore) Update(p *project) error {
+	var old project
+	return s.b.modify(p.Id, &old, func() {
+		old.Name, old.SlackURL, old.Members, old.Owners = p.Name, p.SlackURL, p.Members, p.Owners
+	})
+}
+
+func (s boltProjectStore) Remove(id primitive.ObjectID) error {
+	return s.b.remove(id)
+}
+
+func (s boltProjectStore) AddMember(pid primitive.ObjectID, uid primitive.ObjectID) error {
+	var p project
+	return s.b.modify(pid, &p, func() { p.Members = withId(p.Members, uid) })
+}
+
+func (s boltProjectStore) RemoveMember(pid primitive.ObjectID, uid primitive.ObjectID) error {
+	var p project
+	return s.b.modify(pid, &p, func() { p.Members = withoutId(p.Members, uid) })
+}
+
+func (s boltProjectStore) SetArchived(id primitive.ObjectID, archived bool, at time.Time) error {
+	var p project
+	return s.b.modify(id, &p, func() {
+		p.Archived = archived
+		p.ArchivedAt = time.Time{}
+		if archived {
+			p.ArchivedAt = at
+		}
+	})
+}
+
+type boltAuditStore struct {
+	b boltBucket
+}
+
+func (s boltAuditStore) Insert(e *auditEntry) error {
+	return s.b.db.Update(func(tx *bolt.Tx) error { return s.b.putTx(tx, e.Id, e) })
+}
+
+func (s boltAuditStore) find(f auditFilter) ([]auditEntry, error) {
+	var entries []auditEntry
+	err := s.b.each(func(data []byte) error {
+		var e auditEntry
+		if err := bson.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		if f.matches(&e) {
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	sortAuditByDate(entries)
+	return entries, err
+}
+
+func (s boltAuditStore) Count(f auditFilter) (int, error) {
+	entries, err := s.find(f)
+	return len(entries), err
+}
+
+func (s boltAuditStore) Find(f auditFilter, skip int, limit int) ([]auditEntry, error) {
+	entries, err := s.find(f)
+	if err != nil {
+		return nil, err
+	}
+	return pageAuditEntries(entries, skip, limit), nil
+}
+
+type boltRoleStore struct {
+	b boltBucket
+}
+
+func (s boltRoleStore) Get(id primitive.ObjectID) (*role, error) {
+	var r role
+	if err := s.b.get(id, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s boltRoleStore) List() ([]role, error) {
+	roles := []role{}
+	err := s.b.each(func(data []byte) error {
+		var r role
+		if err := bson.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		roles = append(roles, r)
+		return nil
+	})
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles, err
+}
+
+func (s boltRoleStore) Find(names []string) ([]role, error) {
+	all, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var roles []role
+	for _, r := range all {
+		for _, name := range names {
+			if r.Name == name {
+				roles = append(roles, r)
+				break
+			}
+		}
+	}
+	return roles, nil
+}
+
+func (s boltRoleStore) Insert(r *role) error {
+	if r.Id.IsZero() {
+		r.Id = primitive.NewObjectID()
+	}
+	return s.b.insertUnique(r.Id, r, nameTaken(r.Name))
+}
+
+func (s boltRoleStore) Update(r *role) error {
+	var old role
+	return s.b.modify(r.Id, &old, func() { old.Permissions = r.Permissions })
+}
+
+func (s boltRoleStore) Remove(id primitive.ObjectID) error {
+	return s.b.remove(id)
+}
+
+type boltTokenStore struct {
+	b boltBucket
+}
+
+func (s boltTokenStore) Insert(t *apiToken) error {
+	if t.Id.IsZero() {
+		t.Id = primitive.NewObjectID()
+	}
+	return s.b.db.Update(func(tx *bolt.Tx) error { return s.b.putTx(tx, t.Id, t) })
+}
+
+// filter returns the tokens matching ok.
+func (s boltTokenStore) filter(ok func(t *apiToken) bool) ([]apiToken, error) {
+	tokens := []apiToken{}
+	err := s.b.each(func(data []byte) error {
+		var t apiToken
+		if err := bson.Unmarshal(data, &t); err != nil {
+			return err
+		}
+		if ok(&t) {
+			tokens = append(tokens, t)
+		}
+		return nil
+	})
+	return tokens, err
+}
+
+func (s boltTokenStore) FindByHash(hash string) (*apiToken, error) {
+	tokens, err := s.filter(func(t *apiToken) bool { return t.Hash == hash })
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, ErrNotFound
+	}
+	return &tokens[0], nil
+}
+
+func (s boltTokenStore) List(userId primitive.ObjectID) ([]apiToken, error) {
+	tokens, err := s.filter(func(t *apiToken) bool { return t.UserId == userId })
+	sortTokensByCreation(tokens)
+	return tokens, err
+}
+
+func (s boltTokenStore) Remove(userId primitive.ObjectID, id primitive.ObjectID) error {
+	return s.b.db.Update(func(tx *bolt.Tx) error {
+		var t apiToken
+		if err := s.b.getTx(tx, id, &t); err != nil {
+			return err
+		}
+		if t.UserId != userId {
+			return ErrNotFound
+		}
+		return tx.Bucket(s.b.name).Delete(id[:])
+	})
+}
+
+func (s boltTokenStore) SetLastUsed(id primitive.ObjectID, at time.Time) error {
+	var t apiToken
+	return s.b.modify(id, &t, func() { t.LastUsed = at })
+}
+
+// removeUser deletes the documents of the bucket whose "userid" is userId.
+func (b boltBucket) removeUser(userId primitive.ObjectID) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var ids []primitive.ObjectID
+		err := b.eachTx(tx, func(data []byte) error {
+			var d struct {
+				Id     primitive.ObjectID `bson:"_id"`
+				UserId primitive.ObjectID `bson:"userid"`
+			}
+			if err := bson.Unmarshal(data, &d); err != nil {
+				return err
+			}
+			if d.UserId == userId {
+				ids = append(ids, d.Id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// the bucket can't be changed while iterating
+		for _, id := range ids {
+			if err := tx.Bucket(b.name).Delete(id[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type boltPasswordResetStore struct {
+	b boltBucket
+}
+
+func (s boltPasswordResetStore) Insert(pr *passwordReset) error {
+	if pr.Id.IsZero() {
+		pr.Id = primitive.NewObjectID()
+	}
+	return s.b.db.Update(func(tx *bolt.Tx) error { return s.b.putTx(tx, pr.Id, pr) })
+}
+
+func (s boltPasswordResetStore) FindByHash(hash string) (*passwordReset, error) {
+	var found *passwordReset
+	err := s.b.each(func(data []byte) error {
+		var pr passwordReset
+		if err := bson.Unmarshal(data, &pr); err != nil {
+			return err
+		}
+		if found == nil && pr.Hash == hash {
+			found = &pr
+		}
+		return nil
+	})
+	if err == nil && found == nil {
+		err = ErrNotFound
+	}
+	return found, err
+}
+
+func (s boltPasswordResetStore) RemoveUser(userId primitive.ObjectID) error {
+	return s.b.removeUser(userId)
+}
+
+type boltEmailVerificationStore struct {
+	b boltBucket
+}
+
+func (s boltEmailVerificationStore) Insert(ev *emailVerification) error {
+	if ev.Id.IsZero() {
+		ev.Id = primitive.NewObjectID()
+	}
+	return s.b.db.Update(func(tx *bolt.Tx) error { return s.b.putTx(tx, ev.Id, ev) })
+}
+
+func (s boltEmailVerificationStore) Find(userId primitive.ObjectID, hash string) (*emailVerification, error) {
+	var found *emailVerification
+	err := s.b.each(func(data []byte) error {
+		var ev emailVerification
+		if err := bson.Unmarshal(data, &ev); err != nil {
+			return err
+		}
+		if found == nil && ev.UserId == userId && ev.Hash == hash {
+			found = &ev
+		}
+		return nil
+	})
+	if err == nil && found == nil {
+		err = ErrNotFound
+	}
+	return found, err
+}
+
+func (s boltEmailVerificationStore) RemoveUser(userId primitive.ObjectID) error {
+	return s.b.removeUser(userId)
+}
+
+type boltSettingsStore struct {
+	db *bolt.DB
+}
+
+func (s boltSettingsStore) Get() (*siteSettings, error) {
+	st := siteSettings{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltSettings).Get([]byte(SITE_SETTINGS_ID))
+		if data == nil {
+			return nil
+		}
+		return bson.Unmarshal(data, &st)
+	})
+	return &st, err
+}
+
+func (s boltSettingsStore) Put(st *siteSettings) error {
+	data, err := bson.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSettings).Put([]byte(SITE_SETTINGS_ID), data)
+	})
+}
@@ -0,0 +1,1044 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newMemoryDocDb returns empty stores kept in memory, for the tests of the
+// handlers.
+func newMemoryDocDb() *docdb {
+	revisions := &memoryRevisionStore{revisions: map[primitive.ObjectID][]revision{}}
+	return &docdb{
+		Pages:       &memoryPageStore{pages: map[primitive.ObjectID]page{}, revisions: revisions},
+		Users:       &memoryUserStore{users: map[primitive.ObjectID]user{}},
+		Groups:      &memoryGroupStore{groups: map[primitive.ObjectID]group{}},
+		Projects:    &memoryProjectStore{projects: map[primitive.ObjectID]project{}},
+		Audit:       &memoryAuditStore{},
+		Revisions:   revisions,
+		Attachments: &memoryAttachmentStore{attachments: map[primitive.ObjectID]attachment{}},
+
+		Roles:              &memoryRoleStore{roles: map[primitive.ObjectID]role{}},
+		Tokens:             &memoryTokenStore{tokens: map[primitive.ObjectID]apiToken{}},
+		PasswordResets:     &memoryPasswordResetStore{resets: map[primitive.ObjectID]passwordReset{}},
+		EmailVerifications: &memoryEmailVerificationStore{verifications: map[primitive.ObjectID]emailVerification{}},
+		Settings:           &memorySettingsStore{},
+	}
+}
+
+// withoutId returns a copy of ids without id.
+func withoutId(ids []primitive.ObjectID, id primitive.ObjectID) []primitive.ObjectID {
+	var rest []primitive.ObjectID
+	for _, i := range ids {
+		if i != id {
+			rest = append(rest, i)
+		}
+	}
+	return rest
+}
+
+// withId returns a copy of ids with id added unless present.
+func withId(ids []primitive.ObjectID, id primitive.ObjectID) []primitive.ObjectID {
+	return uniqueIds(append(append([]primitive.ObjectID{}, ids...), id))
+}
+
+type memoryPageStore struct {
+	mu    sync.Mutex
+	pages map[primitive.ObjectID]page
+	// revisions gives the editors of the previous versions to ProjectEdits.
+	revisions *memoryRevisionStore
+}
+
+func (s *memoryPageStore) Get(id primitive.ObjectID) (*page, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pages[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &p, nil
+}
+
+func (s *memoryPageStore) Insert(p *page) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.pages[p.Id]; ok {
+		return ErrDuplicate
+	}
+	s.pages[p.Id] = *p
+	return nil
+}
+
+func (s *memoryPageStore) Update(p *page) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.pages[p.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	old.Article = p.Article
+	old.Projects = p.Projects
+	old.Access = p.Access
+	old.Groups = p.Groups
+	s.pages[p.Id] = old
+	return nil
+}
+
+func (s *memoryPageStore) Swap(p *page, articleId primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.pages[p.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	if old.Article.Id != articleId {
+		return ErrConflict
+	}
+	old.Article = p.Article
+	old.Projects = p.Projects
+	old.Access = p.Access
+	old.Groups = p.Groups
+	s.pages[p.Id] = old
+	return nil
+}
+
+func (s *memoryPageStore) Remove(id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.pages[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.pages, id)
+	return nil
+}
+
+func (s *memoryPageStore) IncViews(id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pages[id]
+	if !ok {
+		return ErrNotFound
+	}
+	p.Views++
+	s.pages[id] = p
+	return nil
+}
+
+// filter returns the pages matching ok.
+func (s *memoryPageStore) filter(ok func(p *page) bool) []page {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pages []page
+	for _, p := range s.pages {
+		if ok(&p) {
+			pages = append(pages, p)
+		}
+	}
+	return pages
+}
+
+func (s *memoryPageStore) Find(v *pageVisibility, words []string) ([]page, error) {
+	match, err := pageMatcher(v, words)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := s.filter(match)
+	sortPagesByDate(pages)
+	return pages, nil
+}
+
+func (s *memoryPageStore) FindByAuthor(author primitive.ObjectID) ([]page, error) {
+	return s.filter(func(p *page) bool { return p.Author == author }), nil
+}
+
+func (s *memoryPageStore) PullGroup(gid primitive.ObjectID) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for id, p := range s.pages {
+		if containsId(p.Groups, gid) {
+			p.Groups = withoutId(p.Groups, gid)
+			s.pages[id] = p
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryPageStore) PullProject(pid primitive.ObjectID) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for id, p := range s.pages {
+		if containsId(p.Projects, pid) {
+			p.Projects = withoutId(p.Projects, pid)
+			s.pages[id] = p
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryPageStore) ProjectEdits(v *pageVisibility, pid primitive.ObjectID) ([]pageEdits, error) {
+	pages := s.filter(func(p *page) bool { return containsId(p.Projects, pid) && v.allows(p) })
+
+	s.revisions.mu.Lock()
+	defer s.revisions.mu.Unlock()
+
+	edits := []pageEdits{}
+	for _, p := range pages {
+		e := pageEdits{Id: p.Id, Title: p.Article.Title, Views: p.Views, Created: p.Created}
+		for _, rev := range s.revisions.revisions[p.Id] {
+			e.Edits = append(e.Edits, pageEdit{UserId: rev.UserId, Date: rev.Date})
+		}
+		e.Edits = append(e.Edits, pageEdit{UserId: p.Article.UserId, Date: p.Article.Date})
+		edits = append(edits, e)
+	}
+	return edits, nil
+}
+
+type memoryRevisionStore struct {
+	mu        sync.Mutex
+	revisions map[primitive.ObjectID][]revision
+}
+
+func (s *memoryRevisionStore) Insert(rev *revision) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revisions[rev.PageId] = append(s.revisions[rev.PageId], *rev)
+	return nil
+}
+
+func (s *memoryRevisionStore) Get(pageId primitive.ObjectID, id primitive.ObjectID) (*revision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rev := range s.revisions[pageId] {
+		if rev.Id == id {
+			return &rev, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryRevisionStore) Update(rev *revision) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.revisions[rev.PageId] {
+		if s.revisions[rev.PageId][i].Id == rev.Id {
+			s.revisions[rev.PageId][i] = *rev
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memoryRevisionStore) List(pageId primitive.ObjectID) ([]revision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var revs []revision
+	for _, rev := range s.revisions[pageId] {
+		rev.Body = nil
+		revs = append(revs, rev)
+	}
+	sortRevisionsByDate(revs)
+	return revs, nil
+}
+
+func (s *memoryRevisionStore) Remove(pageId primitive.ObjectID, ids []primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rest []revision
+	for _, rev := range s.revisions[pageId] {
+		if !containsId(ids, rev.Id) {
+			rest = append(rest, rev)
+		}
+	}
+	s.revisions[pageId] = rest
+	return nil
+}
+
+func (s *memoryRevisionStore) RemovePage(pageId primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.revisions, pageId)
+	return nil
+}
+
+type memoryUserStore struct {
+	mu    sync.Mutex
+	users map[primitive.ObjectID]user
+}
+
+func (s *memoryUserStore) Get(id primitive.ObjectID) (*user, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &u, nil
+}
+
+func (s *memoryUserStore) FindByName(name string) (*user, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Name == name {
+			return &u, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryUserStore) List(includeDisabled bool) ([]user, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := []user{}
+	for _, u := range s.users {
+		if includeDisabled || !u.Disabled {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users, nil
+}
+
+func (s *memoryUserStore) FindByEmail(email string) (*user, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.EMail == email {
+			return &u, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryUserStore) Count(ids []primitive.ObjectID) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, id := range uniqueIds(ids) {
+		if _, ok := s.users[id]; ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryUserStore) Insert(u *user) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, other := range s.users {
+		if other.Name == u.Name || (u.EMail != "" && other.EMail == u.EMail) {
+			return ErrDuplicate
+		}
+	}
+	if u.Id.IsZero() {
+		u.Id = primitive.NewObjectID()
+	}
+	s.users[u.Id] = *u
+	return nil
+}
+
+func (s *memoryUserStore) update(id primitive.ObjectID, f func(u *user)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	f(&u)
+	s.users[id] = u
+	return nil
+}
+
+// updateUnique is update, unless another user then has the name or the
+// email of the user.
+func (s *memoryUserStore) updateUnique(id primitive.ObjectID, f func(u *user)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	f(&u)
+	for other, o := range s.users {
+		if other != id && (o.Name == u.Name || (u.EMail != "" && o.EMail == u.EMail)) {
+			return ErrDuplicate
+		}
+	}
+	s.users[id] = u
+	return nil
+}
+
+func (s *memoryUserStore) SetProfile(id primitive.ObjectID, p userProfile) error {
+	return s.updateUnique(id, func(u *user) { u.Name, u.Timezone, u.Language, u.Bio = p.Name, p.Timezone, p.Language, p.Bio })
+}
+
+func (s *memoryUserStore) SetNameAndEmail(id primitive.ObjectID, name string, email string) error {
+	return s.updateUnique(id, func(u *user) { u.Name, u.EMail = name, email })
+}
+
+func (s *memoryUserStore) SetEmail(id primitive.ObjectID, email string) error {
+	return s.updateUnique(id, func(u *user) { u.EMail, u.PendingEmail = email, "" })
+}
+
+func (s *memoryUserStore) SetPendingEmail(id primitive.ObjectID, email string) error {
+	return s.update(id, func(u *user) { u.PendingEmail = email })
+}
+
+func (s *memoryUserStore) SetTOTP(id primitive.ObjectID, t totpSettings) error {
+	return s.update(id, func(u *user) { u.setTOTP(t) })
+}
+
+func (s *memoryUserStore) UseTOTPStep(id primitive.ObjectID, step int64, t time.Time) (bool, error) {
+	used := false
+	err := s.update(id, func(u *user) { used = u.useTOTPStep(step, t) })
+	return used && err == nil, err
+}
+
+func (s *memoryUserStore) SetDisabled(id primitive.ObjectID, disabled bool) error {
+	return s.update(id, func(u *user) { u.Disabled = disabled })
+}
+
+func (s *memoryUserStore) SetPassword(id primitive.ObjectID, hash []byte) error {
+	return s.update(id, func(u *user) { u.Password = hash })
+}
+
+func (s *memoryUserStore) AddTOTPFailure(id primitive.ObjectID, t time.Time) (int, error) {
+	n, counted := 0, false
+	err := s.update(id, func(u *user) {
+		counted = u.addTOTPFailure(t)
+		n = u.TOTPFailures
+	})
+	if err == nil && !counted {
+		err = ErrTOTPLocked
+	}
+	return n, err
+}
+
+func (s *memoryUserStore) ResetTOTPFailures(id primitive.ObjectID) error {
+	return s.update(id, func(u *user) { u.TOTPFailures, u.TOTPFailedAt = 0, time.Time{} })
+}
+
+func (s *memoryUserStore) UnbindProject(pid primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, u := range s.users {
+		u.Roles = withoutProjectRoles(u.Roles, pid)
+		s.users[id] = u
+	}
+	return nil
+}
+
+func (s *memoryUserStore) PullRecoveryCode(id primitive.ObjectID, hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return false, ErrNotFound
+	}
+	for i, rc := range u.RecoveryCodes {
+		if rc == hash {
+			u.RecoveryCodes = append(append([]string{}, u.RecoveryCodes[:i]...), u.RecoveryCodes[i+1:]...)
+			s.users[id] = u
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryUserStore) SetRoles(id primitive.ObjectID, bs []roleBinding) error {
+	return s.update(id, func(u *user) { u.Roles, u.Permissions = bs, nil })
+}
+
+func (s *memoryUserStore) UnbindRole(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, u := range s.users {
+		u.Roles = withoutRole(u.Roles, name)
+		s.users[id] = u
+	}
+	return nil
+}
+
+type memoryGroupStore struct {
+	mu     sync.Mutex
+	groups map[primitive.ObjectID]group
+}
+
+func (s *memoryGroupStore) Get(id primitive.ObjectID) (*group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g, ok := s.groups[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &g, nil
+}
+
+func (s *memoryGroupStore) FindByName(name string) (*group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, g := range s.groups {
+		if g.Name == name {
+			return &g, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryGroupStore) List(q groupQuery) ([]group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	groups := []group{}
+	for _, g := range s.groups {
+		if q.matches(&g) {
+			groups = append(groups, g)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups, nil
+}
+
+func (s *memoryGroupStore) Insert(g *group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, other := range s.groups {
+		if other.Name == g.Name {
+			return ErrDuplicate
+		}
+	}
+	if g.Id.IsZero() {
+		g.Id = primitive.NewObjectID()
+	}
+	s.groups[g.Id] = *g
+	return nil
+}
+
+func (s *memoryGroupStore) update(id primitive.ObjectID, f func(g *group)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g, ok := s.groups[id]
+	if !ok {
+		return ErrNotFound
+	}
+	f(&g)
+	s.groups[id] = g
+	return nil
+}
+
+func (s *memoryGroupStore) Update(g *group) error {
+	return s.update(g.Id, func(old *group) {
+		old.Name, old.Users, old.Admins = g.Name, g.Users, g.Admins
+	})
+}
+
+func (s *memoryGroupStore) Remove(id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.groups[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.groups, id)
+	return nil
+}
+
+func (s *memoryGroupStore) AddMember(gid primitive.ObjectID, uid primitive.ObjectID) error {
+	return s.update(gid, func(g *group) { g.Users = withId(g.Users, uid) })
+}
+
+func (s *memoryGroupStore) RemoveMember(gid primitive.ObjectID, uid primitive.ObjectID) error {
+	return s.update(gid, func(g *group) { g.Users = withoutId(g.Users, uid) })
+}
+
+func (s *memoryGroupStore) UnbindProject(pid primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, g := range s.groups {
+		g.Roles = withoutProjectRoles(g.Roles, pid)
+		s.groups[id] = g
+	}
+	return nil
+}
+
+func (s *memoryGroupStore) SetRoles(id primitive.ObjectID, bs []roleBinding) error {
+	return s.update(id, func(g *group) { g.Roles = bs })
+}
+
+func (s *memoryGroupStore) UnbindRole(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, g := range s.groups {
+		g.Roles = withoutRole(g.Roles, name)
+		s.groups[id] = g
+	}
+	return nil
+}
+
+type memoryProjectStore struct {
+	mu       sync.Mutex
+	projects map[primitive.ObjectID]project
+}
+
+func (s *memoryProjectStore) Get(id primitive.ObjectID) (*project, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.projects[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &p, nil
+}
+
+func (s *memoryProjectStore) FindByName(name string) (*project, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.projects {
+		if p.Name == name {
+			return &p, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryProjectStore) List(q projectQuery) ([]project, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	projects := []project{}
+	for _, p := range s.projects {
+		if q.matches(&p) {
+			projects = append(projects, p)
+		}
+	}
+	sort.Slice(projects, func(i, j int) bool { return projects[i].Name < projects[j].Name })
+	return projects, nil
+}
+
+func (s *memoryProjectStore) Insert(p *project) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, other := range s.projects {
+		if other.Name == p.Name {
+			return ErrDuplicate
+		}
+	}
+	if p.Id.IsZero() {
+		p.Id = primitive.NewObjectID()
+	}
+	s.projects[p.Id] = *p
+	return nil
+}
+
+func (s *memoryProjectStore) update(id primitive.ObjectID, f func(p *project)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.projects[id]
+	if !ok {
+		return ErrNotFound
+	}
+	f(&p)
+	s.projects[id] = p
+	return nil
+}
+
+func (s *memoryProjectStore) Update(p *project) error {
+	return s.update(p.Id, func(old *project) {
+		old.Name, old.SlackURL, old.Members, old.Owners = p.Name, p.SlackURL, p.Members, p.Owners
+	})
+}
+
+func (s *memoryProjectStore) Remove(id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.projects[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.projects, id)
+	return nil
+}
+
+func (s *memoryProjectStore) AddMember(pid primitive.ObjectID, uid primitive.ObjectID) error {
+	return s.update(pid, func(p *project) { p.Members = withId(p.Members, uid) })
+}
+
+func (s *memoryProjectStore) RemoveMember(pid primitive.ObjectID, uid primitive.ObjectID) error {
+	return s.update(pid, func(p *project) { p.Members = withoutId(p.Members, uid) })
+}
+
+func (s *memoryProjectStore) SetArchived(id primitive.ObjectID, archived bool, at time.Time) error {
+	return s.update(id, func(p *project) {
+		p.Archived = archived
+		p.ArchivedAt = time.Time{}
+		if archived {
+			p.ArchivedAt = at
+		}
+	})
+}
+
+type memoryAttachmentStore struct {
+	mu          sync.Mutex
+	attachments map[primitive.ObjectID]attachment
+}
+
+func (s *memoryAttachmentStore) Insert(a *attachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attachments[a.Id] = *a
+	return nil
+}
+
+func (s *memoryAttachmentStore) Get(pageId primitive.ObjectID, id primitive.ObjectID) (*attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.attachments[id]
+	if !ok || a.PageId != pageId {
+		return nil, ErrNotFound
+	}
+	return &a, nil
+}
+
+func (s *memoryAttachmentStore) RemovePage(pageId primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, a := range s.attachments {
+		if a.PageId == pageId {
+			delete(s.attachments, id)
+		}
+	}
+	return nil
+}
+
+type memoryAuditStore struct {
+	mu      sync.Mutex
+	entries []auditEntry
+}
+
+func (s *memoryAuditStore) Insert(e *auditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = append(s.entries, *e)
+	return nil
+}
+
+func (s *memoryAuditStore) find(f auditFilter) []auditEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entries []auditEntry
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		if f.matches(&s.entries[i]) {
+			entries = append(entries, s.entries[i])
+		}
+	}
+	sortAuditByDate(entries)
+	return entries
+}
+
+func (s *memoryAuditStore) Count(f auditFilter) (int, error) {
+	return len(s.find(f)), nil
+}
+
+func (s *memoryAuditStore) Find(f auditFilter, skip int, limit int) ([]auditEntry, error) {
+	return pageAuditEntries(s.find(f), skip, limit), nil
+}
+
+type memoryRoleStore struct {
+	mu    sync.Mutex
+	roles map[primitive.ObjectID]role
+}
+
+func (s *memoryRoleStore) Get(id primitive.ObjectID) (*role, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.roles[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &r, nil
+}
+
+func (s *memoryRoleStore) List() ([]role, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	roles := []role{}
+	for _, r := range s.roles {
+		roles = append(roles, r)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles, nil
+}
+
+func (s *memoryRoleStore) Find(names []string) ([]role, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var roles []role
+	for _, r := range s.roles {
+		for _, name := range names {
+			if r.Name == name {
+				roles = append(roles, r)
+				break
+			}
+		}
+	}
+	return roles, nil
+}
+
+func (s *memoryRoleStore) Insert(r *role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, other := range s.roles {
+		if other.Name == r.Name {
+			return ErrDuplicate
+		}
+	}
+	if r.Id.IsZero() {
+		r.Id = primitive.NewObjectID()
+	}
+	s.roles[r.Id] = *r
+	return nil
+}
+
+func (s *memoryRoleStore) Update(r *role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.roles[r.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	old.Permissions = r.Permissions
+	s.roles[r.Id] = old
+	return nil
+}
+
+func (s *memoryRoleStore) Remove(id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.roles[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.roles, id)
+	return nil
+}
+
+type memoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[primitive.ObjectID]apiToken
+}
+
+func (s *memoryTokenStore) Insert(t *apiToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t.Id.IsZero() {
+		t.Id = primitive.NewObjectID()
+	}
+	s.tokens[t.Id] = *t
+	return nil
+}
+
+func (s *memoryTokenStore) FindByHash(hash string) (*apiToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.tokens {
+		if t.Hash == hash {
+			return &t, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryTokenStore) List(userId primitive.ObjectID) ([]apiToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := []apiToken{}
+	for _, t := range s.tokens {
+		if t.UserId == userId {
+			tokens = append(tokens, t)
+		}
+	}
+	sortTokensByCreation(tokens)
+	return tokens, nil
+}
+
+func (s *memoryTokenStore) Remove(userId primitive.ObjectID, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.tokens[id]; !ok || t.UserId != userId {
+		return ErrNotFound
+	}
+	delete(s.tokens, id)
+	return nil
+}
+
+func (s *memoryTokenStore) SetLastUsed(id primitive.ObjectID, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[id]
+	if !ok {
+		return ErrNotFound
+	}
+	t.LastUsed = at
+	s.tokens[id] = t
+	return nil
+}
+
+type memoryPasswordResetStore struct {
+	mu     sync.Mutex
+	resets map[primitive.ObjectID]passwordReset
+}
+
+func (s *memoryPasswordResetStore) Insert(pr *passwordReset) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pr.Id.IsZero() {
+		pr.Id = primitive.NewObjectID()
+	}
+	s.resets[pr.Id] = *pr
+	return nil
+}
+
+func (s *memoryPasswordResetStore) FindByHash(hash string) (*passwordReset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pr := range s.resets {
+		if pr.Hash == hash {
+			return &pr, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryPasswordResetStore) RemoveUser(userId primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, pr := range s.resets {
+		if pr.UserId == userId {
+			delete(s.resets, id)
+		}
+	}
+	return nil
+}
+
+type memoryEmailVerificationStore struct {
+	mu            sync.Mutex
+	verifications map[primitive.ObjectID]emailVerification
+}
+
+func (s *memoryEmailVerificationStore) Insert(ev *emailVerification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ev.Id.IsZero() {
+		ev.Id = primitive.NewObjectID()
+	}
+	s.verifications[ev.Id] = *ev
+	return nil
+}
+
+func (s *memoryEmailVerificationStore) Find(userId primitive.ObjectID, hash string) (*emailVerification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ev := range s.verifications {
+		if ev.UserId == userId && ev.Hash == hash {
+			return &ev, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryEmailVerificationStore) RemoveUser(userId primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, ev := range s.verifications {
+		if ev.UserId == userId {
+			delete(s.verifications, id)
+		}
+	}
+	return nil
+}
+
+type memorySettingsStore struct {
+	mu       sync.Mutex
+	settings siteSettings
+}
+
+func (s *memorySettingsStore) Get() (*siteSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := s.settings
+	return &st, nil
+}
+
+func (s *memorySettingsStore) Put(st *siteSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.settings = *st
+	return nil
+}
@@ -0,0 +1,883 @@
+package main
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+)
+
+// connectMongo connects to the MongoDB database configured in s, or given by
+// MONGODB_URL.
+func connectMongo(s storagesettings) (*mongo.Client, *mongo.Database, error) {
+	url := os.Getenv("MONGODB_URL")
+	if url == "" {
+		url = s.Url
+	}
+	if url == "" {
+		url = DEFAULT_MONGODB_URL
+	}
+	if !strings.Contains(url, "://") {
+		// urls without scheme as mgo took them
+		url = "mongodb://" + url
+	}
+
+	cs, err := connstring.ParseAndValidate(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	name := cs.Database
+	if name == "" {
+		name = "irori"
+	}
+
+	timeout := s.Query_Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_QUERY_TIMEOUT
+	}
+
+	opts := options.Client().ApplyURI(url).
+		SetTimeout(time.Duration(timeout) * time.Second).
+		// read and write documents as mgo did, so that the existing data and
+		// the audit summaries stay the same
+		SetBSONOptions(&options.BSONOptions{NilSliceAsEmpty: true, UseLocalTimeZone: true, DefaultDocumentM: true})
+	if s.Connect_Timeout > 0 {
+		opts.SetConnectTimeout(time.Duration(s.Connect_Timeout) * time.Second)
+	}
+	if s.Max_Pool_Size > 0 {
+		opts.SetMaxPoolSize(uint64(s.Max_Pool_Size))
+	}
+	if s.Min_Pool_Size > 0 {
+		opts.SetMinPoolSize(uint64(s.Min_Pool_Size))
+	}
+
+	client, err := mongo.Connect(context.Background(), opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := client.Ping(context.Background(), nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, nil, err
+	}
+	return client, client.Database(name), nil
+}
+
+// withContext returns the stores of db running their queries with ctx, the
+// context of a request. The embedded stores don't take a context.
+func (db *docdb) withContext(ctx context.Context) *docdb {
+	if !db.hasMongo() {
+		return db
+	}
+	return newMongoDocDb(db.Db, ctx)
+}
+
+// newMongoDocDb returns the stores kept in the MongoDB database db, running
+// their queries with ctx.
+func newMongoDocDb(db *mongo.Database, ctx context.Context) *docdb {
+	coll := func(name string) mongoCollection {
+		return mongoCollection{db.Collection(name), ctx}
+	}
+
+	return &docdb{
+		Db:          db,
+		Ctx:         ctx,
+		Pages:       mongoPageStore{coll("pages")},
+		Users:       mongoUserStore{coll("users")},
+		Groups:      mongoGroupStore{coll("groups")},
+		Projects:    mongoProjectStore{coll("projects")},
+		Audit:       mongoAuditStore{coll("audit")},
+		Revisions:   mongoRevisionStore{coll("revisions")},
+		Attachments: mongoAttachmentStore{coll("attachments")},
+
+		Roles:              mongoRoleStore{coll("roles")},
+		Tokens:             mongoTokenStore{coll("tokens")},
+		PasswordResets:     mongoPasswordResetStore{coll("passwordresets")},
+		EmailVerifications: mongoEmailVerificationStore{coll("emailverifications")},
+		Settings:           mongoSettingsStore{coll("settings")},
+	}
+}
+
+// mongoCollection is a collection bound to the context of a request.
+type mongoCollection struct {
+	c   *mongo.Collection
+	ctx context.Context
+}
+
+func (m mongoCollection) findId(id interface{}, v interface{}) error {
+	return m.c.FindOne(m.ctx, bson.M{"_id": id}).Decode(v)
+}
+
+func (m mongoCollection) findOne(filter bson.M, v interface{}) error {
+	return m.c.FindOne(m.ctx, filter).Decode(v)
+}
+
+func (m mongoCollection) findAll(filter bson.M, v interface{}, opts ...*options.FindOptions) error {
+	cur, err := m.c.Find(m.ctx, filter, opts...)
+	if err != nil {
+		return err
+	}
+	return cur.All(m.ctx, v)
+}
+
+// insert inserts doc, failing with ErrDuplicate when a unique index already
+// has its key.
+func (m mongoCollection) insert(doc interface{}) error {
+	_, err := m.c.InsertOne(m.ctx, doc)
+	return duplicateError(err)
+}
+
+// duplicateError maps the duplicate key errors of the unique indexes to
+// ErrDuplicate.
+func duplicateError(err error) error {
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// updateId updates the document id, failing with ErrNotFound when it is
+// missing.
+func (m mongoCollection) updateId(id primitive.ObjectID, update bson.M) error {
+	res, err := m.c.UpdateByID(m.ctx, id, update)
+	if err == nil && res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return duplicateError(err)
+}
+
+// replaceId replaces the document id by doc, failing with ErrNotFound when
+// it is missing.
+func (m mongoCollection) replaceId(id primitive.ObjectID, doc interface{}) error {
+	res, err := m.c.ReplaceOne(m.ctx, bson.M{"_id": id}, doc)
+	if err == nil && res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return duplicateError(err)
+}
+
+func (m mongoCollection) removeId(id primitive.ObjectID) error {
+	return m.remove(bson.M{"_id": id})
+}
+
+// C returns the collection name bound to the context of db, for the
+// migrations and the commands working on the database itself.
+func (db *docdb) C(name string) mongoCollection {
+	return mongoCollection{db.Db.Collection(name), db.Ctx}
+}
+
+func (m mongoCollection) count(filter bson.M) (int, error) {
+	n, err := m.c.CountDocuments(m.ctx, filter)
+	return int(n), err
+}
+
+func (m mongoCollection) aggregate(pipeline interface{}, v interface{}) error {
+	cur, err := m.c.Aggregate(m.ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	return cur.All(m.ctx, v)
+}
+
+// remove deletes one document matching filter, failing with ErrNotFound
+// when there is none.
+func (m mongoCollection) remove(filter bson.M) error {
+	res, err := m.c.DeleteOne(m.ctx, filter)
+	if err == nil && res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (m mongoCollection) removeAll(filter bson.M) (int, error) {
+	res, err := m.c.DeleteMany(m.ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+// updateAll updates the documents matching filter, returning how many were
+// changed.
+func (m mongoCollection) updateAll(filter bson.M, update bson.M) (int, error) {
+	res, err := m.c.UpdateMany(m.ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.ModifiedCount), nil
+}
+
+func (m mongoCollection) upsertId(id interface{}, update bson.M) error {
+	_, err := m.c.UpdateByID(m.ctx, id, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// sortBy returns the options listing the documents in the order of key,
+// descending when it starts with '-'.
+func sortBy(key string) *options.FindOptions {
+	order := 1
+	if key[0] == '-' {
+		key, order = key[1:], -1
+	}
+	return options.Find().SetSort(bson.D{{Key: key, Value: order}})
+}
+
+type mongoPageStore struct {
+	mongoCollection
+}
+
+func (s mongoPageStore) Get(id primitive.ObjectID) (*page, error) {
+	p := page{}
+	if err := s.findId(id, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s mongoPageStore) Insert(p *page) error {
+	return s.insert(p)
+}
+
+func (s mongoPageStore) Update(p *page) error {
+	return s.updateId(p.Id,
+		bson.M{"$set": bson.M{"article": p.Article, "projects": p.Projects, "access": p.Access, "groups": p.Groups}})
+}
+
+func (s mongoPageStore) Swap(p *page, articleId primitive.ObjectID) error {
+	filter := bson.M{"_id": p.Id, "article._id": articleId}
+	if articleId.IsZero() {
+		filter["article._id"] = bson.M{"$exists": false}
+	}
+	res, err := s.c.UpdateOne(s.ctx, filter,
+		bson.M{"$set": bson.M{"article": p.Article, "projects": p.Projects, "access": p.Access, "groups": p.Groups}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		if _, err := s.Get(p.Id); err != nil {
+			return err
+		}
+		return ErrConflict
+	}
+	return nil
+}
+
+func (s mongoPageStore) Remove(id primitive.ObjectID) error {
+	return s.removeId(id)
+}
+
+func (s mongoPageStore) IncViews(id primitive.ObjectID) error {
+	return s.updateId(id, bson.M{"$inc": bson.M{"views": 1}})
+}
+
+// filter is the condition selecting the pages visible with v.
+func (v *pageVisibility) filter() bson.M {
+	return bson.M{"$or": []interface{}{
+		bson.M{"author": v.User},         // user is author
+		bson.M{"access": string(PUBLIC)}, // Access level public
+		bson.M{"groups": bson.M{"$in": v.Groups}},
+		bson.M{"access": string(PROJECT), "projects": bson.M{"$in": v.Projects}},
+	}}
+}
+
+func (s mongoPageStore) Find(v *pageVisibility, words []string) ([]page, error) {
+	cond := v.filter()
+
+	if len(words) > 0 {
+		// FIXME: is sanitize necessary?
+		query := []interface{}{cond}
+		for _, w := range words {
+			re := bson.M{"$regex": w}
+			query = append(query, bson.M{"$or": []interface{}{
+				bson.M{"article.title": re},
+				bson.M{"article.body": re}}})
+		}
+		cond = bson.M{"$and": query}
+	}
+
+	var pages []page
+	err := s.findAll(cond, &pages, sortBy("-article.date"))
+	return pages, err
+}
+
+func (s mongoPageStore) FindByAuthor(author primitive.ObjectID) ([]page, error) {
+	var pages []page
+	err := s.findAll(bson.M{"author": author}, &pages)
+	return pages, err
+}
+
+func (s mongoPageStore) PullGroup(gid primitive.ObjectID) (int, error) {
+	return s.updateAll(bson.M{"groups": gid}, bson.M{"$pull": bson.M{"groups": gid}})
+}
+
+func (s mongoPageStore) PullProject(pid primitive.ObjectID) (int, error) {
+	return s.updateAll(bson.M{"projects": pid}, bson.M{"$pull": bson.M{"projects": pid}})
+}
+
+func (s mongoPageStore) ProjectEdits(v *pageVisibility, pid primitive.ObjectID) ([]pageEdits, error) {
+	pipeline := []bson.M{
+		{"$match": bson.M{"$and": []interface{}{bson.M{"projects": pid}, v.filter()}}},
+		{"$lookup": bson.M{
+			"from": "revisions",
+			"let":  bson.M{"page": "$_id"},
+			"pipeline": []bson.M{
+				{"$match": bson.M{"$expr": bson.M{"$eq": []interface{}{"$pageid", "$$page"}}}},
+				{"$project": bson.M{"_id": 0, "userid": 1, "date": 1}},
+			},
+			"as": "edits",
+		}},
+		{"$project": bson.M{
+			"title":   "$article.title",
+			"views":   1,
+			"created": 1,
+			"edits": bson.M{"$concatArrays": []interface{}{
+				"$edits",
+				[]interface{}{bson.M{"userid": "$article.userid", "date": "$article.date"}},
+			}},
+		}},
+	}
+
+	pages := []pageEdits{}
+	err := s.aggregate(pipeline, &pages)
+	return pages, err
+}
+
+type mongoRevisionStore struct {
+	mongoCollection
+}
+
+func (s mongoRevisionStore) Insert(rev *revision) error {
+	return s.insert(rev)
+}
+
+func (s mongoRevisionStore) Get(pageId primitive.ObjectID, id primitive.ObjectID) (*revision, error) {
+	var rev revision
+	if err := s.findOne(bson.M{"_id": id, "pageid": pageId}, &rev); err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+func (s mongoRevisionStore) Update(rev *revision) error {
+	return s.replaceId(rev.Id, rev)
+}
+
+func (s mongoRevisionStore) List(pageId primitive.ObjectID) ([]revision, error) {
+	var revs []revision
+	err := s.findAll(bson.M{"pageid": pageId}, &revs, sortBy("-date").SetProjection(bson.M{"body": 0}))
+	return revs, err
+}
+
+func (s mongoRevisionStore) Remove(pageId primitive.ObjectID, ids []primitive.ObjectID) error {
+	_, err := s.removeAll(bson.M{"pageid": pageId, "_id": bson.M{"$in": ids}})
+	return err
+}
+
+func (s mongoRevisionStore) RemovePage(pageId primitive.ObjectID) error {
+	_, err := s.removeAll(bson.M{"pageid": pageId})
+	return err
+}
+
+type mongoAttachmentStore struct {
+	mongoCollection
+}
+
+func (s mongoAttachmentStore) Insert(a *attachment) error {
+	return s.insert(a)
+}
+
+func (s mongoAttachmentStore) Get(pageId primitive.ObjectID, id primitive.ObjectID) (*attachment, error) {
+	var a attachment
+	if err := s.findOne(bson.M{"_id": id, "pageid": pageId}, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (s mongoAttachmentStore) RemovePage(pageId primitive.ObjectID) error {
+	_, err := s.removeAll(bson.M{"pageid": pageId})
+	return err
+}
+
+type mongoUserStore struct {
+	mongoCollection
+}
+
+func (s mongoUserStore) Get(id primitive.ObjectID) (*user, error) {
+	u := user{}
+	if err := s.findId(id, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s mongoUserStore) FindByName(name string) (*user, error) {
+	u := user{}
+	if err := s.findOne(bson.M{"name": name}, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s mongoUserStore) List(includeDisabled bool) ([]user, error) {
+	cond := bson.M{"$or": []interface{}{
+		bson.M{"disabled": bson.M{"$exists": false}},
+		bson.M{"disabled": false}}}
+	if includeDisabled {
+		cond = bson.M{}
+	}
+
+	users := []user{}
+	err := s.findAll(cond, &users, sortBy("name"))
+	return users, err
+}
+
+func (s mongoUserStore) FindByEmail(email string) (*user, error) {
+	u := user{}
+	if err := s.findOne(bson.M{"email": email}, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s mongoUserStore) Count(ids []primitive.ObjectID) (int, error) {
+	return s.count(bson.M{"_id": bson.M{"$in": ids}})
+}
+
+func (s mongoUserStore) Insert(u *user) error {
+	if u.Id.IsZero() {
+		u.Id = primitive.NewObjectID()
+	}
+	return s.insert(u)
+}
+
+func (s mongoUserStore) SetProfile(id primitive.ObjectID, p userProfile) error {
+	return s.updateId(id, bson.M{"$set": bson.M{"name": p.Name, "timezone": p.Timezone, "language": p.Language, "bio": p.Bio}})
+}
+
+func (s mongoUserStore) SetNameAndEmail(id primitive.ObjectID, name string, email string) error {
+	return s.updateId(id, bson.M{"$set": bson.M{"name": name, "email": email}})
+}
+
+func (s mongoUserStore) SetEmail(id primitive.ObjectID, email string) error {
+	return s.updateId(id, bson.M{"$set": bson.M{"email": email}, "$unset": bson.M{"pendingemail": ""}})
+}
+
+func (s mongoUserStore) SetPendingEmail(id primitive.ObjectID, email string) error {
+	return s.updateId(id, bson.M{"$set": bson.M{"pendingemail": email}})
+}
+
+func (s mongoUserStore) SetTOTP(id primitive.ObjectID, t totpSettings) error {
+	return s.updateId(id, bson.M{"$set": bson.M{
+		"totpenabled": t.Enabled, "totpsecret": t.Secret, "totplaststep": t.LastStep, "recoverycodes": t.RecoveryCodes}})
+}
+
+// totpUnlocked selects the users not locked out at t, as user.totpLocked.
+func totpUnlocked(t time.Time) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"totpfailures": bson.M{"$not": bson.M{"$gte": TOTP_MAX_FAILURES}}},
+		bson.M{"totpfailedat": bson.M{"$lte": t.Add(-TOTP_LOCKOUT)}},
+	}}
+}
+
+func (s mongoUserStore) UseTOTPStep(id primitive.ObjectID, step int64, t time.Time) (bool, error) {
+	filter := totpUnlocked(t)
+	filter["_id"] = id
+	filter["totplaststep"] = bson.M{"$not": bson.M{"$gte": step}}
+	n, err := s.updateAll(filter, bson.M{"$set": bson.M{"totplaststep": step}})
+	return n > 0, err
+}
+
+func (s mongoUserStore) SetDisabled(id primitive.ObjectID, disabled bool) error {
+	return s.updateId(id, bson.M{"$set": bson.M{"disabled": disabled}})
+}
+
+func (s mongoUserStore) SetPassword(id primitive.ObjectID, hash []byte) error {
+	return s.updateId(id, bson.M{"$set": bson.M{"password": hash}})
+}
+
+func (s mongoUserStore) AddTOTPFailure(id primitive.ObjectID, t time.Time) (int, error) {
+	// count again from zero once a lockout is over
+	expired := bson.M{"_id": id, "totpfailures": bson.M{"$gte": TOTP_MAX_FAILURES}, "totpfailedat": bson.M{"$lte": t.Add(-TOTP_LOCKOUT)}}
+	if _, err := s.updateAll(expired, bson.M{"$set": bson.M{"totpfailures": 0}}); err != nil {
+		return 0, err
+	}
+
+	var u user
+	err := s.c.FindOneAndUpdate(s.ctx, bson.M{"_id": id, "totpfailures": bson.M{"$not": bson.M{"$gte": TOTP_MAX_FAILURES}}},
+		bson.M{"$inc": bson.M{"totpfailures": 1}, "$set": bson.M{"totpfailedat": t}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&u)
+	if err == ErrNotFound {
+		if err = s.findId(id, &u); err == nil {
+			err = ErrTOTPLocked
+		}
+	}
+	return u.TOTPFailures, err
+}
+
+func (s mongoUserStore) ResetTOTPFailures(id primitive.ObjectID) error {
+	return s.updateId(id, bson.M{"$unset": bson.M{"totpfailures": "", "totpfailedat": ""}})
+}
+
+// unbindProject drops the role bindings of pid in the users or the groups.
+func (m mongoCollection) unbindProject(pid primitive.ObjectID) error {
+	_, err := m.updateAll(bson.M{"roles.project": pid}, bson.M{"$pull": bson.M{"roles": bson.M{"project": pid}}})
+	return err
+}
+
+func (s mongoUserStore) PullRecoveryCode(id primitive.ObjectID, hash string) (bool, error) {
+	n, err := s.updateAll(bson.M{"_id": id, "recoverycodes": hash}, bson.M{"$pull": bson.M{"recoverycodes": hash}})
+	return n > 0, err
+}
+
+func (s mongoUserStore) SetRoles(id primitive.ObjectID, bs []roleBinding) error {
+	return s.updateId(id, bson.M{"$set": bson.M{"roles": bs}, "$unset": bson.M{"permissions": ""}})
+}
+
+func (s mongoUserStore) UnbindProject(pid primitive.ObjectID) error {
+	return s.unbindProject(pid)
+}
+
+// unbindRole drops the bindings of the role name in the users or the
+// groups.
+func (m mongoCollection) unbindRole(name string) error {
+	_, err := m.updateAll(bson.M{"roles.role": name}, bson.M{"$pull": bson.M{"roles": bson.M{"role": name}}})
+	return err
+}
+
+func (s mongoUserStore) UnbindRole(name string) error {
+	return s.unbindRole(name)
+}
+
+type mongoGroupStore struct {
+	mongoCollection
+}
+
+func (s mongoGroupStore) Get(id primitive.ObjectID) (*group, error) {
+	var g group
+	if err := s.findId(id, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (s mongoGroupStore) FindByName(name string) (*group, error) {
+	var g group
+	if err := s.findOne(bson.M{"name": name}, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (q groupQuery) filter() bson.M {
+	if q.Member.IsZero() {
+		return bson.M{}
+	}
+
+	return bson.M{"$or": []interface{}{
+		bson.M{"users": q.Member},
+		bson.M{"admins": q.Member}}}
+}
+
+func (s mongoGroupStore) List(q groupQuery) ([]group, error) {
+	groups := []group{}
+	err := s.findAll(q.filter(), &groups, sortBy("name"))
+	return groups, err
+}
+
+func (s mongoGroupStore) Insert(g *group) error {
+	if g.Id.IsZero() {
+		g.Id = primitive.NewObjectID()
+	}
+
+	return s.insert(g)
+}
+
+func (s mongoGroupStore) Update(g *group) error {
+	return s.updateId(g.Id, bson.M{"$set": bson.M{"name": g.Name, "users": g.Users, "admins": g.Admins}})
+}
+
+func (s mongoGroupStore) Remove(id primitive.ObjectID) error {
+	return s.removeId(id)
+}
+
+func (s mongoGroupStore) AddMember(gid primitive.ObjectID, uid primitive.ObjectID) error {
+	return s.updateId(gid, bson.M{"$addToSet": bson.M{"users": uid}})
+}
+
+func (s mongoGroupStore) RemoveMember(gid primitive.ObjectID, uid primitive.ObjectID) error {
+	return s.updateId(gid, bson.M{"$pull": bson.M{"users": uid}})
+}
+
+func (s mongoGroupStore) SetRoles(id primitive.ObjectID, bs []roleBinding) error {
+	return s.updateId(id, bson.M{"$set": bson.M{"roles": bs}})
+}
+
+func (s mongoGroupStore) UnbindProject(pid primitive.ObjectID) error {
+	return s.unbindProject(pid)
+}
+
+func (s mongoGroupStore) UnbindRole(name string) error {
+	return s.unbindRole(name)
+}
+
+type mongoProjectStore struct {
+	mongoCollection
+}
+
+func (s mongoProjectStore) Get(id primitive.ObjectID) (*project, error) {
+	var p project
+	if err := s.findId(id, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s mongoProjectStore) FindByName(name string) (*project, error) {
+	var p project
+	if err := s.findOne(bson.M{"name": name}, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (q projectQuery) filter() bson.M {
+	var conds []interface{}
+
+	if !q.Member.IsZero() {
+		or := []interface{}{
+			bson.M{"members": q.Member},
+			bson.M{"owners": q.Member}}
+		if q.IncludeOpen {
+			or = append(or, bson.M{"members.0": bson.M{"$exists": false}})
+		}
+		conds = append(conds, bson.M{"$or": or})
+	}
+
+	if !q.IncludeArchived {
+		conds = append(conds, bson.M{"archived": bson.M{"$ne": true}})
+	}
+
+	if len(conds) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": conds}
+}
+
+func (s mongoProjectStore) List(q projectQuery) ([]project, error) {
+	projects := []project{}
+	err := s.findAll(q.filter(), &projects, sortBy("name"))
+	return projects, err
+}
+
+func (s mongoProjectStore) Insert(p *project) error {
+	if p.Id.IsZero() {
+		p.Id = primitive.NewObjectID()
+	}
+
+	return s.insert(p)
+}
+
+func (s mongoProjectStore) Update(p *project) error {
+	return s.updateId(p.Id, bson.M{"$set": bson.M{
+		"name": p.Name, "slackurl": p.SlackURL, "members": p.Members, "owners": p.Owners}})
+}
+
+func (s mongoProjectStore) Remove(id primitive.ObjectID) error {
+	return s.removeId(id)
+}
+
+func (s mongoProjectStore) AddMember(pid primitive.ObjectID, uid primitive.ObjectID) error {
+	return s.updateId(pid, bson.M{"$addToSet": bson.M{"members": uid}})
+}
+
+func (s mongoProjectStore) RemoveMember(pid primitive.ObjectID, uid primitive.ObjectID) error {
+	return s.updateId(pid, bson.M{"$pull": bson.M{"members": uid}})
+}
+
+func (s mongoProjectStore) SetArchived(id primitive.ObjectID, archived bool, at time.Time) error {
+	update := bson.M{"$set": bson.M{"archived": archived, "archivedat": at}}
+	if !archived {
+		update = bson.M{"$set": bson.M{"archived": false}, "$unset": bson.M{"archivedat": ""}}
+	}
+	return s.updateId(id, update)
+}
+
+type mongoAuditStore struct {
+	mongoCollection
+}
+
+func (s mongoAuditStore) Insert(e *auditEntry) error {
+	return s.insert(e)
+}
+
+func (f auditFilter) filter() bson.M {
+	cond := bson.M{}
+	if !f.Actor.IsZero() {
+		cond["actor"] = f.Actor
+	}
+	if f.ActionPrefix {
+		cond["action"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(f.Action)}
+	} else if f.Action != "" {
+		cond["action"] = f.Action
+	}
+	if f.Target != "" {
+		cond["target"] = f.Target
+	}
+
+	date := bson.M{}
+	if !f.From.IsZero() {
+		date["$gte"] = f.From
+	}
+	if !f.To.IsZero() {
+		date["$lt"] = f.To
+	}
+	if len(date) > 0 {
+		cond["date"] = date
+	}
+	return cond
+}
+
+func (s mongoAuditStore) Count(f auditFilter) (int, error) {
+	return s.count(f.filter())
+}
+
+func (s mongoAuditStore) Find(f auditFilter, skip int, limit int) ([]auditEntry, error) {
+	entries := []auditEntry{}
+	err := s.findAll(f.filter(), &entries, sortBy("-date").SetSkip(int64(skip)).SetLimit(int64(limit)))
+	return entries, err
+}
+
+type mongoRoleStore struct {
+	mongoCollection
+}
+
+func (s mongoRoleStore) Get(id primitive.ObjectID) (*role, error) {
+	var r role
+	if err := s.findId(id, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s mongoRoleStore) List() ([]role, error) {
+	roles := []role{}
+	err := s.findAll(bson.M{}, &roles, sortBy("name"))
+	return roles, err
+}
+
+func (s mongoRoleStore) Find(names []string) ([]role, error) {
+	var roles []role
+	err := s.findAll(bson.M{"name": bson.M{"$in": names}}, &roles)
+	return roles, err
+}
+
+func (s mongoRoleStore) Insert(r *role) error {
+	if r.Id.IsZero() {
+		r.Id = primitive.NewObjectID()
+	}
+	return s.insert(r)
+}
+
+func (s mongoRoleStore) Update(r *role) error {
+	return s.updateId(r.Id, bson.M{"$set": bson.M{"permissions": r.Permissions}})
+}
+
+func (s mongoRoleStore) Remove(id primitive.ObjectID) error {
+	return s.removeId(id)
+}
+
+type mongoTokenStore struct {
+	mongoCollection
+}
+
+func (s mongoTokenStore) Insert(t *apiToken) error {
+	return s.insert(t)
+}
+
+func (s mongoTokenStore) FindByHash(hash string) (*apiToken, error) {
+	var t apiToken
+	if err := s.findOne(bson.M{"hash": hash}, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s mongoTokenStore) List(userId primitive.ObjectID) ([]apiToken, error) {
+	tokens := []apiToken{}
+	err := s.findAll(bson.M{"userid": userId}, &tokens, sortBy("-createdat"))
+	return tokens, err
+}
+
+func (s mongoTokenStore) Remove(userId primitive.ObjectID, id primitive.ObjectID) error {
+	return s.remove(bson.M{"_id": id, "userid": userId})
+}
+
+func (s mongoTokenStore) SetLastUsed(id primitive.ObjectID, at time.Time) error {
+	return s.updateId(id, bson.M{"$set": bson.M{"lastused": at}})
+}
+
+type mongoPasswordResetStore struct {
+	mongoCollection
+}
+
+func (s mongoPasswordResetStore) Insert(pr *passwordReset) error {
+	return s.insert(pr)
+}
+
+func (s mongoPasswordResetStore) FindByHash(hash string) (*passwordReset, error) {
+	var pr passwordReset
+	if err := s.findOne(bson.M{"hash": hash}, &pr); err != nil {
+		return nil, err
+	}
+	return &pr, nil
+}
+
+func (s mongoPasswordResetStore) RemoveUser(userId primitive.ObjectID) error {
+	_, err := s.removeAll(bson.M{"userid": userId})
+	return err
+}
+
+type mongoEmailVerificationStore struct {
+	mongoCollection
+}
+
+func (s mongoEmailVerificationStore) Insert(ev *emailVerification) error {
+	return s.insert(ev)
+}
+
+func (s mongoEmailVerificationStore) Find(userId primitive.ObjectID, hash string) (*emailVerification, error) {
+	var ev emailVerification
+	if err := s.findOne(bson.M{"userid": userId, "hash": hash}, &ev); err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+func (s mongoEmailVerificationStore) RemoveUser(userId primitive.ObjectID) error {
+	_, err := s.removeAll(bson.M{"userid": userId})
+	return err
+}
+
+type mongoSettingsStore struct {
+	mongoCollection
+}
+
+func (s mongoSettingsStore) Get() (*siteSettings, error) {
+	st := siteSettings{}
+	err := s.findId(SITE_SETTINGS_ID, &st)
+	if err == ErrNotFound {
+		return &st, nil
+	}
+	return &st, err
+}
+
+func (s mongoSettingsStore) Put(st *siteSettings) error {
+	return s.upsertId(SITE_SETTINGS_ID, bson.M{"$set": st})
+}
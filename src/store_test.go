@@ -0,0 +1,307 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testStores checks the behavior every storage backend must share.
+func testStores(t *testing.T, db *docdb) {
+	alice := &user{Name: "alice", EMail: "alice@example.com"}
+	bob := &user{Name: "bob", EMail: "bob@example.com", Disabled: true}
+	for _, u := range []*user{alice, bob} {
+		if err := db.Users.Insert(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Users.Insert(&user{Name: "alice2", EMail: "alice@example.com"}); err != ErrDuplicate {
+		t.Error("duplicated email should be refused:", err)
+	}
+	if err := db.Users.Insert(&user{Name: "alice", EMail: "alice2@example.com"}); err != ErrDuplicate {
+		t.Error("duplicated name should be refused:", err)
+	}
+	if users, _ := db.Users.List(false); len(users) != 1 || users[0].Id != alice.Id {
+		t.Error("disabled users should not be listed:", users)
+	}
+	if u, err := db.Users.FindByName("bob"); err != nil || u.Id != bob.Id {
+		t.Error("FindByName failed:", u, err)
+	}
+	if n, _ := db.Users.Count([]primitive.ObjectID{alice.Id, alice.Id, primitive.NewObjectID()}); n != 1 {
+		t.Error("Count unexpected:", n)
+	}
+
+	g := &group{Name: "dev", Users: []primitive.ObjectID{alice.Id}}
+	if err := db.Groups.Insert(g); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Groups.Insert(&group{Name: "dev"}); err != ErrDuplicate {
+		t.Error("duplicated group name should be refused:", err)
+	}
+	if err := db.Groups.AddMember(g.Id, bob.Id); err != nil {
+		t.Fatal(err)
+	}
+	if gs, _ := db.Groups.List(groupQuery{Member: bob.Id}); len(gs) != 1 {
+		t.Error("bob should be in the group:", gs)
+	}
+
+	open := &project{Name: "open"}
+	closed := &project{Name: "closed", Members: []primitive.ObjectID{bob.Id}}
+	for _, p := range []*project{open, closed} {
+		if err := db.Projects.Insert(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ps, _ := db.Projects.List(projectQuery{Member: alice.Id, IncludeOpen: true}); len(ps) != 1 || ps[0].Id != open.Id {
+		t.Error("alice should see the open project only:", ps)
+	}
+	if err := db.Projects.SetArchived(open.Id, true, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if ps, _ := db.Projects.List(projectQuery{}); len(ps) != 1 || ps[0].Id != closed.Id {
+		t.Error("archived projects should not be listed:", ps)
+	}
+
+	now := time.Now()
+	pages := []*page{
+		{Id: primitive.NewObjectID(), Author: bob.Id, Access: PRIVATE, Article: article{UserId: bob.Id, Title: "private notes", Date: now}},
+		{Id: primitive.NewObjectID(), Author: bob.Id, Access: GROUP, Groups: []primitive.ObjectID{g.Id}, Article: article{UserId: bob.Id, Title: "group notes", Date: now.Add(time.Minute)}},
+		{Id: primitive.NewObjectID(), Author: bob.Id, Access: PROJECT, Projects: []primitive.ObjectID{closed.Id}, Article: article{UserId: bob.Id, Title: "project notes", Date: now}},
+		{Id: primitive.NewObjectID(), Author: bob.Id, Access: PUBLIC, Article: article{UserId: bob.Id, Title: "welcome", Body: "read the notes", Date: now.Add(-time.Minute)}},
+	}
+	for _, p := range pages {
+		if err := db.Pages.Insert(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v := &pageVisibility{User: alice.Id, Groups: []primitive.ObjectID{g.Id}}
+	found, err := db.Pages.Find(v, []string{"notes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[0].Id != pages[1].Id || found[1].Id != pages[3].Id {
+		t.Error("Find unexpected:", found)
+	}
+	if _, err := db.Pages.Find(v, []string{"("}); err == nil {
+		t.Error("invalid regular expression should fail")
+	}
+
+	p := *pages[3]
+	p.Article.Title = "welcome!"
+	if err := db.Pages.Update(&p); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Pages.IncViews(p.Id); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.Pages.Get(p.Id); got.Article.Title != "welcome!" || got.Views != 1 {
+		t.Error("Update unexpected:", got)
+	}
+	swapped := p
+	swapped.Article.Id = primitive.NewObjectID()
+	if err := db.Pages.Swap(&swapped, primitive.NewObjectID()); err != ErrConflict {
+		t.Error("Swap over another article should conflict:", err)
+	}
+	if err := db.Pages.Swap(&swapped, p.Article.Id); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.Pages.Get(p.Id); got.Article.Id != swapped.Article.Id {
+		t.Error("Swap unexpected:", got)
+	}
+
+	var revs []*revision
+	for i := 0; i < 3; i++ {
+		a := article{Title: "welcome", Body: "version", UserId: bob.Id, Date: now.Add(time.Duration(i) * time.Hour)}
+		rev, err := a.createRevision(p.Id, &p.Article, i < 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Revisions.Insert(rev); err != nil {
+			t.Fatal(err)
+		}
+		revs = append(revs, rev)
+	}
+	if got, _ := db.Revisions.List(p.Id); len(got) != 3 || got[0].Id != revs[2].Id || got[0].Delta == nil || got[1].Body != nil {
+		t.Error("revisions should be listed the latest first without snapshot body:", got)
+	}
+	if got, err := db.Revisions.Get(p.Id, revs[1].Id); err != nil || got.Body == nil {
+		t.Error("Get revision failed:", got, err)
+	}
+	if _, err := db.Revisions.Get(pages[0].Id, revs[1].Id); err != ErrNotFound {
+		t.Error("revision of another page should be not found:", err)
+	}
+	revs[2].Body, revs[2].Delta = revs[1].Body, nil
+	if err := db.Revisions.Update(revs[2]); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Revisions.Get(p.Id, revs[2].Id); err != nil || !got.isSnapshot() {
+		t.Error("Update revision failed:", got, err)
+	}
+	if err := db.Revisions.Update(&revision{Id: primitive.NewObjectID(), PageId: p.Id}); err != ErrNotFound {
+		t.Error("missing revision should not be updated:", err)
+	}
+	if err := db.Revisions.Remove(p.Id, []primitive.ObjectID{revs[0].Id}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.Revisions.List(p.Id); len(got) != 2 {
+		t.Error("Remove revision failed:", got)
+	}
+	if err := db.Revisions.RemovePage(p.Id); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.Revisions.List(p.Id); len(got) != 0 {
+		t.Error("RemovePage failed:", got)
+	}
+
+	if n, _ := db.Pages.PullGroup(g.Id); n != 1 {
+		t.Error("PullGroup should change one page:", n)
+	}
+	if err := db.Pages.Remove(primitive.NewObjectID()); err != ErrNotFound {
+		t.Error("missing page should not be removed:", err)
+	}
+	if _, err := db.Pages.Get(primitive.NewObjectID()); err != ErrNotFound {
+		t.Error("missing page should be not found:", err)
+	}
+
+	testAccountStores(t, db)
+}
+
+// testAccountStores checks the stores of the accounts and the site settings.
+func testAccountStores(t *testing.T, db *docdb) {
+	alice, err := db.Users.FindByEmail("alice@example.com")
+	if err != nil || alice.Name != "alice" {
+		t.Fatal("FindByEmail failed:", alice, err)
+	}
+	if err := db.Users.SetProfile(alice.Id, userProfile{Name: "alice", Bio: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Users.SetTOTP(alice.Id, totpSettings{Secret: "secret", RecoveryCodes: []string{"a", "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Users.SetEmail(alice.Id, "bob@example.com"); err != ErrDuplicate {
+		t.Error("update to a used email should be refused:", err)
+	}
+	if err := db.Users.SetProfile(alice.Id, userProfile{Name: "bob"}); err != ErrDuplicate {
+		t.Error("update to a used name should be refused:", err)
+	}
+	if err := db.Users.SetPendingEmail(alice.Id, "alice@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	// the setters keep the other fields
+	if err := db.Users.SetDisabled(alice.Id, true); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.Users.UseTOTPStep(alice.Id, 42, time.Now()); !ok || err != nil {
+		t.Fatal("step should be used:", ok, err)
+	}
+	if ok, _ := db.Users.UseTOTPStep(alice.Id, 42, time.Now()); ok {
+		t.Error("step should be used once")
+	}
+	if u, _ := db.Users.Get(alice.Id); !u.Disabled || u.TOTPLastStep != 42 || u.TOTPSecret != "secret" || u.PendingEmail != "alice@example.org" {
+		t.Error("setters should only change their fields:", u)
+	}
+	if err := db.Users.SetDisabled(alice.Id, false); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.Users.PullRecoveryCode(alice.Id, "a"); !ok || err != nil {
+		t.Error("recovery code should be pulled:", ok, err)
+	}
+	if ok, _ := db.Users.PullRecoveryCode(alice.Id, "a"); ok {
+		t.Error("recovery code should be used once")
+	}
+	if u, _ := db.Users.Get(alice.Id); u.Bio != "hello" || len(u.RecoveryCodes) != 1 || u.EMail != "alice@example.com" {
+		t.Error("user update unexpected:", u)
+	}
+
+	auditor := &role{Name: "auditor", Permissions: []permission{USER_MANAGE}}
+	if err := db.Roles.Insert(auditor); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Roles.Insert(&role{Name: "auditor"}); err != ErrDuplicate {
+		t.Error("duplicated role name should be refused:", err)
+	}
+	if roles, _ := db.Roles.Find([]string{"auditor", "missing"}); len(roles) != 1 || roles[0].Id != auditor.Id {
+		t.Error("Find should return the known roles:", roles)
+	}
+	if err := db.Users.SetRoles(alice.Id, []roleBinding{{Role: "auditor"}, {Role: string(EDITOR)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Users.UnbindRole("auditor"); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := db.Users.Get(alice.Id); len(u.Roles) != 1 || u.Roles[0].Role != string(EDITOR) {
+		t.Error("bindings of the removed role should be dropped:", u.Roles)
+	}
+
+	now := time.Now()
+	old := &apiToken{UserId: alice.Id, Name: "old", Hash: "h1", CreatedAt: now.Add(-time.Hour)}
+	latest := &apiToken{UserId: alice.Id, Name: "latest", Hash: "h2", CreatedAt: now}
+	for _, tk := range []*apiToken{old, latest} {
+		if err := db.Tokens.Insert(tk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tokens, _ := db.Tokens.List(alice.Id); len(tokens) != 2 || tokens[0].Id != latest.Id {
+		t.Error("tokens should be listed the latest first:", tokens)
+	}
+	if err := db.Tokens.Remove(primitive.NewObjectID(), old.Id); err != ErrNotFound {
+		t.Error("token of another user should not be removed:", err)
+	}
+	if tk, err := db.Tokens.FindByHash("h1"); err != nil || tk.Id != old.Id {
+		t.Error("FindByHash failed:", tk, err)
+	}
+
+	if st, err := db.Settings.Get(); err != nil || st.RequireAdmin2FA {
+		t.Error("settings should default to the zero value:", st, err)
+	}
+	if err := db.Settings.Put(&siteSettings{RequireAdmin2FA: true}); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := db.Settings.Get(); !st.RequireAdmin2FA {
+		t.Error("settings should be saved:", st)
+	}
+
+	for i, action := range []string{"user.update", "group.update", "user.delete"} {
+		e := auditEntry{Id: primitive.NewObjectID(), Action: action, Date: now.Add(time.Duration(i) * time.Minute)}
+		if err := db.Audit.Insert(&e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := auditFilter{Action: "user.", ActionPrefix: true}
+	if n, _ := db.Audit.Count(f); n != 2 {
+		t.Error("Count unexpected:", n)
+	}
+	if entries, _ := db.Audit.Find(f, 1, 10); len(entries) != 1 || entries[0].Action != "user.update" {
+		t.Error("Find should skip the latest entry:", entries)
+	}
+}
+
+func TestMemoryStores(t *testing.T) {
+	testStores(t, newMemoryDocDb())
+}
+
+func TestBoltStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "irori")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bdb, err := bolt.Open(filepath.Join(dir, "irori.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bdb.Close()
+
+	db, err := newBoltDocDb(bdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStores(t, db)
+}
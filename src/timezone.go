@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/flosch/pongo2"
+)
+
+const DEFAULT_TIMEZONE = "Asia/Tokyo"
+
+// DATE_FORMAT is how dates are shown in the templates.
+const DATE_FORMAT = "2006/01/02 15:04 MST"
+
+var siteLocation = time.FixedZone(DEFAULT_TIMEZONE, 9*60*60)
+
+// setSiteTimezone sets the timezone used for users without a preference.
+func setSiteTimezone(name string) {
+	if name == "" {
+		name = DEFAULT_TIMEZONE
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Println("invalid timezone in config, use", siteLocation, ":", err)
+		return
+	}
+	siteLocation = loc
+}
+
+// location returns the timezone preferred by the user, or the site default.
+func (u *user) location() *time.Location {
+	if u == nil || u.Timezone == "" {
+		return siteLocation
+	}
+
+	loc, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		return siteLocation
+	}
+	return loc
+}
+
+// localTime converts t for display to the user. JSON encodes the result as
+// RFC 3339 with the user's offset.
+func (u *user) localTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return t.In(u.location())
+}
+
+func (u *user) formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return u.localTime(t).Format(DATE_FORMAT)
+}
+
+func (u *user) localizePage(p *page) {
+	p.Article.Date = u.localTime(p.Article.Date)
+	p.Created = u.localTime(p.Created)
+}
+
+func (u *user) localizePages(pages []page) {
+	for i := range pages {
+		u.localizePage(&pages[i])
+	}
+}
+
+func (u *user) localizeToken(t *apiToken) {
+	t.CreatedAt = u.localTime(t.CreatedAt)
+	t.ExpiresAt = u.localTime(t.ExpiresAt)
+	t.LastUsed = u.localTime(t.LastUsed)
+}
+
+// filterLocalDate formats a time.Time for the user given as parameter:
+// {{ date|localdate:loginuser }}
+func filterLocalDate(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	t, ok := in.Interface().(time.Time)
+	if !ok {
+		return in, nil
+	}
+
+	u, _ := param.Interface().(*user)
+	return pongo2.AsValue(u.formatTime(t)), nil
+}
+
+func init() {
+	pongo2.RegisterFilter("localdate", filterLocalDate)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserLocalTime(t *testing.T) {
+	utc := time.Date(2015, 6, 1, 3, 4, 0, 0, time.UTC)
+
+	u := &user{Timezone: "UTC"}
+	if s := u.formatTime(utc); s != "2015/06/01 03:04 UTC" {
+		t.Error("unexpected format", s)
+	}
+
+	nowhere := &user{Timezone: "Nowhere/Invalid"}
+	if nowhere.location() != siteLocation {
+		t.Error("invalid timezone should fall back to site default")
+	}
+
+	if s := u.formatTime(time.Time{}); s != "" {
+		t.Error("zero time should be empty", s)
+	}
+
+	p := page{}
+	p.Article.Date = utc
+	site := &user{}
+	site.localizePage(&p)
+
+	js, _ := json.Marshal(p.Article.Date)
+	if _, offset := p.Article.Date.Zone(); !strings.HasSuffix(strings.Trim(string(js), `"`), "+09:00") || offset != 9*60*60 {
+		t.Error("unexpected json date", string(js))
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrTokenInvalid = errors.New("token invalid")
+
+const TOKEN_PREFIX = "irori_"
+
+type tokenScope string
+
+const (
+	SCOPE_READ  tokenScope = "read"
+	SCOPE_WRITE tokenScope = "write"
+	SCOPE_ADMIN tokenScope = "admin"
+)
+
+func (s tokenScope) valid() bool {
+	return s == SCOPE_READ || s == SCOPE_WRITE || s == SCOPE_ADMIN
+}
+
+// apiToken is a personal access token. Only the sha256 hash of the token is
+// stored, the plain token is shown to the user once on creation.
+type apiToken struct {
+	Id        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserId    primitive.ObjectID `bson:"userid" json:"-"`
+	Name      string             `bson:"name" json:"name"`
+	Hash      string             `bson:"hash" json:"-"`
+	Scopes    []tokenScope       `bson:"scopes" json:"scopes"`
+	CreatedAt time.Time          `bson:"createdat" json:"createdAt"`
+	ExpiresAt time.Time          `bson:"expiresat,omitempty" json:"expiresAt,omitempty"`
+	LastUsed  time.Time          `bson:"lastused,omitempty" json:"lastUsed,omitempty"`
+}
+
+func (t *apiToken) HasScope(s tokenScope) bool {
+	for _, scope := range t.Scopes {
+		if scope == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *apiToken) expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && now.After(t.ExpiresAt)
+}
+
+// allowMethod reports whether the token scopes permit a request with method.
+func (t *apiToken) allowMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return t.HasScope(SCOPE_READ) || t.HasScope(SCOPE_WRITE) || t.HasScope(SCOPE_ADMIN)
+	default:
+		return t.HasScope(SCOPE_WRITE) || t.HasScope(SCOPE_ADMIN)
+	}
+}
+
+func generateToken() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return TOKEN_PREFIX + hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// getUserByToken returns the owner of a valid, unexpired token and records
+// the time it was used.
+func getUserByToken(docdb *docdb, token string) (*user, *apiToken, error) {
+	t, err := docdb.Tokens.FindByHash(hashToken(token))
+	if err == ErrNotFound {
+		return nil, nil, ErrTokenInvalid
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if t.expired(now) {
+		return nil, nil, ErrTokenInvalid
+	}
+
+	u, err := getUserById(docdb, t.UserId)
+	if err == ErrNotFound || (err == nil && u.Disabled) {
+		return nil, nil, ErrTokenInvalid
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	if err := resolvePermissions(docdb, u); err != nil {
+		return nil, nil, err
+	}
+
+	t.LastUsed = now
+	if err := docdb.Tokens.SetLastUsed(t.Id, now); err != nil {
+		log.Println("getUserByToken: update lastused failed: ", err)
+	}
+
+	return u, t, nil
+}
+
+// getSessionToken returns the token used to authenticate the request, or nil
+// if the request is authenticated by the session cookie.
+func getSessionToken(c web.C) *apiToken {
+	t, ok := c.Env["token"].(*apiToken)
+	if !ok {
+		return nil
+	}
+	return t
+}
+
+// needApiLogin accepts either the session cookie or an
+// "Authorization: Bearer" personal access token.
+func needApiLogin(c *web.C, h http.Handler) http.Handler {
+	login := needLogin(c, h)
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			login.ServeHTTP(w, r)
+			return
+		}
+
+		user, t, err := getUserByToken(getDocDb(*c), token)
+		if err == ErrTokenInvalid {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !t.allowMethod(r.Method) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		user.locale = negotiateLocale(user, r)
+		c.Env["user"] = user
+		c.Env["token"] = t
+
+		h.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// apiNeedSession refuses requests authenticated by a token, so a token can
+// not be used to mint or revoke other tokens.
+func apiNeedSession(c web.C, w http.ResponseWriter, r *http.Request) bool {
+	if getSessionToken(c) != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+type postedToken struct {
+	Name      string       `json:"name"`
+	Scopes    []tokenScope `json:"scopes"`
+	ExpiresIn int          `json:"expiresIn"` // days, 0 means never
+}
+
+type createdToken struct {
+	apiToken
+	Token string `json:"token"`
+}
+
+func apiTokenListGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	user := getSessionUser(c)
+	docdb := getDocDb(c)
+
+	tokens, err := docdb.Tokens.List(user.Id)
+	if err != nil {
+		log.Println("apiTokenListGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for i := range tokens {
+		user.localizeToken(&tokens[i])
+	}
+
+	js, err := json.Marshal(tokens)
+	if err != nil {
+		log.Println("apiTokenListGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func apiTokenPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	user := getSessionUser(c)
+
+	defer r.Body.Close()
+	var pt postedToken
+	if err := json.NewDecoder(r.Body).Decode(&pt); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if pt.Name == "" || len(pt.Scopes) == 0 || pt.ExpiresIn < 0 {
+		log.Println("token is incomplete, ", pt)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for _, s := range pt.Scopes {
+		if !s.valid() {
+			log.Println("invalid token scope: ", s)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if s == SCOPE_ADMIN && !user.isManager() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		log.Println("apiTokenPostHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	t := apiToken{
+		Id:        primitive.NewObjectID(),
+		UserId:    user.Id,
+		Name:      pt.Name,
+		Hash:      hashToken(token),
+		Scopes:    pt.Scopes,
+		CreatedAt: now,
+	}
+	if pt.ExpiresIn > 0 {
+		t.ExpiresAt = now.AddDate(0, 0, pt.ExpiresIn)
+	}
+
+	docdb := getDocDb(c)
+	if err := docdb.Tokens.Insert(&t); err != nil {
+		log.Println("apiTokenPostHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	user.localizeToken(&t)
+	js, _ := json.Marshal(createdToken{apiToken: t, Token: token})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+func apiTokenDeleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	user := getSessionUser(c)
+
+	tokenId := c.URLParams["tokenId"]
+	if !isObjectIdHex(tokenId) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	docdb := getDocDb(c)
+	err := docdb.Tokens.Remove(user.Id, objectIdHex(tokenId))
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("apiTokenDeleteHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBearerToken(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/api/pages", nil)
+	if s := bearerToken(r); s != "" {
+		t.Error("unexpected token", s)
+	}
+
+	r.Header.Set("Authorization", "bearer irori_abc")
+	if s := bearerToken(r); s != "irori_abc" {
+		t.Error("unexpected token", s)
+	}
+
+	r.Header.Set("Authorization", "Basic Z3Vlc3Q6Z3Vlc3Q=")
+	if s := bearerToken(r); s != "" {
+		t.Error("unexpected token", s)
+	}
+}
+
+func TestGenerateToken(t *testing.T) {
+	a, err := generateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := generateToken()
+
+	if !strings.HasPrefix(a, TOKEN_PREFIX) || a == b {
+		t.Error("unexpected token", a, b)
+	}
+
+	if hashToken(a) == a || hashToken(a) != hashToken(a) {
+		t.Error("unexpected hash", hashToken(a))
+	}
+}
+
+func TestTokenScope(t *testing.T) {
+	read := apiToken{Scopes: []tokenScope{SCOPE_READ}}
+	if !read.allowMethod("GET") || read.allowMethod("POST") {
+		t.Error("read scope unexpected")
+	}
+
+	write := apiToken{Scopes: []tokenScope{SCOPE_WRITE}}
+	if !write.allowMethod("GET") || !write.allowMethod("DELETE") {
+		t.Error("write scope unexpected")
+	}
+
+	now := time.Now()
+	if read.expired(now) {
+		t.Error("token without expiry expired")
+	}
+
+	read.ExpiresAt = now.Add(-time.Minute)
+	if !read.expired(now) {
+		t.Error("token should be expired")
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"github.com/gorilla/sessions"
+	"github.com/zenazn/goji/web"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TOTP parameters (RFC 6238), compatible with the common authenticator apps.
+const (
+	TOTP_ISSUER = "irori"
+	TOTP_DIGITS = 6
+	TOTP_PERIOD = 30
+	TOTP_SKEW   = 1 // accepted time steps before and after now
+
+	RECOVERY_CODE_NUM = 10
+
+	// a password checked login waits this long for the second step
+	PENDING_2FA_TIMEOUT = 5 * time.Minute
+
+	// after this many wrong codes in a row, the second step is refused
+	// until TOTP_LOCKOUT after the last one
+	TOTP_MAX_FAILURES = 5
+	TOTP_LOCKOUT      = 15 * time.Minute
+)
+
+// ErrTOTPLocked is returned for the second login step of a user who entered
+// too many wrong codes in a row.
+var ErrTOTPLocked = errors.New("too many wrong authentication codes")
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(b), nil
+}
+
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, bin%mod), nil
+}
+
+func totpStep(t time.Time) int64 { return t.Unix() / TOTP_PERIOD }
+
+// totpSettings are the fields of a user saved by the 2FA enrollment.
+type totpSettings struct {
+	Enabled       bool
+	Secret        string
+	LastStep      int64
+	RecoveryCodes []string
+}
+
+func (u *user) setTOTP(t totpSettings) {
+	u.TOTPEnabled, u.TOTPSecret, u.TOTPLastStep, u.RecoveryCodes = t.Enabled, t.Secret, t.LastStep, t.RecoveryCodes
+}
+
+// verifyTOTP checks code against the steps around t and returns the matched
+// step. Steps not after lastStep are refused so a code can't be replayed.
+func verifyTOTP(secret string, code string, t time.Time, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+
+	now := totpStep(t)
+	for step := now - TOTP_SKEW; step <= now+TOTP_SKEW; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expect, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expect), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+func totpProvisioningURI(account string, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", TOTP_ISSUER)
+	v.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	v.Set("period", fmt.Sprint(TOTP_PERIOD))
+
+	label := url.PathEscape(TOTP_ISSUER + ":" + account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// generateRecoveryCodes returns the plain codes for the user and their
+// hashes to be stored.
+func generateRecoveryCodes() ([]string, []string, error) {
+	var codes, hashes []string
+	for i := 0; i < RECOVERY_CODE_NUM; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+// useRecoveryCode removes a matching recovery code from the user, so every
+// code is single-use.
+func useRecoveryCode(db *docdb, u *user, code string) (bool, error) {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	if code == "" {
+		return false, nil
+	}
+
+	h := hashToken(code)
+	for _, rc := range u.RecoveryCodes {
+		if rc == h {
+			return db.Users.PullRecoveryCode(u.Id, h)
+		}
+	}
+	return false, nil
+}
+
+// totpLocked reports whether u entered too many wrong codes in a row, the
+// last one less than TOTP_LOCKOUT before t.
+func (u *user) totpLocked(t time.Time) bool {
+	return u.TOTPFailures >= TOTP_MAX_FAILURES && t.Sub(u.TOTPFailedAt) < TOTP_LOCKOUT
+}
+
+// useTOTPStep records step as the last time step of u unless u used it or a
+// later one already or is locked out at t.
+func (u *user) useTOTPStep(step int64, t time.Time) bool {
+	if step <= u.TOTPLastStep || u.totpLocked(t) {
+		return false
+	}
+	u.TOTPLastStep = step
+	return true
+}
+
+// addTOTPFailure counts a wrong code of u at t, from zero again once a
+// lockout is over. It returns false when u is locked out at t.
+func (u *user) addTOTPFailure(t time.Time) bool {
+	if u.totpLocked(t) {
+		return false
+	}
+	if u.TOTPFailures >= TOTP_MAX_FAILURES {
+		u.TOTPFailures = 0
+	}
+	u.TOTPFailures, u.TOTPFailedAt = u.TOTPFailures+1, t
+	return true
+}
+
+// verify2FA checks the code, or else the recovery code, of the second login
+// step of u at t. The wrong codes are counted in the user rather than in the
+// session, so that logging in again doesn't allow more guesses.
+func verify2FA(db *docdb, u *user, code string, recovery string, t time.Time) (bool, error) {
+	if u.totpLocked(t) {
+		return false, ErrTOTPLocked
+	}
+
+	verified := false
+	var err error
+	if code != "" {
+		if step, ok := verifyTOTP(u.TOTPSecret, code, t, u.TOTPLastStep); ok {
+			// concurrent logins can't both use the step, nor pass a
+			// lockout started meanwhile
+			if verified, err = db.Users.UseTOTPStep(u.Id, step, t); verified {
+				u.TOTPLastStep = step
+			}
+		}
+	} else if recovery != "" {
+		verified, err = useRecoveryCode(db, u, recovery)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if verified {
+		if u.TOTPFailures > 0 {
+			err = db.Users.ResetTOTPFailures(u.Id)
+		}
+		return true, err
+	}
+
+	n, err := db.Users.AddTOTPFailure(u.Id, t)
+	if err != nil {
+		return false, err
+	}
+	u.TOTPFailures, u.TOTPFailedAt = n, t
+	if u.totpLocked(t) {
+		return false, ErrTOTPLocked
+	}
+	return false, nil
+}
+
+type siteSettings struct {
+	RequireAdmin2FA bool `bson:"requireadmin2fa" json:"requireAdmin2fa"`
+}
+
+const SITE_SETTINGS_ID = "site"
+
+func getSiteSettings(db *docdb) (*siteSettings, error) {
+	return db.Settings.Get()
+}
+
+// need2FAEnrollment reports whether the user must enroll TOTP before using
+// anything other than the 2fa settings.
+func need2FAEnrollment(db *docdb, u *user) bool {
+	if u.TOTPEnabled || !u.HasPermission(ADMIN) {
+		return false
+	}
+
+	s, err := getSiteSettings(db)
+	if err != nil {
+		log.Println("need2FAEnrollment: ", err)
+		return false
+	}
+	return s.RequireAdmin2FA
+}
+
+func allowedWithout2FA(path string) bool {
+	return path == "/profile/2fa" || strings.HasPrefix(path, "/api/users/own") ||
+		strings.HasPrefix(path, "/assets/")
+}
+
+func login2FAPageGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, SESSION_NAME)
+	if _, ok := session.Values["pending2fa"]; !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	err := executeWriterFromFile(w, "view/login-2fa.html", &pongo2.Context{
+		"locale": negotiateLocale(nil, r),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func login2FAPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, SESSION_NAME)
+	id, ok := session.Values["pending2fa"].(string)
+	at, _ := session.Values["pending2faAt"].(int64)
+	if !ok || !isObjectIdHex(id) || time.Since(time.Unix(at, 0)) > PENDING_2FA_TIMEOUT {
+		delete(session.Values, "pending2fa")
+		delete(session.Values, "pending2faAt")
+		sessions.Save(r, w)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	docdb := getDocDb(c)
+	u, err := getUserById(docdb, objectIdHex(id))
+	if err != nil || u.Disabled {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	verified, err := verify2FA(docdb, u, r.FormValue("code"), r.FormValue("recovery"), time.Now())
+	if err == ErrTOTPLocked {
+		// the login starts over, once the lockout is over
+		delete(session.Values, "pending2fa")
+		delete(session.Values, "pending2faAt")
+		sessions.Save(r, w)
+		render2FALocked(w, r, u)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !verified {
+		w.WriteHeader(http.StatusUnauthorized)
+		locale := negotiateLocale(u, r)
+		executeWriterFromFile(w, "view/login-2fa.html", &pongo2.Context{
+			"locale": locale,
+			"error":  T(locale, "2fa.error.incorrect"),
+		})
+		return
+	}
+
+	delete(session.Values, "pending2fa")
+	delete(session.Values, "pending2faAt")
+	session.Values["userid"] = u.Id.Hex()
+	sessions.Save(r, w)
+	http.Redirect(w, r, "/home", http.StatusSeeOther)
+}
+
+func render2FALocked(w http.ResponseWriter, r *http.Request, u *user) {
+	w.WriteHeader(http.StatusTooManyRequests)
+	locale := negotiateLocale(u, r)
+	executeWriterFromFile(w, "view/login.html", &pongo2.Context{
+		"locale": locale,
+		"error":  T(locale, "2fa.error.locked"),
+	})
+}
+
+type totpEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type totpVerify struct {
+	Code     string `json:"code"`
+	Password string `json:"password"`
+}
+
+type totpStatus struct {
+	Enabled       bool     `json:"enabled"`
+	Required      bool     `json:"required"`
+	RecoveryLeft  int      `json:"recoveryLeft"`
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+}
+
+func writeTOTPStatus(w http.ResponseWriter, db *docdb, u *user, codes []string) {
+	st := totpStatus{
+		Enabled:       u.TOTPEnabled,
+		RecoveryLeft:  len(u.RecoveryCodes),
+		RecoveryCodes: codes,
+	}
+
+	if s, err := getSiteSettings(db); err == nil {
+		st.Required = s.RequireAdmin2FA && u.HasPermission(ADMIN)
+	}
+
+	js, _ := json.Marshal(st)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func apiOwnTOTPGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	user := getSessionUser(c)
+	writeTOTPStatus(w, getDocDb(c), user, nil)
+}
+
+// apiOwnTOTPPostHandler starts enrollment by creating a new pending secret.
+func apiOwnTOTPPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	user := getSessionUser(c)
+
+	if user.TOTPEnabled {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		log.Println("apiOwnTOTPPostHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	docdb := getDocDb(c)
+	user.TOTPSecret = secret
+	if err := docdb.Users.SetTOTP(user.Id, totpSettings{Secret: secret}); err != nil {
+		log.Println("apiOwnTOTPPostHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(totpEnrollment{Secret: secret, URI: totpProvisioningURI(user.Name, secret)})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// apiOwnTOTPPutHandler verifies the first code of the pending secret and
+// enables 2FA. The recovery codes are only returned by this response.
+func apiOwnTOTPPutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	user := getSessionUser(c)
+
+	defer r.Body.Close()
+	var v totpVerify
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	step, ok := verifyTOTP(user.TOTPSecret, v.Code, time.Now(), 0)
+	if !ok {
+		log.Println("apiOwnTOTPPutHandler: code incorrect")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		log.Println("apiOwnTOTPPutHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	t := totpSettings{Enabled: true, Secret: user.TOTPSecret, LastStep: step, RecoveryCodes: hashes}
+	user.setTOTP(t)
+
+	docdb := getDocDb(c)
+	if err := docdb.Users.SetTOTP(user.Id, t); err != nil {
+		log.Println("apiOwnTOTPPutHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeTOTPStatus(w, docdb, user, codes)
+}
+
+func apiOwnTOTPDeleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	user := getSessionUser(c)
+
+	defer r.Body.Close()
+	var v totpVerify
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword(user.Password, []byte(v.Password)); err != nil {
+		log.Println("apiOwnTOTPDeleteHandler Failed: Password Incorrect")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	docdb := getDocDb(c)
+	if s, err := getSiteSettings(docdb); err == nil && s.RequireAdmin2FA && user.HasPermission(ADMIN) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	user.setTOTP(totpSettings{})
+	if err := docdb.Users.SetTOTP(user.Id, totpSettings{}); err != nil {
+		log.Println("apiOwnTOTPDeleteHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiSettingsGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	s, err := getSiteSettings(getDocDb(c))
+	if err != nil {
+		log.Println("apiSettingsGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(s)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func apiSettingsPutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var s siteSettings
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	docdb := getDocDb(c)
+	before, err := getSiteSettings(docdb)
+	if err != nil {
+		log.Println("apiSettingsPutHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := docdb.Settings.Put(&s); err != nil {
+		log.Println("apiSettingsPutHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(docdb, r, getSessionUser(c), "settings.update", "settings:"+SITE_SETTINGS_ID, before, s)
+
+	js, _ := json.Marshal(s)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B test secret "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		code, err := totpCode(rfcSecret, totpStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Error("unexpected code", tt.unix, code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := totpStep(now)
+
+	prev, _ := totpCode(rfcSecret, step-1)
+	if s, ok := verifyTOTP(rfcSecret, prev, now, 0); !ok || s != step-1 {
+		t.Error("previous step should be accepted", s, ok)
+	}
+
+	if _, ok := verifyTOTP(rfcSecret, prev, now, step-1); ok {
+		t.Error("used step should be refused")
+	}
+
+	old, _ := totpCode(rfcSecret, step-5)
+	if _, ok := verifyTOTP(rfcSecret, old, now, 0); ok {
+		t.Error("old code should be refused")
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := totpProvisioningURI("guest", rfcSecret)
+	if !strings.HasPrefix(uri, "otpauth://totp/irori:guest?") ||
+		!strings.Contains(uri, "secret="+rfcSecret) {
+		t.Error("unexpected uri", uri)
+	}
+}
+
+func TestVerify2FALockout(t *testing.T) {
+	db := newMemoryDocDb()
+	u := addTestUser(t, db, "alice")
+	u.TOTPEnabled, u.TOTPSecret = true, rfcSecret
+	if err := db.Users.SetTOTP(u.Id, totpSettings{Enabled: true, Secret: rfcSecret}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1234567890, 0)
+	for i := 1; i < TOTP_MAX_FAILURES; i++ {
+		if ok, err := verify2FA(db, u, "000000", "", now); ok || err != nil {
+			t.Fatal("wrong code should fail:", ok, err)
+		}
+	}
+	if _, err := verify2FA(db, u, "000000", "", now); err != ErrTOTPLocked {
+		t.Fatal("too many wrong codes should lock:", err)
+	}
+
+	// a new login reads the user again
+	u, _ = db.Users.Get(u.Id)
+	code, _ := totpCode(rfcSecret, totpStep(now))
+	if _, err := verify2FA(db, u, code, "", now.Add(time.Minute)); err != ErrTOTPLocked {
+		t.Fatal("the lockout should outlive the login:", err)
+	}
+
+	later := now.Add(TOTP_LOCKOUT + time.Minute)
+	code, _ = totpCode(rfcSecret, totpStep(later))
+	if ok, err := verify2FA(db, u, code, "", later); !ok || err != nil {
+		t.Fatal("right code should pass after the lockout:", ok, err)
+	}
+	if u, _ = db.Users.Get(u.Id); u.TOTPFailures != 0 {
+		t.Error("failures should be reset:", u.TOTPFailures)
+	}
+}
+
+func TestVerify2FAConcurrent(t *testing.T) {
+	db := newMemoryDocDb()
+	u := addTestUser(t, db, "alice")
+	if err := db.Users.SetTOTP(u.Id, totpSettings{Enabled: true, Secret: rfcSecret}); err != nil {
+		t.Fatal(err)
+	}
+
+	// every login reads the user before any of them checks its code
+	now := time.Unix(1234567890, 0)
+	verify := func(code string) (passed int, locked int) {
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for i := 0; i < 2*TOTP_MAX_FAILURES; i++ {
+			login, _ := db.Users.Get(u.Id)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ok, err := verify2FA(db, login, code, "", now)
+				mu.Lock()
+				defer mu.Unlock()
+				if ok {
+					passed++
+				} else if err == ErrTOTPLocked {
+					locked++
+				} else if err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		return
+	}
+
+	code, _ := totpCode(rfcSecret, totpStep(now))
+	if passed, _ := verify(code); passed != 1 {
+		t.Fatal("a code should be used once:", passed)
+	}
+	// the replays counted as wrong codes
+	if err := db.Users.ResetTOTPFailures(u.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Minute)
+	if passed, locked := verify("000000"); passed != 0 || locked != TOTP_MAX_FAILURES+1 {
+		t.Error("the wrong codes after the limit should be locked out:", passed, locked)
+	}
+	if u, _ = db.Users.Get(u.Id); u.TOTPFailures != TOTP_MAX_FAILURES {
+		t.Error("failures beyond the limit should not count:", u.TOTPFailures)
+	}
+
+	code, _ = totpCode(rfcSecret, totpStep(now))
+	if passed, _ := verify(code); passed != 0 {
+		t.Error("the right code should not pass the lockout:", passed)
+	}
+}
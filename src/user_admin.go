@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/flosch/pongo2"
+	"github.com/zenazn/goji/web"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// editedUser is the body of PUT /api/users/:userId. Fields left out are not
+// changed.
+type editedUser struct {
+	Name     *string        `json:"name"`
+	Email    *string        `json:"email"`
+	Roles    *[]roleBinding `json:"roles"`
+	Disabled *bool          `json:"disabled"`
+	Password *string        `json:"password"`
+}
+
+// userConflict returns a validation error when another user already uses
+// the value of field. An empty id checks against every user.
+func userConflict(db *docdb, id primitive.ObjectID, field string, value string) (*validationError, error) {
+	find := db.Users.FindByName
+	if field == "email" {
+		find = db.Users.FindByEmail
+	}
+
+	other, err := find(value)
+	if err == ErrNotFound || (err == nil && other.Id == id) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &validationError{Field: field, Code: "taken", Message: field + " is already used by another user"}, nil
+}
+
+// sameBindings compares role bindings ignoring their order.
+func sameBindings(a []roleBinding, b []roleBinding) bool {
+	count := map[roleBinding]int{}
+	for _, rb := range a {
+		count[rb]++
+	}
+	for _, rb := range b {
+		count[rb]--
+	}
+	for _, n := range count {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func apiUserPutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(c)
+
+	uid := c.URLParams["userId"]
+	if !isObjectIdHex(uid) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	defer r.Body.Close()
+	var e editedUser
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	docdb := getDocDb(c)
+	u, err := getUserById(docdb, objectIdHex(uid))
+	if err == ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("apiUserPutHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if ok, err := canManageAccount(docdb, me, u); err != nil {
+		log.Println("apiUserPutHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	before := summarizeUser(u)
+	edited := *u
+	var errs []validationError
+
+	if e.Name != nil && *e.Name != u.Name {
+		if len(*e.Name) < 4 {
+			errs = append(errs, validationError{Field: "name", Code: "too_short", Message: "name must be at least 4 characters"})
+		} else if ve, err := userConflict(docdb, u.Id, "name", *e.Name); err != nil {
+			log.Println("apiUserPutHandler: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if ve != nil {
+			errs = append(errs, *ve)
+		}
+		edited.Name = *e.Name
+	}
+
+	if e.Email != nil && *e.Email != u.EMail {
+		if *e.Email == "" {
+			errs = append(errs, validationError{Field: "email", Code: "required", Message: "email is required"})
+		} else if ve, err := userConflict(docdb, u.Id, "email", *e.Email); err != nil {
+			log.Println("apiUserPutHandler: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if ve != nil {
+			errs = append(errs, *ve)
+		}
+		edited.EMail = *e.Email
+	}
+
+	if e.Password != nil {
+		name := u.Name
+		if e.Name != nil {
+			name = *e.Name
+		}
+		errs = append(errs, validatePassword("password", *e.Password, name)...)
+	}
+
+	if e.Roles != nil && !sameBindings(*e.Roles, u.bindings()) {
+		// granting roles is reserved to the site admin
+		if !me.HasPermission(ADMIN) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !verifyBindings(docdb, *e.Roles) {
+			errs = append(errs, validationError{Field: "roles", Code: "unknown_role", Message: "unknown role"})
+		}
+		edited.Roles = *e.Roles
+		edited.Permissions = nil
+	}
+
+	if e.Disabled != nil && *e.Disabled != u.Disabled {
+		if u.Id == me.Id {
+			errs = append(errs, validationError{Field: "disabled", Code: "self", Message: "you can not disable or enable yourself"})
+		}
+		edited.Disabled = *e.Disabled
+	}
+
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	// hash only a password that passed the policy
+	if e.Password != nil {
+		edited.Password = HashPassword(*e.Password)
+	}
+
+	// only the fields edited are saved, keeping the changes made to the
+	// others meanwhile
+	err = nil
+	if edited.Name != u.Name || edited.EMail != u.EMail {
+		err = docdb.Users.SetNameAndEmail(u.Id, edited.Name, edited.EMail)
+	}
+	if err == nil && e.Password != nil {
+		err = docdb.Users.SetPassword(u.Id, edited.Password)
+	}
+	if err == nil && e.Roles != nil && !sameBindings(*e.Roles, u.bindings()) {
+		err = docdb.Users.SetRoles(u.Id, edited.Roles)
+	}
+	if err == nil && edited.Disabled != u.Disabled {
+		err = docdb.Users.SetDisabled(u.Id, edited.Disabled)
+	}
+	if err != nil {
+		log.Println("apiUserPutHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	u = &edited
+
+	after := summarizeUser(u)
+	after.PasswordChanged = e.Password != nil
+	recordAudit(docdb, r, getSessionUser(c), "user.update", "user:"+u.Id.Hex(), before, after)
+
+	js, _ := json.Marshal(u)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func userEditHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	userId := c.URLParams["userId"]
+	if !isObjectIdHex(userId) {
+		log.Println("invalid userId:", userId)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	executeWriterFromFile(w, "view/edit-user.html", &pongo2.Context{
+		"loginuser": getSessionUser(c),
+		"userid":    userId,
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUserAdminHandlers(t *testing.T) {
+	db := newMemoryDocDb()
+	admin := addTestUser(t, db, "admin", ADMIN)
+	if err := db.Users.SetRoles(admin.Id, []roleBinding{{Role: string(ADMIN)}}); err != nil {
+		t.Fatal(err)
+	}
+	manager := addTestUser(t, db, "manager", USER_MANAGE)
+	carol := addTestUser(t, db, "carol")
+
+	params := map[string]string{"userId": admin.Id.Hex()}
+	if w := serve(db, manager, apiUserPutHandler, params, "PUT", "/api/users/"+admin.Id.Hex(), `{"email":"mine@example.com"}`); w.Code != http.StatusUnauthorized {
+		t.Error("user manager should not change the email of an admin:", w.Code)
+	}
+	if w := serve(db, manager, apiUserPutHandler, params, "PUT", "/api/users/"+admin.Id.Hex(), `{"disabled":true}`); w.Code != http.StatusUnauthorized {
+		t.Error("user manager should not disable an admin:", w.Code)
+	}
+	if w := serve(db, manager, apiUserPasswordResetPostHandler, params, "POST", "/api/users/"+admin.Id.Hex()+"/password_reset", ""); w.Code != http.StatusUnauthorized {
+		t.Error("user manager should not reset the password of an admin:", w.Code)
+	}
+	if w := serve(db, manager, apiUserDeleteHandler, params, "DELETE", "/api/users/"+admin.Id.Hex(), ""); w.Code != http.StatusUnauthorized {
+		t.Error("user manager should not delete an admin:", w.Code)
+	}
+	if u, _ := db.Users.Get(admin.Id); u.EMail != "admin@example.com" || u.Disabled {
+		t.Error("admin should be unchanged:", u)
+	}
+
+	params = map[string]string{"userId": carol.Id.Hex()}
+	if w := serve(db, manager, apiUserPutHandler, params, "PUT", "/api/users/"+carol.Id.Hex(), `{"email":"carol@example.org"}`); w.Code != http.StatusOK {
+		t.Error("user manager should change other users:", w.Code, w.Body.String())
+	}
+	if u, _ := db.Users.Get(carol.Id); u.EMail != "carol@example.org" {
+		t.Error("email should be changed:", u.EMail)
+	}
+
+	params = map[string]string{"userId": admin.Id.Hex()}
+	if w := serve(db, admin, apiUserPutHandler, params, "PUT", "/api/users/"+admin.Id.Hex(), `{"disabled":true}`); w.Code != http.StatusBadRequest {
+		t.Error("users should not disable themselves:", w.Code)
+	}
+	if w := serve(db, admin, apiUserPutHandler, params, "PUT", "/api/users/"+admin.Id.Hex(), `{"email":"root@example.com"}`); w.Code != http.StatusOK {
+		t.Error("admin should change its own account:", w.Code)
+	}
+}
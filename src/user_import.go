@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const INVITATION_EXPIRE = 7 * 24 * time.Hour
+
+// max size of an uploaded csv
+const USER_IMPORT_MAX_SIZE = 1 << 20
+
+var userCSVHeader = []string{"name", "email", "groups", "permissions"}
+
+type importRow struct {
+	Row         int               `json:"row"`
+	Name        string            `json:"name"`
+	Email       string            `json:"email"`
+	Groups      []string          `json:"groups"`
+	Permissions []string          `json:"permissions"`
+	Status      string            `json:"status"` // ok, created, error
+	Errors      []validationError `json:"errors,omitempty"`
+}
+
+type importReport struct {
+	DryRun  bool        `json:"dryRun"`
+	Created int         `json:"created"`
+	Failed  int         `json:"failed"`
+	Rows    []importRow `json:"rows"`
+}
+
+// splitList splits a ';' separated csv cell.
+func splitList(s string) []string {
+	list := []string{}
+	for _, v := range strings.Split(s, ";") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// csvCell escapes a value that a spreadsheet would read as a formula.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// unescapeCSVCell reverts csvCell, for the exported files imported back.
+func unescapeCSVCell(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.ContainsRune("=+-@\t\r", rune(s[1])) {
+		return s[1:]
+	}
+	return s
+}
+
+// parseUserCSV reads rows of name, email, groups, permissions. A header row
+// is skipped when present.
+func parseUserCSV(r io.Reader) ([]importRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []importRow
+	for i, rec := range records {
+		if i == 0 && len(rec) > 0 && strings.EqualFold(strings.TrimSpace(rec[0]), "name") {
+			continue
+		}
+
+		for len(rec) < len(userCSVHeader) {
+			rec = append(rec, "")
+		}
+
+		rows = append(rows, importRow{
+			Row:         i + 1,
+			Name:        unescapeCSVCell(strings.TrimSpace(rec[0])),
+			Email:       unescapeCSVCell(strings.TrimSpace(rec[1])),
+			Groups:      splitList(unescapeCSVCell(rec[2])),
+			Permissions: splitList(unescapeCSVCell(rec[3])),
+		})
+	}
+	return rows, nil
+}
+
+// validateImportRows checks every row against the database and against the
+// other rows of the import.
+func validateImportRows(db *docdb, me *user, rows []importRow) error {
+	names := map[string]int{}
+	emails := map[string]int{}
+
+	groups, err := db.Groups.List(groupQuery{})
+	if err != nil {
+		return err
+	}
+	groupsByName := map[string]*group{}
+	for i := range groups {
+		groupsByName[groups[i].Name] = &groups[i]
+	}
+
+	for i := range rows {
+		row := &rows[i]
+		add := func(field string, code string, msg string) {
+			row.Errors = append(row.Errors, validationError{Field: field, Code: code, Message: msg})
+		}
+
+		if len(row.Name) < 4 {
+			add("name", "too_short", "name must be at least 4 characters")
+		} else if n, ok := names[row.Name]; ok {
+			add("name", "duplicate", fmt.Sprintf("name is duplicated in row %d", n))
+		} else if ve, err := userConflict(db, primitive.NilObjectID, "name", row.Name); err != nil {
+			return err
+		} else if ve != nil {
+			add("name", "duplicate", "name is already registered")
+		}
+		names[row.Name] = row.Row
+
+		if !strings.Contains(row.Email, "@") {
+			add("email", "invalid", "email is invalid")
+		} else if n, ok := emails[row.Email]; ok {
+			add("email", "duplicate", fmt.Sprintf("email is duplicated in row %d", n))
+		} else if ve, err := userConflict(db, primitive.NilObjectID, "email", row.Email); err != nil {
+			return err
+		} else if ve != nil {
+			add("email", "duplicate", "email is already registered")
+		}
+		emails[row.Email] = row.Row
+
+		for _, name := range row.Groups {
+			g, ok := groupsByName[name]
+			if !ok {
+				add("groups", "unknown_group", "unknown group: "+name)
+			} else if len(g.Roles) > 0 && !me.HasPermission(ADMIN) {
+				// members get the roles of the group
+				add("groups", "forbidden", "only admin can add members to group with roles: "+name)
+			}
+		}
+
+		for _, p := range row.Permissions {
+			if !verifyBindings(db, []roleBinding{{Role: p}}) {
+				add("permissions", "unknown_role", "unknown role: "+p)
+			} else if p != string(EDITOR) && !me.HasPermission(ADMIN) {
+				add("permissions", "forbidden", "only admin can grant role: "+p)
+			}
+		}
+
+		if len(row.Errors) > 0 {
+			row.Status = "error"
+		} else {
+			row.Status = "ok"
+		}
+	}
+
+	return nil
+}
+
+func sendInvitationMail(db *docdb, u *user) error {
+	token, err := createPasswordReset(db, u, INVITATION_EXPIRE)
+	if err != nil {
+		return err
+	}
+
+	link := siteURL("/password/reset?token=" + url.QueryEscape(token))
+	body := fmt.Sprintf("Hello %s,\n\nAn account on irori has been created for you.\nOpen the link below within %d days to set your password.\n\n%s\n",
+		u.Name, int(INVITATION_EXPIRE/(24*time.Hour)), link)
+
+	return sendMail(u.EMail, "[irori] Invitation", body)
+}
+
+func importUser(db *docdb, row *importRow) (*user, error) {
+	u := &user{
+		Id:       primitive.NewObjectID(),
+		Name:     row.Name,
+		EMail:    row.Email,
+		Roles:    []roleBinding{},
+		Disabled: false,
+	}
+	for _, p := range row.Permissions {
+		u.Roles = append(u.Roles, roleBinding{Role: p})
+	}
+	if len(u.Roles) == 0 {
+		u.Roles = []roleBinding{{Role: string(EDITOR)}}
+	}
+
+	// the password is chosen by the user through the invitation
+	err := db.Users.Insert(u)
+	if err == ErrDuplicate {
+		return nil, fmt.Errorf("name or email already exists: %s <%s>", u.Name, u.EMail)
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, name := range row.Groups {
+		g, err := db.Groups.FindByName(name)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if err := db.Groups.AddMember(g.Id, u.Id); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := sendInvitationMail(db, u); err != nil {
+		log.Println("importUser: invitation failed: ", err)
+	}
+
+	return u, nil
+}
+
+// readUploadedCSV accepts either a multipart "file" field or a raw csv body.
+func readUploadedCSV(r *http.Request) ([]importRow, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(USER_IMPORT_MAX_SIZE); err != nil {
+			return nil, err
+		}
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return parseUserCSV(f)
+	}
+
+	defer r.Body.Close()
+	return parseUserCSV(io.LimitReader(r.Body, USER_IMPORT_MAX_SIZE))
+}
+
+func apiUserImportPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(c)
+	docdb := getDocDb(c)
+
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+
+	rows, err := readUploadedCSV(r)
+	if err != nil {
+		log.Println("apiUserImportPostHandler: ", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateImportRows(docdb, me, rows); err != nil {
+		log.Println("apiUserImportPostHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	report := importReport{DryRun: dryRun, Rows: rows}
+	for i := range report.Rows {
+		row := &report.Rows[i]
+		if row.Status != "ok" {
+			report.Failed++
+			continue
+		}
+		if dryRun {
+			continue
+		}
+
+		u, err := importUser(docdb, row)
+		if err != nil {
+			log.Println("apiUserImportPostHandler: ", err)
+			row.Status = "error"
+			row.Errors = append(row.Errors, validationError{Field: "row", Code: "failed", Message: err.Error()})
+			report.Failed++
+			continue
+		}
+		row.Status = "created"
+		report.Created++
+		recordAudit(docdb, r, getSessionUser(c), "user.import", "user:"+u.Id.Hex(), nil, summarizeUser(u))
+	}
+
+	js, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func apiUserExportGetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	docdb := getDocDb(c)
+
+	users, err := docdb.Users.List(true)
+	if err != nil {
+		log.Println("apiUserExportGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	groups, err := docdb.Groups.List(groupQuery{})
+	if err != nil {
+		log.Println("apiUserExportGetHandler: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	groupsOf := map[primitive.ObjectID][]string{}
+	for _, g := range groups {
+		for _, uid := range g.Users {
+			groupsOf[uid] = append(groupsOf[uid], g.Name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+
+	cw := csv.NewWriter(w)
+	cw.Write(append(userCSVHeader, "disabled"))
+	for _, u := range users {
+		var roles []string
+		for _, b := range u.bindings() {
+			if b.Project.IsZero() {
+				roles = append(roles, b.Role)
+			}
+		}
+		cw.Write([]string{
+			csvCell(u.Name),
+			csvCell(u.EMail),
+			csvCell(strings.Join(groupsOf[u.Id], ";")),
+			csvCell(strings.Join(roles, ";")),
+			strconv.FormatBool(u.Disabled),
+		})
+	}
+	cw.Flush()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseUserCSV(t *testing.T) {
+	data := `name,email,groups,permissions
+alice,alice@example.com,dev;ops,editor
+bob,bob@example.com
+`
+	rows, err := parseUserCSV(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 2 {
+		t.Fatal("unexpected rows", rows)
+	}
+
+	a := rows[0]
+	if a.Row != 2 || a.Name != "alice" || a.Email != "alice@example.com" ||
+		len(a.Groups) != 2 || a.Groups[1] != "ops" || len(a.Permissions) != 1 {
+		t.Error("unexpected row", a)
+	}
+
+	b := rows[1]
+	if b.Name != "bob" || len(b.Groups) != 0 || len(b.Permissions) != 0 {
+		t.Error("unexpected row", b)
+	}
+}
+
+func TestValidateImportRowsGroupRoles(t *testing.T) {
+	db := newMemoryDocDb()
+	manager := addTestUser(t, db, "manager", USER_MANAGE)
+	admin := addTestUser(t, db, "admin", ADMIN)
+	for _, g := range []*group{{Name: "dev"}, {Name: "ops", Roles: []roleBinding{{Role: string(EDITOR)}}}} {
+		if err := db.Groups.Insert(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows := []importRow{
+		{Row: 1, Name: "carol", Email: "carol@example.com", Groups: []string{"dev"}},
+		{Row: 2, Name: "dave", Email: "dave@example.com", Groups: []string{"ops"}},
+	}
+	if err := validateImportRows(db, manager, rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows[0].Status != "ok" || rows[1].Status != "error" || rows[1].Errors[0].Code != "forbidden" {
+		t.Error("only admin should import members of groups with roles:", rows)
+	}
+
+	rows[1].Errors = nil
+	if err := validateImportRows(db, admin, rows[1:]); err != nil || rows[1].Status != "ok" {
+		t.Error("admin should import members of groups with roles:", rows[1], err)
+	}
+}
+
+func TestUserExportEscapesFormulas(t *testing.T) {
+	db := newMemoryDocDb()
+	admin := addTestUser(t, db, "admin", ADMIN)
+	addTestUser(t, db, "=HYPERLINK(\"http://example.com\")")
+
+	w := serve(db, admin, apiUserExportGetHandler, nil, "GET", "/api/users/export", "")
+	if !strings.Contains(w.Body.String(), "\"'=HYPERLINK(") {
+		t.Fatal("formula should be escaped:", w.Body.String())
+	}
+
+	rows, err := parseUserCSV(strings.NewReader(w.Body.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Name != "=HYPERLINK(\"http://example.com\")" {
+		t.Error("escaped cells should be imported back:", rows)
+	}
+}